@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/env"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/crc-org/macadam/pkg/shim"
+	"github.com/crc-org/macadam/pkg/spec"
+	"github.com/spf13/cobra"
+)
+
+var (
+	applyCmd = &cobra.Command{
+		Use:   "apply [options] -f FILE",
+		Short: "Create or update a machine from a spec file",
+		Long: `Create or update a machine from a YAML or JSON spec file.
+
+The machine is created when it does not exist. Otherwise the settings which can
+be changed in place are reconciled, and the ones which require recreating the
+machine are reported.`,
+		RunE: apply,
+		Args: cobra.NoArgs,
+		Example: `macadam apply -f machine.yaml
+  cat machine.json | macadam apply -f -`,
+	}
+	applyFlag = applyFlagType{}
+)
+
+type applyFlagType struct {
+	file     string
+	progress string
+}
+
+func init() {
+	rootCmd.AddCommand(applyCmd)
+
+	flags := applyCmd.Flags()
+	flags.StringVarP(&applyFlag.file, "file", "f", "", "Path to the machine spec file, - reads it from stdin")
+	flags.StringVar(&applyFlag.progress, "progress", progressBar, "Image download progress output: bar, json or none")
+	_ = applyCmd.MarkFlagRequired("file")
+}
+
+func apply(_ *cobra.Command, _ []string) error {
+	progress, err := newProgressFunc(applyFlag.progress)
+	if err != nil {
+		return err
+	}
+	out := messageOutput(applyFlag.progress)
+
+	s, err := spec.Load(applyFlag.file)
+	if err != nil {
+		return err
+	}
+	if s.Name == "" {
+		s.Name = defaultMachineName
+	}
+
+	dirs, err := env.GetMachineDirs(provider.VMType())
+	if err != nil {
+		return err
+	}
+	mc, err := vmconfigs.LoadMachineByName(s.Name, dirs)
+	var notExistErr *define.ErrVMDoesNotExist
+	if errors.As(err, &notExistErr) {
+		opts := s.InitOptions(containersConfig)
+		opts.ImagePull.Progress = progress
+		if err := createMachine(opts); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Machine %q created\n", s.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return err
+	}
+
+	setOpts, changes, recreate := s.Diff(mc, macadamConfig, provider)
+	if len(changes) > 0 {
+		if err := shim.Set(mc, provider, setOpts); err != nil {
+			return err
+		}
+		// not all the providers can change the networking mode
+		if s.UserModeNetworking != nil && provider.UserModeNetworkEnabled(mc) != *s.UserModeNetworking {
+			for i, change := range changes {
+				if change.Field == "userModeNetworking" {
+					changes = append(changes[:i], changes[i+1:]...)
+					recreate = append(recreate, change)
+					break
+				}
+			}
+		}
+	}
+
+	for _, change := range changes {
+		fmt.Fprintf(out, "Updated %s\n", change)
+	}
+	if len(recreate) == 0 {
+		if len(changes) == 0 {
+			fmt.Fprintf(out, "Machine %q is up to date\n", mc.Name)
+		}
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "The following settings of machine %q can only be changed by recreating it:\n", mc.Name)
+	for _, change := range recreate {
+		fmt.Fprintf(os.Stderr, "\t%s\n", change)
+	}
+	return fmt.Errorf("machine %q does not match the spec, %d setting(s) require recreating it", mc.Name, len(recreate))
+}
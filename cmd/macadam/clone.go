@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/crc-org/macadam/pkg/shim"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cloneCmd = &cobra.Command{
+		Use:   "clone SOURCE DESTINATION",
+		Short: "Clone a stopped machine",
+		Long: `Create a new machine from the disk and settings of a stopped machine.
+The clone gets its own SSH port. Cloud-init machines are provisioned again with the
+clone name as hostname. Ignition only runs on the first start of a machine, ignition
+machines can only be cloned before they are started.`,
+		RunE:    clone,
+		Args:    cobra.ExactArgs(2),
+		Example: `macadam clone myvm myvm-copy`,
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(cloneCmd)
+}
+
+func clone(_ *cobra.Command, args []string) error {
+	src, _, err := loadMachine(args[:1])
+	if err != nil {
+		return err
+	}
+	if err := shim.ValidateMachineName(args[1]); err != nil {
+		return err
+	}
+
+	if err := shim.Clone(src, provider, args[1]); err != nil {
+		return err
+	}
+	fmt.Printf("Machine %q cloned to %q\n", src.Name, args[1])
+	return nil
+}
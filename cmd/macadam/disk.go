@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/containers/common/pkg/strongunits"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/crc-org/macadam/pkg/shim"
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+)
+
+const defaultDiskListFormat = "{{range .}}{{.Name}}\t{{.Serial}}\t{{.Size}}\t{{.Format}}\t{{.Path}}\n{{end -}}"
+
+var (
+	diskCmd = &cobra.Command{
+		Use:   "disk",
+		Short: "Manage machine data disks",
+		Long:  "Manage the disks attached to a machine besides its boot disk",
+	}
+	diskAddCmd = &cobra.Command{
+		Use:   "add [options] [MACHINE] NAME",
+		Short: "Attach a data disk",
+		Long: `Attach an empty disk of the given size or an existing image file to a stopped machine.
+The guest finds the disk as /dev/disk/by-id/virtio-SERIAL. Empty disks are deleted
+along with the machine, image files are attached in place and never deleted.`,
+		RunE: diskAdd,
+		Args: cobra.RangeArgs(1, 2),
+		Example: `macadam disk add --size 20 myvm pgdata
+macadam disk add --image /data/pgdata.qcow2 myvm pgdata`,
+	}
+	diskLsCmd = &cobra.Command{
+		Use:     "list [options] [MACHINE]",
+		Aliases: []string{"ls"},
+		Short:   "List data disks",
+		Long:    "List the data disks of a machine",
+		RunE:    diskList,
+		Args:    cobra.MaximumNArgs(1),
+		Example: `macadam disk ls myvm`,
+	}
+	diskRmCmd = &cobra.Command{
+		Use:     "rm [MACHINE] NAME",
+		Short:   "Detach a data disk",
+		Long:    "Detach a data disk from a stopped machine, empty disks created by macadam are deleted",
+		RunE:    diskRm,
+		Args:    cobra.RangeArgs(1, 2),
+		Example: `macadam disk rm myvm pgdata`,
+	}
+	diskAddFlag = diskAddFlagType{}
+	diskLsFlag  = diskLsFlagType{}
+)
+
+type diskAddFlagType struct {
+	size   uint64
+	image  string
+	serial string
+}
+
+type diskLsFlagType struct {
+	format    string
+	noHeading bool
+	quiet     bool
+}
+
+// DiskReporter is the machine data disk which is displayed to the user
+type DiskReporter struct {
+	Name   string
+	Serial string
+	Size   string
+	Format string
+	Path   string
+}
+
+func init() {
+	rootCmd.AddCommand(diskCmd)
+	diskCmd.AddCommand(diskAddCmd, diskLsCmd, diskRmCmd)
+
+	addFlags := diskAddCmd.Flags()
+	addFlags.Uint64Var(&diskAddFlag.size, "size", 0, "Size in GiB of the empty disk to create")
+	addFlags.StringVar(&diskAddFlag.image, "image", "", "Existing disk image file to attach")
+	addFlags.StringVar(&diskAddFlag.serial, "serial", "", "Serial number of the disk in the guest, defaults to its name")
+	diskAddCmd.MarkFlagsMutuallyExclusive("size", "image")
+
+	lsFlags := diskLsCmd.Flags()
+	lsFlags.StringVar(&diskLsFlag.format, "format", defaultDiskListFormat, "Format disk output using JSON or a Go template")
+	lsFlags.BoolVarP(&diskLsFlag.noHeading, "noheading", "n", false, "Do not print headers")
+	lsFlags.BoolVarP(&diskLsFlag.quiet, "quiet", "q", false, "Show only disk names")
+}
+
+func diskAdd(_ *cobra.Command, args []string) error {
+	if diskAddFlag.size == 0 && diskAddFlag.image == "" {
+		return errors.New("one of --size or --image is required")
+	}
+	machineArgs, name := namedArgs(args)
+	mc, _, err := loadMachine(machineArgs)
+	if err != nil {
+		return err
+	}
+
+	opts := shim.DataDiskOptions{
+		Name:   name,
+		Serial: diskAddFlag.serial,
+		Size:   strongunits.GiB(diskAddFlag.size),
+		Image:  diskAddFlag.image,
+	}
+	disk, err := shim.AddDataDisk(mc, provider, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Disk %q attached to machine %q as /dev/disk/by-id/virtio-%s\n", disk.Name, mc.Name, disk.Serial)
+	return nil
+}
+
+func diskRm(_ *cobra.Command, args []string) error {
+	machineArgs, name := namedArgs(args)
+	mc, _, err := loadMachine(machineArgs)
+	if err != nil {
+		return err
+	}
+
+	if err := shim.RemoveDataDisk(mc, provider, name); err != nil {
+		return err
+	}
+	fmt.Println(name)
+	return nil
+}
+
+func diskList(cmd *cobra.Command, args []string) error {
+	mc, _, err := loadMachine(args)
+	if err != nil {
+		return err
+	}
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return err
+	}
+
+	if isJSONFormat(diskLsFlag.format) {
+		disks := macadamConfig.DataDisks
+		if disks == nil {
+			disks = []machineconfig.DataDisk{}
+		}
+		b, err := json.MarshalIndent(disks, "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(os.Stdout, string(b))
+		return err
+	}
+
+	format := diskLsFlag.format
+	renderHeaders := !diskLsFlag.noHeading
+	switch {
+	case cmd.Flag("format").Changed:
+		// user provided templates are rendered as-is
+		renderHeaders = false
+	case diskLsFlag.quiet:
+		format = "{{range .}}{{.Name}}\n{{end -}}"
+		renderHeaders = false
+	}
+
+	tmpl, err := template.New("disk list").Parse(format)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 8, 2, 2, ' ', 0)
+	defer w.Flush()
+
+	if renderHeaders {
+		headers := []string{"NAME", "SERIAL", "SIZE", "FORMAT", "PATH"}
+		if _, err := fmt.Fprintln(w, strings.Join(headers, "\t")); err != nil {
+			return fmt.Errorf("failed to write report column headers: %w", err)
+		}
+	}
+	return tmpl.Execute(w, toDiskReporters(macadamConfig.DataDisks, !cmd.Flag("format").Changed))
+}
+
+func toDiskReporters(disks []machineconfig.DataDisk, human bool) []*DiskReporter {
+	reporters := make([]*DiskReporter, 0, len(disks))
+	for _, d := range disks {
+		r := &DiskReporter{
+			Name:   d.Name,
+			Serial: d.Serial,
+			Size:   fmt.Sprint(d.Size),
+			Format: d.Format,
+			Path:   d.Path,
+		}
+		if human {
+			r.Size = units.BytesSize(float64(d.Size))
+		}
+		reporters = append(reporters, r)
+	}
+	return reporters
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/crc-org/macadam/pkg/shim"
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportCmd = &cobra.Command{
+		Use:   "export [options] [MACHINE]",
+		Short: "Export a stopped machine to a bundle",
+		Long: `Write the disk, settings, ignition file and mounts of a stopped machine to a
+zstd compressed bundle which can be imported on another host with "macadam import".
+Internal snapshots, data disks and socket forwards are not exported.`,
+		RunE:    export,
+		Args:    cobra.MaximumNArgs(1),
+		Example: `macadam export -o myvm.tar.zst myvm`,
+	}
+	exportFlag = exportFlagType{}
+)
+
+type exportFlagType struct {
+	output        string
+	includeSSHKey bool
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+
+	flags := exportCmd.Flags()
+	flags.StringVarP(&exportFlag.output, "output", "o", "", "Path of the bundle to write")
+	_ = exportCmd.MarkFlagRequired("output")
+	flags.BoolVar(&exportFlag.includeSSHKey, "include-ssh-key", false, "Add the SSH key pair of the machine to the bundle, the guest only authorizes the key it was provisioned with")
+}
+
+func export(_ *cobra.Command, args []string) error {
+	mc, _, err := loadMachine(args)
+	if err != nil {
+		return err
+	}
+
+	opts := shim.ExportOptions{
+		IncludeSSHKey: exportFlag.includeSSHKey,
+	}
+	if err := shim.Export(mc, provider, exportFlag.output, opts); err != nil {
+		return err
+	}
+	fmt.Printf("Machine %q exported to %s\n", mc.Name, exportFlag.output)
+	return nil
+}
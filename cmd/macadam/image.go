@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/env"
+	"github.com/crc-org/macadam/pkg/imagecache"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+)
+
+const defaultImageListFormat = "{{range .}}{{.Key}}\t{{.Kind}}\t{{.Source}}\t{{.Format}}\t{{.Size}}\t{{.Created}}\t{{.LastUsed}}\t{{join .Machines \", \"}}\n{{end -}}"
+
+var (
+	imageCmd = &cobra.Command{
+		Use:   "image",
+		Short: "Manage the image cache",
+		Long:  "Manage the cache of the disk images machines are created from",
+	}
+	imageLsCmd = &cobra.Command{
+		Use:     "list [options]",
+		Aliases: []string{"ls"},
+		Short:   "List cached images",
+		Long:    "List the disk images in the image cache",
+		RunE:    imageList,
+		Args:    cobra.NoArgs,
+		Example: `macadam image ls
+  macadam image ls --format json`,
+	}
+	imageRmCmd = &cobra.Command{
+		Use:     "rm [options] IMAGE...",
+		Short:   "Remove cached images",
+		Long:    "Remove disk images from the image cache, images are given by key, unique key prefix or source",
+		RunE:    imageRm,
+		Args:    cobra.MinimumNArgs(1),
+		Example: `macadam image rm 3f1a2b`,
+	}
+	imagePruneCmd = &cobra.Command{
+		Use:     "prune",
+		Short:   "Remove unused cached images",
+		Long:    "Remove the cached disk images no machine was created from",
+		RunE:    imagePrune,
+		Args:    cobra.NoArgs,
+		Example: `macadam image prune`,
+	}
+	imageLsFlag = imageLsFlagType{}
+	imageRmFlag = imageRmFlagType{}
+)
+
+type imageLsFlagType struct {
+	format    string
+	noHeading bool
+	quiet     bool
+}
+
+type imageRmFlagType struct {
+	force bool
+}
+
+// ImageReporter is the image cache entry which is displayed to the user
+type ImageReporter struct {
+	Key      string
+	Kind     imagecache.Kind
+	Source   string
+	Digest   string `json:",omitempty"`
+	Format   string `json:",omitempty"`
+	Path     string
+	Size     string
+	Created  string
+	LastUsed string
+	Machines []string
+}
+
+func init() {
+	rootCmd.AddCommand(imageCmd)
+	imageCmd.AddCommand(imageLsCmd, imageRmCmd, imagePruneCmd)
+
+	lsFlags := imageLsCmd.Flags()
+	lsFlags.StringVar(&imageLsFlag.format, "format", defaultImageListFormat, "Format image output using JSON or a Go template")
+	lsFlags.BoolVarP(&imageLsFlag.noHeading, "noheading", "n", false, "Do not print headers")
+	lsFlags.BoolVarP(&imageLsFlag.quiet, "quiet", "q", false, "Show only image keys")
+
+	rmFlags := imageRmCmd.Flags()
+	rmFlags.BoolVarP(&imageRmFlag.force, "force", "f", false, "Remove images machines were created from, QEMU machines using them as a backing file will not start anymore")
+}
+
+// imageCache returns the image cache of the current provider along with the
+// names of the machines created from each cached image
+func imageCache() (*imagecache.Cache, map[string][]string, error) {
+	dirs, err := env.GetMachineDirs(provider.VMType())
+	if err != nil {
+		return nil, nil, err
+	}
+	users, err := imageUsers(dirs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return imagecache.New(dirs, provider.VMType()), users, nil
+}
+
+func imageUsers(dirs *define.MachineDirs) (map[string][]string, error) {
+	mcs, err := vmconfigs.LoadMachinesInDir(dirs)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string][]string)
+	for name, mc := range mcs {
+		macadamConfig, err := machineconfig.Load(mc)
+		if err != nil {
+			return nil, err
+		}
+		if macadamConfig.CachedImage != "" {
+			users[macadamConfig.CachedImage] = append(users[macadamConfig.CachedImage], name)
+		}
+	}
+	return users, nil
+}
+
+func imageList(cmd *cobra.Command, _ []string) error {
+	cache, users, err := imageCache()
+	if err != nil {
+		return err
+	}
+	entries, err := cache.List()
+	if err != nil {
+		return err
+	}
+
+	if isJSONFormat(imageLsFlag.format) {
+		b, err := json.MarshalIndent(toImageReporters(cache, entries, users, false), "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(os.Stdout, string(b))
+		return err
+	}
+
+	format := imageLsFlag.format
+	renderHeaders := !imageLsFlag.noHeading
+	switch {
+	case cmd.Flag("format").Changed:
+		// user provided templates are rendered as-is
+		renderHeaders = false
+	case imageLsFlag.quiet:
+		format = "{{range .}}{{.Key}}\n{{end -}}"
+		renderHeaders = false
+	}
+
+	tmpl, err := template.New("image list").Funcs(template.FuncMap{"join": strings.Join}).Parse(format)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 8, 2, 2, ' ', 0)
+	defer w.Flush()
+
+	if renderHeaders {
+		headers := []string{"KEY", "KIND", "SOURCE", "FORMAT", "SIZE", "CREATED", "LAST USED", "MACHINES"}
+		if _, err := fmt.Fprintln(w, strings.Join(headers, "\t")); err != nil {
+			return fmt.Errorf("failed to write report column headers: %w", err)
+		}
+	}
+	return tmpl.Execute(w, toImageReporters(cache, entries, users, !cmd.Flag("format").Changed))
+}
+
+func toImageReporters(cache *imagecache.Cache, entries []*imagecache.Entry, users map[string][]string, human bool) []*ImageReporter {
+	reporters := make([]*ImageReporter, 0, len(entries))
+	for _, e := range entries {
+		r := &ImageReporter{
+			Key:      e.Key,
+			Kind:     e.Kind,
+			Source:   e.Source,
+			Digest:   e.Digest.String(),
+			Format:   string(e.Format),
+			Path:     cache.ImagePath(e),
+			Size:     fmt.Sprint(e.Size),
+			Created:  strTime(e.Created),
+			LastUsed: strTime(e.LastUsed),
+			Machines: users[e.Key],
+		}
+		if r.Machines == nil {
+			r.Machines = []string{}
+		}
+		if human {
+			r.Key = e.Key[:min(12, len(e.Key))]
+			r.Size = units.BytesSize(float64(e.Size))
+			r.Created = units.HumanDuration(time.Since(e.Created)) + " ago"
+			r.LastUsed = units.HumanDuration(time.Since(e.LastUsed)) + " ago"
+		}
+		reporters = append(reporters, r)
+	}
+	return reporters
+}
+
+func imageRm(_ *cobra.Command, args []string) error {
+	cache, users, err := imageCache()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, arg := range args {
+		e, err := cache.Find(arg)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if machines := users[e.Key]; len(machines) > 0 && !imageRmFlag.force {
+			errs = append(errs, fmt.Errorf("image %s is used by machines %s, use --force to remove it", e.Key, strings.Join(machines, ", ")))
+			continue
+		}
+		if err := cache.Remove(e); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fmt.Println(e.Key)
+	}
+	return errors.Join(errs...)
+}
+
+func imagePrune(_ *cobra.Command, _ []string) error {
+	cache, users, err := imageCache()
+	if err != nil {
+		return err
+	}
+
+	removed, err := cache.Prune(func(e *imagecache.Entry) bool {
+		return len(users[e.Key]) > 0
+	})
+	var reclaimed int64
+	for _, e := range removed {
+		fmt.Println(e.Key)
+		reclaimed += e.Size
+	}
+	fmt.Printf("Total reclaimed space: %s\n", units.BytesSize(float64(reclaimed)))
+	return err
+}
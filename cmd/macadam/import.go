@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/crc-org/macadam/pkg/shim"
+	"github.com/spf13/cobra"
+)
+
+var (
+	importCmd = &cobra.Command{
+		Use:   "import BUNDLE [NAME]",
+		Short: "Create a machine from a bundle",
+		Long: `Create a machine from a bundle written by "macadam export", named after the
+exported machine unless NAME is given. The machine gets its own SSH port and uses
+the SSH key pair of the bundle if any, the default key otherwise. Machines which
+never booted are provisioned again for this host. The host directories mounted by
+the bundle are only shared with the machine with --keep-mounts.`,
+		RunE:    importMachine,
+		Args:    cobra.RangeArgs(1, 2),
+		Example: `macadam import myvm.tar.zst`,
+	}
+	importFlag = importFlagType{}
+)
+
+type importFlagType struct {
+	keepMounts bool
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+
+	flags := importCmd.Flags()
+	flags.BoolVar(&importFlag.keepMounts, "keep-mounts", false, "Share the host directories mounted by the bundle with the machine")
+}
+
+func importMachine(_ *cobra.Command, args []string) error {
+	opts := shim.ImportOptions{
+		KeepMounts: importFlag.keepMounts,
+	}
+	if len(args) > 1 {
+		opts.Name = args[1]
+		if err := shim.ValidateMachineName(opts.Name); err != nil {
+			return err
+		}
+	}
+
+	name, err := shim.Import(args[0], provider, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Machine %q imported from %s\n", name, args[0])
+	return nil
+}
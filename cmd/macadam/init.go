@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	ldefine "github.com/containers/podman/v5/libpod/define"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/imagecache"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/crc-org/macadam/pkg/shim"
+	"github.com/spf13/cobra"
+)
+
+var (
+	initCmd = &cobra.Command{
+		Use:     "init [options] [NAME]",
+		Short:   "Initialize a virtual machine",
+		Long:    "Initialize a virtual machine",
+		RunE:    initMachine,
+		Args:    cobra.MaximumNArgs(1),
+		Example: `macadam init myvm`,
+	}
+
+	initOpts          = shim.InitOptions{}
+	initOptionalFlags = InitOptionalFlags{}
+	now               bool
+	forwardSockets    []string
+)
+
+// Flags which have a meaning when unspecified that differs from the flag default
+type InitOptionalFlags struct {
+	UserModeNetworking bool
+	Provisioner        string
+	Progress           string
+}
+
+func init() {
+	rootCmd.AddCommand(initCmd)
+
+	flags := initCmd.Flags()
+	cfg := containersConfig
+
+	flags.Uint64Var(&initOpts.CPUS, "cpus", cfg.Machine.CPUs, "Number of CPUs")
+	flags.Uint64Var(&initOpts.DiskSize, "disk-size", cfg.Machine.DiskSize, "Disk size in GiB")
+	flags.Uint64VarP(&initOpts.Memory, "memory", "m", cfg.Machine.Memory, "Memory in MiB")
+	flags.BoolVar(&now, "now", false, "Start machine now")
+
+	defaultTz := cfg.TZ()
+	if len(defaultTz) < 1 {
+		defaultTz = "local"
+	}
+	flags.StringVar(&initOpts.TimeZone, "timezone", defaultTz, "Set timezone")
+	flags.StringVar(&initOpts.Username, "username", cfg.Machine.User, "Username used in image")
+	flags.StringVar(&initOpts.Image, "image", cfg.Machine.Image, "Bootable image for machine")
+	flags.StringArrayVarP(&initOpts.Volumes, "volume", "v", cfg.Machine.Volumes.Get(), "Volumes to mount, source:target")
+	flags.StringArrayVar(&initOpts.USBs, "usb", []string{}, "USB Host passthrough: bus=$1,devnum=$2 or vendor=$1,product=$2")
+	flags.StringVar(&initOpts.IgnitionPath, "ignition-path", "", "Path to ignition file")
+	flags.BoolVar(&initOpts.Rootful, "rootful", false, "Whether this machine should prefer rootful container execution")
+	flags.BoolVar(&initOptionalFlags.UserModeNetworking, "user-mode-networking", false,
+		"Whether this machine should use user-mode networking, routing traffic through a host user-space process")
+	flags.StringArrayVar(&forwardSockets, "forward-socket", []string{}, "Guest socket to forward to the host, [USER@]GUEST_PATH:HOST where HOST is a socket path, a port or tcp://address:port")
+	flags.BoolVar(&initOpts.SkipPodmanConnection, "skip-podman-connection", false, "Do not register the machine in the podman system connections")
+	flags.StringVar(&initOpts.ImagePull.Verify.Digest, "image-digest", "", "Expected digest of the image, sha256:<hex> or sha512:<hex>")
+	flags.StringVar(&initOpts.ImagePull.Verify.Checksums, "image-checksums", "", "URL or path of a SHA256SUMS file listing the digest of the image")
+	flags.StringVar(&initOpts.ImagePull.Verify.Signature, "image-checksums-signature", "", "URL or path of the detached signature of the checksums file")
+	flags.StringVar(&initOpts.ImagePull.Verify.PublicKey, "image-verify-key", "", "GPG or sigstore public key the checksums file must be signed with")
+	flags.IntVar(&initOpts.ImagePull.Retries, "image-pull-retries", imagecache.DefaultRetries, "Number of times a failed image download is retried")
+	flags.DurationVar(&initOpts.ImagePull.RetryDelay, "image-pull-retry-delay", imagecache.DefaultRetryDelay, "Delay before retrying a failed image download, doubled after each attempt")
+	flags.StringVar(&initOpts.ImagePull.OCI.Repository, "image-repository", "", "Registry repository of the default image (default quay.io/podman/machine-os)")
+	flags.StringVar(&initOpts.ImagePull.OCI.Tag, "image-tag", "", "Tag of the default image, \"latest\" for the most recent one (default the podman version)")
+	flags.StringVar(&initOpts.ImagePull.OCI.Digest, "image-manifest-digest", "", "Pin the default image to the digest of its manifest list")
+	flags.StringVar(&initOpts.ImagePull.OCI.AuthFile, "image-authfile", "", "Path of the containers auth.json holding the registry credentials")
+	flags.StringVar(&initOpts.ImagePull.OCI.DiskType, "image-disktype", "", "disktype annotation of the OCI image artifact to use (default the provider disk type)")
+	flags.StringVar(&initOptionalFlags.Progress, "progress", progressBar, "Image download progress output: bar, json or none")
+	flags.StringVar(&initOptionalFlags.Provisioner, "provisioner", string(machineconfig.IgnitionProvisioner),
+		"How the machine is configured on first boot: ignition (Fedora CoreOS images) or cloud-init (generic cloud images)")
+}
+
+func initMachine(cmd *cobra.Command, args []string) error {
+	initOpts.Name = machineNameFromArgs(args)
+
+	// Only pass the user-mode networking option when the flag was explicitly
+	// set, so that the provider default is used otherwise
+	if cmd.Flags().Changed("user-mode-networking") {
+		initOpts.UserModeNetworking = &initOptionalFlags.UserModeNetworking
+	}
+
+	provisioner, err := machineconfig.ParseProvisioner(initOptionalFlags.Provisioner)
+	if err != nil {
+		return err
+	}
+	initOpts.Provisioner = provisioner
+
+	for _, input := range forwardSockets {
+		fwd, err := machineconfig.ParseSocketForward(input)
+		if err != nil {
+			return err
+		}
+		initOpts.SocketForwards = append(initOpts.SocketForwards, fwd)
+	}
+
+	if initOpts.ImagePull.Progress, err = newProgressFunc(initOptionalFlags.Progress); err != nil {
+		return err
+	}
+
+	if err := createMachine(initOpts); err != nil {
+		return err
+	}
+
+	out := messageOutput(initOptionalFlags.Progress)
+	fmt.Fprintln(out, "Machine init complete")
+
+	if now {
+		if initOptionalFlags.Progress == progressJSON {
+			// the tips of the provider are printed to stdout
+			startOpts.NoInfo = true
+		}
+		return startMachine(args, out)
+	}
+	extra := ""
+	if initOpts.Name != defaultMachineName {
+		extra = " " + initOpts.Name
+	}
+	fmt.Fprintf(out, "To start your machine run:\n\n\tmacadam start%s\n\n", extra)
+	return nil
+}
+
+// createMachine validates the options and creates the machine
+func createMachine(opts shim.InitOptions) error {
+	if err := shim.ValidateMachineName(opts.Name); err != nil {
+		return err
+	}
+
+	if !ldefine.NameRegex.MatchString(opts.Username) {
+		return fmt.Errorf("invalid username %q: %w", opts.Username, ldefine.RegexError)
+	}
+
+	// Check if machine already exists
+	_, exists, err := shim.VMExists(opts.Name, []vmconfigs.VMProvider{provider})
+	if err != nil {
+		return err
+	}
+
+	// machine exists, return error
+	if exists {
+		return fmt.Errorf("%s: %w", opts.Name, define.ErrVMAlreadyExists)
+	}
+
+	if err := opts.ImagePull.Verify.Validate(); err != nil {
+		return err
+	}
+	if err := opts.ImagePull.OCI.Validate(opts.Image); err != nil {
+		return err
+	}
+
+	for idx, vol := range opts.Volumes {
+		opts.Volumes[idx] = os.ExpandEnv(vol)
+	}
+
+	return shim.Init(opts, provider)
+}
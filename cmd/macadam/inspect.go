@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/env"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/spf13/cobra"
+)
+
+var (
+	inspectCmd = &cobra.Command{
+		Use:   "inspect [options] [MACHINE...]",
+		Short: "Inspect an existing machine",
+		Long:  "Provide details on a managed virtual machine",
+		RunE:  inspect,
+		Example: `macadam inspect myvm
+  macadam inspect --format '{{.State}}' myvm`,
+	}
+	inspectFlag = inspectFlagType{}
+)
+
+type inspectFlagType struct {
+	format string
+}
+
+// InspectInfo is the machine state which is displayed to the user
+type InspectInfo struct {
+	Name               string
+	VMType             string
+	ConfigDir          define.VMFile
+	Created            time.Time
+	LastUp             time.Time
+	State              define.Status
+	Resources          vmconfigs.ResourceConfig
+	SSHConfig          vmconfigs.SSHConfig
+	Connection         machineconfig.Connection
+	Mounts             []*vmconfigs.Mount
+	ImagePath          *define.VMFile
+	Provisioner        machineconfig.Provisioner
+	IgnitionPath       *define.VMFile `json:",omitempty"`
+	CloudInitISO       *define.VMFile `json:",omitempty"`
+	Sockets            InspectSockets
+	SavedState         *machineconfig.SavedState `json:",omitempty"`
+	UserModeNetworking bool
+	Rootful            bool
+}
+
+// InspectSockets are the host sockets used to communicate with the machine
+type InspectSockets struct {
+	GVProxySocket *define.VMFile
+	APISocket     *define.VMFile
+	ReadySocket   *define.VMFile
+	// Forwards are the guest sockets forwarded to the host besides the
+	// podman API socket
+	Forwards []machineconfig.SocketForward `json:",omitempty"`
+}
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+
+	flags := inspectCmd.Flags()
+	flags.StringVar(&inspectFlag.format, "format", "", "Format machine output using JSON or a Go template")
+}
+
+func inspect(cmd *cobra.Command, args []string) error {
+	var errs []error
+
+	dirs, err := env.GetMachineDirs(provider.VMType())
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		args = append(args, defaultMachineName)
+	}
+
+	vms := make([]InspectInfo, 0, len(args))
+	for _, name := range args {
+		mc, err := vmconfigs.LoadMachineByName(name, dirs)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		ii, err := inspectMachine(mc, dirs)
+		if err != nil {
+			return err
+		}
+		vms = append(vms, *ii)
+	}
+
+	if cmd.Flag("format").Changed && !isJSONFormat(inspectFlag.format) {
+		if err := inspectTemplate(vms); err != nil {
+			errs = append(errs, err)
+		}
+	} else {
+		b, err := json.MarshalIndent(vms, "", "    ")
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(os.Stdout, string(b)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func inspectMachine(mc *vmconfigs.MachineConfig, dirs *define.MachineDirs) (*InspectInfo, error) {
+	state, err := provider.State(mc, false)
+	if err != nil {
+		return nil, err
+	}
+
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return nil, err
+	}
+
+	gvProxySocket, err := mc.GVProxySocket()
+	if err != nil {
+		return nil, err
+	}
+	apiSocket, err := mc.APISocket()
+	if err != nil {
+		return nil, err
+	}
+	readySocket, err := mc.ReadySocket()
+	if err != nil {
+		return nil, err
+	}
+
+	ii := InspectInfo{
+		Name:        mc.Name,
+		VMType:      provider.VMType().String(),
+		ConfigDir:   *dirs.ConfigDir,
+		Created:     mc.Created,
+		LastUp:      mc.LastUp,
+		State:       state,
+		Resources:   mc.Resources,
+		SSHConfig:   mc.SSH,
+		Connection:  macadamConfig.Connection,
+		Mounts:      mc.Mounts,
+		ImagePath:   mc.ImagePath,
+		Provisioner: macadamConfig.Provisioner,
+		Sockets: InspectSockets{
+			GVProxySocket: gvProxySocket,
+			APISocket:     apiSocket,
+			ReadySocket:   readySocket,
+			Forwards:      macadamConfig.SocketForwards,
+		},
+		SavedState:         macadamConfig.SavedState,
+		UserModeNetworking: provider.UserModeNetworkEnabled(mc),
+		Rootful:            mc.HostUser.Rootful,
+	}
+
+	switch macadamConfig.Provisioner {
+	case machineconfig.CloudInitProvisioner:
+		ii.CloudInitISO = macadamConfig.CloudInitISO
+	default:
+		if ii.IgnitionPath, err = mc.IgnitionFile(); err != nil {
+			return nil, err
+		}
+	}
+	return &ii, nil
+}
+
+// inspectTemplate renders the user provided template once per machine
+func inspectTemplate(vms []InspectInfo) error {
+	tmpl, err := template.New("inspect").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(inspectFlag.format)
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		if err := tmpl.Execute(os.Stdout, vm); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(os.Stdout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/shim"
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+)
+
+const defaultListFormat = "{{range .}}{{.Name}}\t{{.VMType}}\t{{.Created}}\t{{.LastUp}}\t{{.CPUs}}\t{{.Memory}}\t{{.DiskSize}}\n{{end -}}"
+
+var (
+	lsCmd = &cobra.Command{
+		Use:     "list [options]",
+		Aliases: []string{"ls"},
+		Short:   "List machines",
+		Long:    "List managed virtual machines.",
+		RunE:    list,
+		Args:    cobra.NoArgs,
+		Example: `macadam list
+  macadam list --format json
+  macadam ls`,
+	}
+	listFlag = listFlagType{}
+)
+
+type listFlagType struct {
+	format    string
+	noHeading bool
+	quiet     bool
+}
+
+// ListReporter is the machine list entry which is displayed to the user
+type ListReporter struct {
+	Name               string
+	Running            bool
+	Starting           bool
+	LastUp             string
+	Created            string
+	VMType             string
+	CPUs               uint64
+	Memory             string
+	DiskSize           string
+	Port               int
+	RemoteUsername     string
+	IdentityPath       string
+	UserModeNetworking bool
+}
+
+func init() {
+	rootCmd.AddCommand(lsCmd)
+
+	flags := lsCmd.Flags()
+	flags.StringVar(&listFlag.format, "format", defaultListFormat, "Format machine output using JSON or a Go template")
+	flags.BoolVarP(&listFlag.noHeading, "noheading", "n", false, "Do not print headers")
+	flags.BoolVarP(&listFlag.quiet, "quiet", "q", false, "Show only machine names")
+}
+
+func list(cmd *cobra.Command, _ []string) error {
+	listResponse, err := shim.List([]vmconfigs.VMProvider{provider}, machine.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	// Sort by last run
+	sort.Slice(listResponse, func(i, j int) bool {
+		return listResponse[i].LastUp.After(listResponse[j].LastUp)
+	})
+	// Bring currently running machines to top
+	sort.SliceStable(listResponse, func(i, j int) bool {
+		return listResponse[i].Running && !listResponse[j].Running
+	})
+
+	if isJSONFormat(listFlag.format) {
+		b, err := json.MarshalIndent(toMachineFormat(listResponse), "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(os.Stdout, string(b))
+		return err
+	}
+
+	return outputTemplate(cmd, toHumanFormat(listResponse))
+}
+
+func isJSONFormat(format string) bool {
+	return strings.TrimSpace(format) == "json"
+}
+
+func outputTemplate(cmd *cobra.Command, responses []*ListReporter) error {
+	format := listFlag.format
+	renderHeaders := !listFlag.noHeading
+	switch {
+	case cmd.Flag("format").Changed:
+		// user provided templates are rendered as-is
+		renderHeaders = false
+	case listFlag.quiet:
+		format = "{{range .}}{{.Name}}\n{{end -}}"
+		renderHeaders = false
+	}
+
+	tmpl, err := template.New("list").Parse(format)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 8, 2, 2, ' ', 0)
+	defer w.Flush()
+
+	if renderHeaders {
+		headers := []string{"NAME", "VM TYPE", "CREATED", "LAST UP", "CPUS", "MEMORY", "DISK SIZE"}
+		if _, err := fmt.Fprintln(w, strings.Join(headers, "\t")); err != nil {
+			return fmt.Errorf("failed to write report column headers: %w", err)
+		}
+	}
+	return tmpl.Execute(w, responses)
+}
+
+func strTime(t time.Time) string {
+	iso, err := t.MarshalText()
+	if err != nil {
+		return ""
+	}
+	return string(iso)
+}
+
+func toMachineFormat(vms []*machine.ListResponse) []*ListReporter {
+	machineResponses := make([]*ListReporter, 0, len(vms))
+	for _, vm := range vms {
+		response := new(ListReporter)
+		response.Name = vm.Name
+		response.Running = vm.Running
+		response.LastUp = strTime(vm.LastUp)
+		response.Created = strTime(vm.CreatedAt)
+		response.VMType = vm.VMType
+		response.CPUs = vm.CPUs
+		response.Memory = fmt.Sprint(vm.Memory.ToBytes())
+		response.DiskSize = fmt.Sprint(vm.DiskSize.ToBytes())
+		response.Port = vm.Port
+		response.RemoteUsername = vm.RemoteUsername
+		response.IdentityPath = vm.IdentityPath
+		response.Starting = vm.Starting
+		response.UserModeNetworking = vm.UserModeNetworking
+
+		machineResponses = append(machineResponses, response)
+	}
+	return machineResponses
+}
+
+func toHumanFormat(vms []*machine.ListResponse) []*ListReporter {
+	humanResponses := make([]*ListReporter, 0, len(vms))
+	for _, vm := range vms {
+		response := new(ListReporter)
+		response.Name = vm.Name
+		switch {
+		case vm.Starting:
+			response.LastUp = "Currently starting"
+			response.Starting = true
+		case vm.Running:
+			response.LastUp = "Currently running"
+			response.Running = true
+		case vm.LastUp.IsZero():
+			response.LastUp = "Never"
+		default:
+			response.LastUp = units.HumanDuration(time.Since(vm.LastUp)) + " ago"
+		}
+		response.Created = units.HumanDuration(time.Since(vm.CreatedAt)) + " ago"
+		response.VMType = vm.VMType
+		response.CPUs = vm.CPUs
+		response.Memory = units.BytesSize(float64(vm.Memory.ToBytes()))
+		response.DiskSize = units.BytesSize(float64(vm.DiskSize.ToBytes()))
+
+		humanResponses = append(humanResponses, response)
+	}
+	return humanResponses
+}
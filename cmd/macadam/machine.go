@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/env"
+)
+
+// machineNameFromArgs returns the machine name given on the command line, or
+// the default machine name when none was provided
+func machineNameFromArgs(args []string) string {
+	if len(args) > 0 && len(args[0]) > 0 {
+		return args[0]
+	}
+	return defaultMachineName
+}
+
+// loadMachine loads the configuration of the machine named in args along with
+// the machine directories of the current provider
+func loadMachine(args []string) (*vmconfigs.MachineConfig, *define.MachineDirs, error) {
+	dirs, err := env.GetMachineDirs(provider.VMType())
+	if err != nil {
+		return nil, nil, err
+	}
+	mc, err := vmconfigs.LoadMachineByName(machineNameFromArgs(args), dirs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mc, dirs, nil
+}
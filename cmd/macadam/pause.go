@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/crc-org/macadam/pkg/shim"
+	"github.com/spf13/cobra"
+)
+
+var pauseCmd = &cobra.Command{
+	Use:     "pause [MACHINE]",
+	Short:   "Pause a running machine",
+	Long:    "Freeze the guest of a running machine, it keeps its memory and carries on where it left off once resumed",
+	RunE:    pause,
+	Args:    cobra.MaximumNArgs(1),
+	Example: `macadam pause myvm`,
+}
+
+func init() {
+	rootCmd.AddCommand(pauseCmd)
+}
+
+func pause(_ *cobra.Command, args []string) error {
+	mc, _, err := loadMachine(args)
+	if err != nil {
+		return err
+	}
+
+	if err := shim.Pause(mc, provider); err != nil {
+		return err
+	}
+	fmt.Printf("Machine %q paused successfully\n", mc.Name)
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/crc-org/macadam/pkg/shim"
+	"github.com/spf13/cobra"
+)
+
+const defaultPortListFormat = "{{range .}}{{.HostPort}}\t{{.GuestPort}}\t{{.Protocol}}\n{{end -}}"
+
+var (
+	portCmd = &cobra.Command{
+		Use:   "port",
+		Short: "Manage machine port forwards",
+		Long:  "Manage the host ports forwarded to a machine, forwards are applied on every start",
+	}
+	portAddCmd = &cobra.Command{
+		Use:   "add [MACHINE] HOST_PORT[:GUEST_PORT][/PROTOCOL]",
+		Short: "Forward a host port",
+		Long: `Forward a host port to a port of the guest, the guest port defaults to the host port
+and the protocol, tcp or udp, to tcp. The forward is applied right away to running machines.`,
+		RunE: portAdd,
+		Args: cobra.RangeArgs(1, 2),
+		Example: `macadam port add myvm 8080:80
+macadam port add myvm 5353/udp`,
+	}
+	portLsCmd = &cobra.Command{
+		Use:     "list [options] [MACHINE]",
+		Aliases: []string{"ls"},
+		Short:   "List port forwards",
+		Long:    "List the host ports forwarded to a machine",
+		RunE:    portList,
+		Args:    cobra.MaximumNArgs(1),
+		Example: `macadam port ls myvm`,
+	}
+	portRmCmd = &cobra.Command{
+		Use:     "rm [MACHINE] HOST_PORT[/PROTOCOL]",
+		Short:   "Remove a port forward",
+		Long:    "Remove the forward of a host port, the forward is stopped right away on running machines",
+		RunE:    portRm,
+		Args:    cobra.RangeArgs(1, 2),
+		Example: `macadam port rm myvm 8080`,
+	}
+	portLsFlag = portLsFlagType{}
+)
+
+type portLsFlagType struct {
+	format    string
+	noHeading bool
+}
+
+func init() {
+	rootCmd.AddCommand(portCmd)
+	portCmd.AddCommand(portAddCmd, portLsCmd, portRmCmd)
+
+	lsFlags := portLsCmd.Flags()
+	lsFlags.StringVar(&portLsFlag.format, "format", defaultPortListFormat, "Format port forward output using JSON or a Go template")
+	lsFlags.BoolVarP(&portLsFlag.noHeading, "noheading", "n", false, "Do not print headers")
+}
+
+func portAdd(_ *cobra.Command, args []string) error {
+	machineArgs, spec := namedArgs(args)
+	fwd, err := machineconfig.ParsePortForward(spec)
+	if err != nil {
+		return err
+	}
+	mc, _, err := loadMachine(machineArgs)
+	if err != nil {
+		return err
+	}
+
+	if err := shim.AddPortForward(mc, provider, fwd); err != nil {
+		return err
+	}
+	fmt.Printf("Host port %d/%s forwarded to port %d of machine %q\n", fwd.HostPort, fwd.Protocol, fwd.GuestPort, mc.Name)
+	return nil
+}
+
+func portRm(_ *cobra.Command, args []string) error {
+	machineArgs, spec := namedArgs(args)
+	fwd, err := machineconfig.ParsePortForward(spec)
+	if err != nil {
+		return err
+	}
+	mc, _, err := loadMachine(machineArgs)
+	if err != nil {
+		return err
+	}
+
+	if err := shim.RemovePortForward(mc, provider, fwd.HostPort, fwd.Protocol); err != nil {
+		return err
+	}
+	fmt.Printf("%d/%s\n", fwd.HostPort, fwd.Protocol)
+	return nil
+}
+
+func portList(cmd *cobra.Command, args []string) error {
+	mc, _, err := loadMachine(args)
+	if err != nil {
+		return err
+	}
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return err
+	}
+	forwards := macadamConfig.PortForwards
+	if forwards == nil {
+		forwards = []machineconfig.PortForward{}
+	}
+
+	if isJSONFormat(portLsFlag.format) {
+		b, err := json.MarshalIndent(forwards, "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(os.Stdout, string(b))
+		return err
+	}
+
+	// user provided templates are rendered as-is
+	renderHeaders := !portLsFlag.noHeading && !cmd.Flag("format").Changed
+
+	tmpl, err := template.New("port list").Parse(portLsFlag.format)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 8, 2, 2, ' ', 0)
+	defer w.Flush()
+
+	if renderHeaders {
+		headers := []string{"HOST PORT", "GUEST PORT", "PROTOCOL"}
+		if _, err := fmt.Fprintln(w, strings.Join(headers, "\t")); err != nil {
+			return fmt.Errorf("failed to write report column headers: %w", err)
+		}
+	}
+	return tmpl.Execute(w, forwards)
+}
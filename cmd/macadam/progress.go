@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/crc-org/macadam/pkg/imagecache"
+	"github.com/sirupsen/logrus"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+const (
+	progressBar  = "bar"
+	progressJSON = "json"
+	progressNone = "none"
+)
+
+// ProgressEvent is the structured progress report of an image download
+// which is displayed to the user in JSON mode, one event per line
+type ProgressEvent struct {
+	Type      string `json:"type"`
+	Image     string `json:"image"`
+	Attempt   int    `json:"attempt"`
+	Completed int64  `json:"completed"`
+	Total     int64  `json:"total"`
+	Done      bool   `json:"done"`
+	Error     string `json:"error,omitempty"`
+}
+
+// newProgressFunc returns the reporter of the image download progress for
+// the given output mode
+func newProgressFunc(mode string) (imagecache.ProgressFunc, error) {
+	switch mode {
+	case progressBar:
+		return barProgress(), nil
+	case progressJSON:
+		return jsonProgress, nil
+	case progressNone:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown progress output %q, must be %q, %q or %q", mode, progressBar, progressJSON, progressNone)
+}
+
+// messageOutput returns where the messages for the user are written in the
+// given progress mode, stderr in JSON mode so that stdout only holds the
+// progress events
+func messageOutput(mode string) io.Writer {
+	if mode == progressJSON {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+func jsonProgress(p imagecache.Progress) {
+	event := ProgressEvent{
+		Type:      "download",
+		Image:     p.Image,
+		Attempt:   p.Attempt,
+		Completed: p.Completed,
+		Total:     p.Total,
+		Done:      p.Done,
+	}
+	if p.Err != nil {
+		event.Error = p.Err.Error()
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(event); err != nil {
+		logrus.Warnf("writing progress event: %v", err)
+	}
+}
+
+// barProgress renders a terminal progress bar for each download attempt
+func barProgress() imagecache.ProgressFunc {
+	var (
+		p   *mpb.Progress
+		bar *mpb.Bar
+	)
+	return func(progress imagecache.Progress) {
+		if bar == nil {
+			prefix := "Downloading VM image: " + path.Base(progress.Image)
+			// Do not go below 80, see podman bug #17718
+			p = mpb.New(mpb.WithWidth(80))
+			bar = p.AddBar(progress.Total,
+				mpb.BarFillerClearOnComplete(),
+				mpb.PrependDecorators(
+					decor.OnComplete(decor.Name(prefix), prefix+": done"),
+				),
+				mpb.AppendDecorators(
+					decor.OnComplete(decor.CountersKibiByte("%.1f / %.1f"), ""),
+				),
+			)
+		}
+		bar.SetCurrent(progress.Completed)
+		if !progress.Done {
+			return
+		}
+		if progress.Err != nil {
+			bar.Abort(false)
+		} else {
+			// completes bars of images of unknown size
+			bar.SetTotal(-1, true)
+		}
+		p.Wait()
+		bar = nil
+	}
+}
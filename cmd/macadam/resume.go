@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/crc-org/macadam/pkg/shim"
+	"github.com/spf13/cobra"
+)
+
+var resumeCmd = &cobra.Command{
+	Use:     "resume [MACHINE]",
+	Short:   "Resume a paused machine",
+	Long:    "Continue the guest of a paused machine and sync its clock with the host",
+	RunE:    resume,
+	Args:    cobra.MaximumNArgs(1),
+	Example: `macadam resume myvm`,
+}
+
+func init() {
+	rootCmd.AddCommand(resumeCmd)
+}
+
+func resume(_ *cobra.Command, args []string) error {
+	mc, _, err := loadMachine(args)
+	if err != nil {
+		return err
+	}
+
+	if err := shim.Resume(mc, provider); err != nil {
+		return err
+	}
+	fmt.Printf("Machine %q resumed successfully\n", mc.Name)
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/crc-org/macadam/pkg/shim"
+	"github.com/spf13/cobra"
+)
+
+var (
+	rmCmd = &cobra.Command{
+		Use:     "rm [options] [MACHINE]",
+		Short:   "Remove an existing machine",
+		Long:    "Remove a managed virtual machine",
+		RunE:    rm,
+		Args:    cobra.MaximumNArgs(1),
+		Example: `macadam rm myvm`,
+	}
+	destroyOptions machine.RemoveOptions
+)
+
+func init() {
+	rootCmd.AddCommand(rmCmd)
+
+	flags := rmCmd.Flags()
+	flags.BoolVarP(&destroyOptions.Force, "force", "f", false, "Stop and do not prompt before rming")
+	flags.BoolVar(&destroyOptions.SaveIgnition, "save-ignition", false, "Do not delete ignition file")
+	flags.BoolVar(&destroyOptions.SaveImage, "save-image", false, "Do not delete the image file")
+}
+
+func rm(_ *cobra.Command, args []string) error {
+	mc, dirs, err := loadMachine(args)
+	if err != nil {
+		return err
+	}
+
+	return shim.Remove(mc, provider, dirs, destroyOptions)
+}
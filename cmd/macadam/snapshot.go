@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/crc-org/macadam/pkg/shim"
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+)
+
+const defaultSnapshotListFormat = "{{range .}}{{.Name}}\t{{.Created}}\t{{.DiskSize}}\t{{.VMStateSize}}\n{{end -}}"
+
+var (
+	snapshotCmd = &cobra.Command{
+		Use:   "snapshot",
+		Short: "Manage machine snapshots",
+		Long:  "Manage the snapshots of the boot disk and qcow2 data disks of a machine, running machines are snapshotted along with their memory",
+	}
+	snapshotCreateCmd = &cobra.Command{
+		Use:     "create [MACHINE] NAME",
+		Short:   "Create a snapshot",
+		Long:    "Take a snapshot of a stopped or running machine",
+		RunE:    snapshotCreate,
+		Args:    cobra.RangeArgs(1, 2),
+		Example: `macadam snapshot create myvm before-upgrade`,
+	}
+	snapshotLsCmd = &cobra.Command{
+		Use:     "list [options] [MACHINE]",
+		Aliases: []string{"ls"},
+		Short:   "List snapshots",
+		Long:    "List the snapshots of a machine",
+		RunE:    snapshotList,
+		Args:    cobra.MaximumNArgs(1),
+		Example: `macadam snapshot ls myvm`,
+	}
+	snapshotRestoreCmd = &cobra.Command{
+		Use:     "restore [options] [MACHINE] NAME",
+		Short:   "Restore a snapshot",
+		Long:    "Revert a machine to a snapshot, the machine must be stopped unless --force is used",
+		RunE:    snapshotRestore,
+		Args:    cobra.RangeArgs(1, 2),
+		Example: `macadam snapshot restore myvm before-upgrade`,
+	}
+	snapshotRmCmd = &cobra.Command{
+		Use:     "rm [MACHINE] NAME",
+		Short:   "Remove a snapshot",
+		Long:    "Delete a snapshot of a machine",
+		RunE:    snapshotRm,
+		Args:    cobra.RangeArgs(1, 2),
+		Example: `macadam snapshot rm myvm before-upgrade`,
+	}
+	snapshotLsFlag      = snapshotLsFlagType{}
+	snapshotRestoreFlag = snapshotRestoreFlagType{}
+)
+
+type snapshotLsFlagType struct {
+	format    string
+	noHeading bool
+	quiet     bool
+}
+
+type snapshotRestoreFlagType struct {
+	force bool
+}
+
+// SnapshotReporter is the machine snapshot which is displayed to the user
+type SnapshotReporter struct {
+	Name        string
+	Created     string
+	DiskSize    string
+	VMStateSize string
+}
+
+func init() {
+	rootCmd.AddCommand(snapshotCmd)
+	snapshotCmd.AddCommand(snapshotCreateCmd, snapshotLsCmd, snapshotRestoreCmd, snapshotRmCmd)
+
+	lsFlags := snapshotLsCmd.Flags()
+	lsFlags.StringVar(&snapshotLsFlag.format, "format", defaultSnapshotListFormat, "Format snapshot output using JSON or a Go template")
+	lsFlags.BoolVarP(&snapshotLsFlag.noHeading, "noheading", "n", false, "Do not print headers")
+	lsFlags.BoolVarP(&snapshotLsFlag.quiet, "quiet", "q", false, "Show only snapshot names")
+
+	restoreFlags := snapshotRestoreCmd.Flags()
+	restoreFlags.BoolVarP(&snapshotRestoreFlag.force, "force", "f", false, "Restore the snapshot of a running machine, which is stopped first unless the snapshot was taken while it was running")
+}
+
+// namedArgs splits the [MACHINE] NAME arguments of the snapshot and disk
+// commands
+func namedArgs(args []string) ([]string, string) {
+	return args[:len(args)-1], args[len(args)-1]
+}
+
+func snapshotCreate(_ *cobra.Command, args []string) error {
+	machineArgs, name := namedArgs(args)
+	mc, _, err := loadMachine(machineArgs)
+	if err != nil {
+		return err
+	}
+
+	if _, err := shim.CreateSnapshot(mc, provider, name); err != nil {
+		return err
+	}
+	fmt.Printf("Snapshot %q of machine %q created\n", name, mc.Name)
+	return nil
+}
+
+func snapshotRestore(_ *cobra.Command, args []string) error {
+	machineArgs, name := namedArgs(args)
+	mc, dirs, err := loadMachine(machineArgs)
+	if err != nil {
+		return err
+	}
+
+	if err := shim.RestoreSnapshot(mc, provider, dirs, name, snapshotRestoreFlag.force); err != nil {
+		return err
+	}
+	fmt.Printf("Machine %q restored to snapshot %q\n", mc.Name, name)
+	return nil
+}
+
+func snapshotRm(_ *cobra.Command, args []string) error {
+	machineArgs, name := namedArgs(args)
+	mc, _, err := loadMachine(machineArgs)
+	if err != nil {
+		return err
+	}
+
+	if err := shim.DeleteSnapshot(mc, provider, name); err != nil {
+		return err
+	}
+	fmt.Println(name)
+	return nil
+}
+
+func snapshotList(cmd *cobra.Command, args []string) error {
+	mc, _, err := loadMachine(args)
+	if err != nil {
+		return err
+	}
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return err
+	}
+
+	if isJSONFormat(snapshotLsFlag.format) {
+		snapshots := macadamConfig.Snapshots
+		if snapshots == nil {
+			snapshots = []machineconfig.Snapshot{}
+		}
+		b, err := json.MarshalIndent(snapshots, "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(os.Stdout, string(b))
+		return err
+	}
+
+	format := snapshotLsFlag.format
+	renderHeaders := !snapshotLsFlag.noHeading
+	switch {
+	case cmd.Flag("format").Changed:
+		// user provided templates are rendered as-is
+		renderHeaders = false
+	case snapshotLsFlag.quiet:
+		format = "{{range .}}{{.Name}}\n{{end -}}"
+		renderHeaders = false
+	}
+
+	tmpl, err := template.New("snapshot list").Parse(format)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 8, 2, 2, ' ', 0)
+	defer w.Flush()
+
+	if renderHeaders {
+		headers := []string{"NAME", "CREATED", "DISK SIZE", "VM STATE SIZE"}
+		if _, err := fmt.Fprintln(w, strings.Join(headers, "\t")); err != nil {
+			return fmt.Errorf("failed to write report column headers: %w", err)
+		}
+	}
+	return tmpl.Execute(w, toSnapshotReporters(macadamConfig.Snapshots, !cmd.Flag("format").Changed))
+}
+
+func toSnapshotReporters(snapshots []machineconfig.Snapshot, human bool) []*SnapshotReporter {
+	reporters := make([]*SnapshotReporter, 0, len(snapshots))
+	for _, s := range snapshots {
+		r := &SnapshotReporter{
+			Name:        s.Name,
+			Created:     strTime(s.Created),
+			DiskSize:    fmt.Sprint(s.DiskSize),
+			VMStateSize: fmt.Sprint(s.VMStateSize),
+		}
+		if human {
+			r.Created = units.HumanDuration(time.Since(s.Created)) + " ago"
+			r.DiskSize = units.BytesSize(float64(s.DiskSize))
+			r.VMStateSize = units.BytesSize(float64(s.VMStateSize))
+		}
+		reporters = append(reporters, r)
+	}
+	return reporters
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/crc-org/macadam/pkg/shim"
+	"github.com/spf13/cobra"
+)
+
+const defaultSocketListFormat = "{{range .}}{{.Guest}}\t{{.Host}}\t{{.User}}\n{{end -}}"
+
+var (
+	socketCmd = &cobra.Command{
+		Use:   "socket",
+		Short: "Manage machine socket forwards",
+		Long:  "Manage the guest unix sockets forwarded to the host besides the podman API socket, forwards are set up when the machine starts",
+	}
+	socketAddCmd = &cobra.Command{
+		Use:   "add [MACHINE] [USER@]GUEST_PATH:HOST",
+		Short: "Forward a guest socket",
+		Long: `Forward a guest unix socket to a host socket or TCP address over SSH. HOST is a socket
+path, a port on the host loopback address or tcp://address:port. The socket is reached
+as the SSH user of the machine unless USER is given.`,
+		RunE: socketAdd,
+		Args: cobra.RangeArgs(1, 2),
+		Example: `macadam socket add myvm root@/run/containerd/containerd.sock:/tmp/containerd.sock
+macadam socket add myvm /run/agent.sock:9000`,
+	}
+	socketLsCmd = &cobra.Command{
+		Use:     "list [options] [MACHINE]",
+		Aliases: []string{"ls"},
+		Short:   "List socket forwards",
+		Long:    "List the guest sockets forwarded to the host",
+		RunE:    socketList,
+		Args:    cobra.MaximumNArgs(1),
+		Example: `macadam socket ls myvm`,
+	}
+	socketRmCmd = &cobra.Command{
+		Use:     "rm [MACHINE] HOST",
+		Short:   "Remove a socket forward",
+		Long:    "Remove the forward to a host socket or TCP address",
+		RunE:    socketRm,
+		Args:    cobra.RangeArgs(1, 2),
+		Example: `macadam socket rm myvm /tmp/containerd.sock`,
+	}
+	socketLsFlag = socketLsFlagType{}
+)
+
+type socketLsFlagType struct {
+	format    string
+	noHeading bool
+}
+
+func init() {
+	rootCmd.AddCommand(socketCmd)
+	socketCmd.AddCommand(socketAddCmd, socketLsCmd, socketRmCmd)
+
+	lsFlags := socketLsCmd.Flags()
+	lsFlags.StringVar(&socketLsFlag.format, "format", defaultSocketListFormat, "Format socket forward output using JSON or a Go template")
+	lsFlags.BoolVarP(&socketLsFlag.noHeading, "noheading", "n", false, "Do not print headers")
+}
+
+func socketAdd(_ *cobra.Command, args []string) error {
+	machineArgs, spec := namedArgs(args)
+	fwd, err := machineconfig.ParseSocketForward(spec)
+	if err != nil {
+		return err
+	}
+	mc, _, err := loadMachine(machineArgs)
+	if err != nil {
+		return err
+	}
+
+	running, err := shim.AddSocketForward(mc, provider, fwd)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Socket %s of machine %q forwarded to %s\n", fwd.Guest, mc.Name, fwd.Host)
+	if running {
+		fmt.Println("The forward is set up on the next start of the machine")
+	}
+	return nil
+}
+
+func socketRm(_ *cobra.Command, args []string) error {
+	machineArgs, input := namedArgs(args)
+	host, err := machineconfig.ParseSocketForwardHost(input)
+	if err != nil {
+		return err
+	}
+	mc, _, err := loadMachine(machineArgs)
+	if err != nil {
+		return err
+	}
+
+	running, err := shim.RemoveSocketForward(mc, provider, host)
+	if err != nil {
+		return err
+	}
+	fmt.Println(host)
+	if running {
+		fmt.Println("The forward is removed on the next start of the machine")
+	}
+	return nil
+}
+
+func socketList(cmd *cobra.Command, args []string) error {
+	mc, _, err := loadMachine(args)
+	if err != nil {
+		return err
+	}
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return err
+	}
+	forwards := macadamConfig.SocketForwards
+	if forwards == nil {
+		forwards = []machineconfig.SocketForward{}
+	}
+
+	if isJSONFormat(socketLsFlag.format) {
+		b, err := json.MarshalIndent(forwards, "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(os.Stdout, string(b))
+		return err
+	}
+
+	// user provided templates are rendered as-is
+	renderHeaders := !socketLsFlag.noHeading && !cmd.Flag("format").Changed
+
+	tmpl, err := template.New("socket list").Parse(socketLsFlag.format)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 8, 2, 2, ' ', 0)
+	defer w.Flush()
+
+	if renderHeaders {
+		headers := []string{"GUEST", "HOST", "USER"}
+		if _, err := fmt.Fprintln(w, strings.Join(headers, "\t")); err != nil {
+			return fmt.Errorf("failed to write report column headers: %w", err)
+		}
+	}
+	return tmpl.Execute(w, forwards)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/spf13/cobra"
+)
+
+var (
+	sshCmd = &cobra.Command{
+		Use:   "ssh [options] [MACHINE] [-- COMMAND [ARG ...]]",
+		Short: "SSH into an existing machine",
+		Long:  "SSH into a managed virtual machine. An interactive shell is opened when no command is given, otherwise the command's exit status is returned.",
+		RunE:  ssh,
+		Example: `macadam ssh myvm
+  macadam ssh myvm -- uname -a
+  cat script.sh | macadam ssh myvm -- sh -s`,
+	}
+	sshOpts = machine.SSHOptions{}
+)
+
+func init() {
+	rootCmd.AddCommand(sshCmd)
+
+	flags := sshCmd.Flags()
+	// the flags of the command run in the machine are its own
+	flags.SetInterspersed(false)
+	flags.StringVar(&sshOpts.Username, "username", "", "Username to use when ssh-ing into the VM, defaults to the machine's remote user")
+}
+
+func ssh(cmd *cobra.Command, args []string) error {
+	nameArgs := args
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		nameArgs, sshOpts.Args = args[:dash], args[dash:]
+	} else if len(args) > 1 {
+		nameArgs, sshOpts.Args = args[:1], args[1:]
+	}
+	if len(nameArgs) > 1 {
+		return fmt.Errorf("accepts at most one machine name, received %d", len(nameArgs))
+	}
+
+	mc, _, err := loadMachine(nameArgs)
+	if err != nil {
+		return err
+	}
+
+	state, err := provider.State(mc, false)
+	if err != nil {
+		return err
+	}
+	if state != define.Running {
+		return fmt.Errorf("vm %q is not running", mc.Name)
+	}
+
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return err
+	}
+
+	username := sshOpts.Username
+	if username == "" {
+		username = mc.SSH.RemoteUsername
+	}
+
+	err = machine.CommonSSHShell(username, macadamConfig.Connection.IdentityPath, mc.Name, macadamConfig.Connection.Port, sshOpts.Args)
+	return handleSSHError(err)
+}
+
+// handleSSHError sets the exit code of the command run in the machine as
+// macadam's exit code. Other errors are returned as-is.
+func handleSSHError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var exitError *exec.ExitError
+	if errors.As(err, &exitError) {
+		// do not return the error to the user otherwise "exit status X"
+		// would be printed
+		code := exitError.ExitCode()
+		if status, ok := exitError.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			// follow the shell conventions for commands killed by a signal
+			code = 128 + int(status.Signal())
+		}
+		setExitCode(code)
+		return nil
+	}
+	// follow the shell conventions when ssh cannot be executed
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, exec.ErrNotFound) {
+		setExitCode(127)
+	} else if errors.Is(err, os.ErrPermission) {
+		setExitCode(126)
+	}
+	return err
+}
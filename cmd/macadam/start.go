@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/crc-org/macadam/pkg/shim"
+	"github.com/spf13/cobra"
+)
+
+var (
+	startCmd = &cobra.Command{
+		Use:     "start [options] [MACHINE]",
+		Short:   "Start an existing machine",
+		Long:    "Start a managed virtual machine",
+		RunE:    start,
+		Args:    cobra.MaximumNArgs(1),
+		Example: `macadam start myvm`,
+	}
+	startOpts = shim.StartOptions{}
+)
+
+func init() {
+	rootCmd.AddCommand(startCmd)
+
+	flags := startCmd.Flags()
+	flags.BoolVar(&startOpts.NoInfo, "no-info", false, "Suppress informational tips")
+	flags.BoolVarP(&startOpts.Quiet, "quiet", "q", false, "Suppress machine starting status output")
+	flags.BoolVar(&startOpts.Restore, "restore", false, "Continue the suspended machine from its saved state instead of booting it")
+	flags.BoolVar(&startOpts.DiscardState, "discard-state", false, "Boot the suspended machine, deleting its saved state")
+	flags.DurationVar(&startOpts.Timeout, "timeout", shim.DefaultStartTimeout, "Maximum time to wait for the machine to be ready")
+}
+
+func start(_ *cobra.Command, args []string) error {
+	return startMachine(args, os.Stdout)
+}
+
+// startMachine starts the machine, writing the messages for the user to out
+func startMachine(args []string, out io.Writer) error {
+	startOpts.NoInfo = startOpts.Quiet || startOpts.NoInfo
+
+	mc, dirs, err := loadMachine(args)
+	if err != nil {
+		return err
+	}
+
+	if !startOpts.Quiet {
+		fmt.Fprintf(out, "Starting machine %q\n", mc.Name)
+	}
+
+	if err := shim.Start(mc, provider, dirs, startOpts); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Machine %q started successfully\n", mc.Name)
+	return nil
+}
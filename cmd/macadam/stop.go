@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/crc-org/macadam/pkg/shim"
+	"github.com/spf13/cobra"
+)
+
+var (
+	stopCmd = &cobra.Command{
+		Use:   "stop [options] [MACHINE]",
+		Short: "Stop an existing machine",
+		Long: `Stop a managed virtual machine. With a timeout, the guest is given that many
+seconds in total to shut down before the machine is killed: half of them after
+an ACPI powerdown request, the rest after running systemctl poweroff over SSH.`,
+		RunE: stop,
+		Args: cobra.MaximumNArgs(1),
+		Example: `macadam stop myvm
+macadam stop --timeout 60 myvm`,
+	}
+	stopFlag = stopFlagType{}
+)
+
+type stopFlagType struct {
+	force   bool
+	timeout uint
+}
+
+func init() {
+	rootCmd.AddCommand(stopCmd)
+
+	flags := stopCmd.Flags()
+	flags.BoolVar(&stopFlag.force, "force", false, "Stop the machine without waiting for a graceful shutdown")
+	flags.UintVar(&stopFlag.timeout, "timeout", 0, "Seconds to wait for the machine to shut down gracefully before killing it, 0 waits indefinitely")
+	stopCmd.MarkFlagsMutuallyExclusive("force", "timeout")
+}
+
+func stop(_ *cobra.Command, args []string) error {
+	mc, dirs, err := loadMachine(args)
+	if err != nil {
+		return err
+	}
+
+	opts := shim.StopOptions{
+		Force:   stopFlag.force,
+		Timeout: time.Duration(stopFlag.timeout) * time.Second,
+	}
+	method, err := shim.Stop(mc, provider, dirs, opts)
+	if err != nil {
+		return err
+	}
+
+	if method == "" {
+		fmt.Printf("Machine %q stopped successfully\n", mc.Name)
+	} else {
+		fmt.Printf("Machine %q stopped successfully by %s\n", mc.Name, method)
+	}
+	return nil
+}
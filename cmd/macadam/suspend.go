@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/crc-org/macadam/pkg/shim"
+	"github.com/spf13/cobra"
+)
+
+var suspendCmd = &cobra.Command{
+	Use:   "suspend [MACHINE]",
+	Short: "Save the state of a machine and stop it",
+	Long: `Save the memory and device state of a running machine to a file and stop it.
+Start the machine with --restore to carry on where it left off, or with
+--discard-state to boot it and delete the saved state. The state is also
+discarded when the disks or resources of the machine change.`,
+	RunE:    suspend,
+	Args:    cobra.MaximumNArgs(1),
+	Example: `macadam suspend myvm`,
+}
+
+func init() {
+	rootCmd.AddCommand(suspendCmd)
+}
+
+func suspend(_ *cobra.Command, args []string) error {
+	mc, dirs, err := loadMachine(args)
+	if err != nil {
+		return err
+	}
+
+	if err := shim.Suspend(mc, provider, dirs); err != nil {
+		return err
+	}
+	fmt.Printf("Machine %q suspended successfully\n", mc.Name)
+	return nil
+}
@@ -0,0 +1,137 @@
+package cloudinit
+
+import (
+	"fmt"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/ignition"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// volumeLabel is the label the NoCloud datasource looks for
+	volumeLabel = "cidata"
+
+	userDataFileName = "user-data"
+	metaDataFileName = "meta-data"
+
+	readyUnitPath = "/etc/systemd/system/ready.service"
+)
+
+// CloudInit holds the settings used to generate the NoCloud data of a machine
+type CloudInit struct {
+	// Name of the user created in the guest
+	Name string
+	// Key is the SSH public key authorized for the user
+	Key string
+	// TimeZone of the guest, "local" means the same as the host
+	TimeZone string
+	// VMName is used as the guest hostname and instance ID
+	VMName string
+	// VMType is the provider the machine runs on
+	VMType define.VMType
+}
+
+type user struct {
+	Name              string   `yaml:"name"`
+	Sudo              string   `yaml:"sudo"`
+	Shell             string   `yaml:"shell"`
+	LockPasswd        bool     `yaml:"lock_passwd"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys"`
+}
+
+type writeFile struct {
+	Path        string `yaml:"path"`
+	Content     string `yaml:"content"`
+	Permissions string `yaml:"permissions"`
+}
+
+type userData struct {
+	Users      []user      `yaml:"users"`
+	Timezone   string      `yaml:"timezone,omitempty"`
+	WriteFiles []writeFile `yaml:"write_files"`
+	RunCmd     [][]string  `yaml:"runcmd"`
+}
+
+type metaData struct {
+	InstanceID    string `yaml:"instance-id"`
+	LocalHostname string `yaml:"local-hostname"`
+}
+
+// UserData returns the #cloud-config user-data document
+func (c *CloudInit) UserData() ([]byte, error) {
+	tz := c.TimeZone
+	// local means the same as the host
+	if tz == "local" {
+		var err error
+		if tz, err = getLocalTimeZone(); err != nil {
+			return nil, err
+		}
+	}
+
+	// The ready unit tells the host the guest has booted. cloud-init only
+	// runs runcmd on first boot, the unit being enabled takes care of the
+	// following boots.
+	readyUnit, err := ignition.CreateReadyUnitFile(c.VMType, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ud := userData{
+		Users: []user{
+			{
+				Name:              c.Name,
+				Sudo:              "ALL=(ALL) NOPASSWD:ALL",
+				Shell:             "/bin/bash",
+				LockPasswd:        true,
+				SSHAuthorizedKeys: []string{c.Key},
+			},
+		},
+		Timezone: tz,
+		WriteFiles: []writeFile{
+			{
+				Path:        readyUnitPath,
+				Content:     readyUnit,
+				Permissions: "0644",
+			},
+		},
+		RunCmd: [][]string{
+			{"systemctl", "daemon-reload"},
+			{"systemctl", "enable", "--now", "--no-block", "ready.service"},
+		},
+	}
+
+	b, err := yaml.Marshal(ud)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("#cloud-config\n"), b...), nil
+}
+
+// MetaData returns the meta-data document
+func (c *CloudInit) MetaData() ([]byte, error) {
+	return yaml.Marshal(metaData{
+		InstanceID:    c.VMName,
+		LocalHostname: c.VMName,
+	})
+}
+
+// GenerateISO writes the NoCloud seed ISO containing the user-data and
+// meta-data documents to isoPath
+func (c *CloudInit) GenerateISO(isoPath string) error {
+	ud, err := c.UserData()
+	if err != nil {
+		return err
+	}
+	md, err := c.MetaData()
+	if err != nil {
+		return err
+	}
+	if err := createISO(isoPath, volumeLabel, map[string][]byte{
+		userDataFileName: ud,
+		metaDataFileName: md,
+	}); err != nil {
+		return fmt.Errorf("creating cloud-init seed ISO: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package cloudinit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// isoTools are the mkisofs compatible ISO creation tools which are tried in
+// order when creating an ISO image
+var isoTools = []string{"xorrisofs", "genisoimage", "mkisofs"}
+
+func findISOTool() (string, error) {
+	for _, tool := range isoTools {
+		path, err := exec.LookPath(tool)
+		if err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("none of %v could be found in $PATH", isoTools)
+}
+
+// createISO creates an ISO9660 image with Joliet and Rock Ridge extensions
+// at isoPath, labelled volumeID and containing files at its root
+func createISO(isoPath, volumeID string, files map[string][]byte) error {
+	tool, err := findISOTool()
+	if err != nil {
+		return err
+	}
+
+	srcDir, err := os.MkdirTemp("", "macadam-iso")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(srcDir); err != nil {
+			logrus.Warnf("unable to remove %s: %v", srcDir, err)
+		}
+	}()
+
+	names := make([]string, 0, len(files))
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(srcDir, name), content, 0644); err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := []string{"-output", isoPath, "-volid", volumeID, "-joliet", "-rock"}
+	for _, name := range names {
+		args = append(args, filepath.Join(srcDir, name))
+	}
+	cmd := exec.Command(tool, args...)
+	logrus.Debugf("creating ISO: %v", cmd.Args)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if len(out) == 0 {
+			return err
+		}
+		return errors.New(string(out))
+	}
+	return nil
+}
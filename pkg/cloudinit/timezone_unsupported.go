@@ -0,0 +1,7 @@
+//go:build !linux && !darwin
+
+package cloudinit
+
+func getLocalTimeZone() (string, error) {
+	return "", nil
+}
@@ -0,0 +1,304 @@
+// Package compression extracts disk images from the compressed files and
+// archives they are distributed as. It is a fork of podman's machine
+// compression package: the format is detected from the magic number of the
+// file, a single pipeline handles all formats, single disk tarballs are
+// unpacked and the disk is always written sparse.
+package compression
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/utils"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	decompressedFileFlag = os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	progressBarPrefix    = "Extracting compressed file"
+	// headerSize is enough to detect the compression and tar formats, the
+	// tar magic is at offset 257
+	headerSize = 512
+)
+
+// Kind is the compression format of an image file
+type Kind string
+
+const (
+	Uncompressed Kind = "uncompressed"
+	Gzip         Kind = "gzip"
+	Bzip2        Kind = "bzip2"
+	Xz           Kind = "xz"
+	Zstd         Kind = "zstd"
+	Lz4          Kind = "lz4"
+	Zip          Kind = "zip"
+)
+
+var (
+	magicNumbers = []struct {
+		kind  Kind
+		magic []byte
+	}{
+		{Gzip, []byte{0x1F, 0x8B, 0x08}},
+		{Bzip2, []byte{0x42, 0x5A, 0x68}},
+		{Xz, []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}},
+		{Zstd, []byte{0x28, 0xB5, 0x2F, 0xFD}},
+		{Lz4, []byte{0x04, 0x22, 0x4D, 0x18}},
+		{Zip, []byte{0x50, 0x4B, 0x03, 0x04}},
+	}
+
+	// unsupportedMagicNumbers are formats images are sometimes distributed
+	// as which cannot be extracted, they are detected to fail early
+	unsupportedMagicNumbers = []struct {
+		name  string
+		magic []byte
+	}{
+		{"7-zip", []byte{0x37, 0x7A, 0xBC, 0xAF, 0x27, 0x1C}},
+		{"rar", []byte{0x52, 0x61, 0x72, 0x21, 0x1A, 0x07}},
+		{"lzip", []byte{0x4C, 0x5A, 0x49, 0x50}},
+	}
+
+	extensions = map[string]Kind{
+		".gz":  Gzip,
+		".tgz": Gzip,
+		".bz2": Bzip2,
+		".xz":  Xz,
+		".zst": Zstd,
+		".lz4": Lz4,
+		".zip": Zip,
+	}
+
+	unsupportedExtensions = []string{".7z", ".rar", ".lz", ".lzma", ".br", ".z"}
+
+	tarMagic = []byte("ustar")
+)
+
+// Detect returns the compression of the file at path from its header. An
+// error is returned for formats which cannot be extracted and for files
+// whose extension does not match their content.
+func Detect(path string, header []byte) (Kind, error) {
+	for _, m := range magicNumbers {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.kind, nil
+		}
+	}
+	for _, m := range unsupportedMagicNumbers {
+		if bytes.HasPrefix(header, m.magic) {
+			return "", fmt.Errorf("%s: unsupported %s compressed image", path, m.name)
+		}
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, unsupported := range unsupportedExtensions {
+		if ext == unsupported {
+			return "", fmt.Errorf("%s: unsupported %s compressed image", path, strings.TrimPrefix(ext, "."))
+		}
+	}
+	switch kind, ok := extensions[ext]; {
+	// Zip files are not guaranteed to have a magic number at the beginning
+	// of the file, so we need to use the file name to detect them.
+	case kind == Zip:
+		return Zip, nil
+	case ok:
+		return "", fmt.Errorf("%s: file is not %s compressed as its extension suggests", path, kind)
+	}
+	return Uncompressed, nil
+}
+
+// Decompress extracts the disk image in compressedVMFile to
+// decompressedFilePath. Tarballs, compressed or not, must contain a single
+// regular file, the disk image.
+func Decompress(compressedVMFile *define.VMFile, decompressedFilePath string) (retErr error) {
+	compressedFilePath := compressedVMFile.GetPath()
+	compressedFile, err := os.Open(compressedFilePath)
+	if err != nil {
+		return err
+	}
+	defer compressedFile.Close()
+	stat, err := compressedFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(compressedFile)
+	header, err := br.Peek(headerSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	kind, err := Detect(compressedFilePath, header)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("extracting %s compressed image %s", kind, compressedFilePath)
+
+	initMsg := progressBarPrefix + ": " + filepath.Base(decompressedFilePath)
+	p, bar := utils.ProgressBar(initMsg, stat.Size(), initMsg+": done")
+	// Wait for bars to complete and then shut down the bars container
+	defer p.Wait()
+	// Interrupts the bar goroutine. It's important that
+	// bar.Abort(false) is called before p.Wait(), otherwise
+	// can hang.
+	defer bar.Abort(false)
+
+	var r io.Reader
+	if kind == Zip {
+		// zip files cannot be streamed, the progress bar shows the
+		// decompressed file stream against the compressed file size
+		zr, err := openZip(compressedFilePath)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = bar.ProxyReader(zr)
+	} else {
+		dr, err := newReader(kind, bar.ProxyReader(br))
+		if err != nil {
+			return fmt.Errorf("%s: %w", compressedFilePath, err)
+		}
+		defer dr.Close()
+		r = dr
+	}
+
+	decompressedFile, err := os.OpenFile(decompressedFilePath, decompressedFileFlag, 0644)
+	if err != nil {
+		logrus.Errorf("Unable to open destination file %s for writing: %q", decompressedFilePath, err)
+		return err
+	}
+	defer func() {
+		if err := decompressedFile.Close(); err != nil {
+			logrus.Warnf("Unable to to close destination file %s: %q", decompressedFilePath, err)
+			if retErr == nil {
+				retErr = err
+			}
+		}
+	}()
+
+	if err := extract(decompressedFile, r); err != nil {
+		logrus.Errorf("Error extracting compressed file: %q", err)
+		return err
+	}
+	return nil
+}
+
+// newReader returns the decompressed stream of r
+func newReader(kind Kind, r io.Reader) (io.ReadCloser, error) {
+	switch kind {
+	case Uncompressed:
+		return io.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Bzip2:
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case Xz:
+		xr, err := xz.NewReader(r)
+		return io.NopCloser(xr), err
+	case Zstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case Lz4:
+		// hide lz4.Reader.WriteTo, it fails once Read was called, which
+		// happens when the stream is checked for a tarball
+		return io.NopCloser(struct{ io.Reader }{lz4.NewReader(r)}), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %q", kind)
+}
+
+type zipFileReader struct {
+	io.ReadCloser
+	archive *zip.ReadCloser
+}
+
+func (z *zipFileReader) Close() error {
+	return errors.Join(z.ReadCloser.Close(), z.archive.Close())
+}
+
+func openZip(path string) (io.ReadCloser, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(archive.File) != 1 {
+		archive.Close()
+		return nil, errors.New("machine image files should consist of a single compressed file")
+	}
+	f, err := archive.File[0].Open()
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
+	return &zipFileReader{f, archive}, nil
+}
+
+// extract writes the disk image of the decompressed stream r to w, holes
+// are created for the zeroed blocks of the image
+func extract(w io.WriteSeeker, r io.Reader) (retErr error) {
+	sparseWriter := NewSparseWriter(w)
+	defer func() {
+		if err := sparseWriter.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	br := bufio.NewReaderSize(r, headerSize)
+	header, err := br.Peek(headerSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if len(header) < 257+len(tarMagic) || !bytes.Equal(header[257:257+len(tarMagic)], tarMagic) {
+		_, err = io.Copy(sparseWriter, br)
+		return err
+	}
+	return extractTar(sparseWriter, br)
+}
+
+// extractTar writes the only regular file of the tarball r to w
+func extractTar(w io.Writer, r io.Reader) error {
+	var disk string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+		case tar.TypeDir:
+			continue
+		default:
+			logrus.Debugf("skipping %s in image archive", hdr.Name)
+			continue
+		}
+		if disk != "" {
+			return fmt.Errorf("image archives should contain a single disk image, found %s and %s", disk, hdr.Name)
+		}
+		disk = hdr.Name
+		logrus.Debugf("extracting %s from image archive", disk)
+		if _, err := io.Copy(w, tr); err != nil {
+			return err
+		}
+	}
+	if disk == "" {
+		return errors.New("image archive does not contain a disk image")
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package compression
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// testDisk is a disk image with zeroed blocks long enough to become holes
+var testDisk = append(append(bytes.Repeat([]byte("disk"), 1024), make([]byte, 8192)...), bytes.Repeat([]byte("data"), 1024)...)
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		header  []byte
+		want    Kind
+		wantErr bool
+	}{
+		{name: "gzip", path: "disk.gz", header: []byte{0x1F, 0x8B, 0x08, 0x00}, want: Gzip},
+		{name: "bzip2", path: "disk.bz2", header: []byte("BZh91AY"), want: Bzip2},
+		{name: "xz", path: "disk.xz", header: []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00, 0x00}, want: Xz},
+		{name: "zstd", path: "disk.zst", header: []byte{0x28, 0xB5, 0x2F, 0xFD, 0x00}, want: Zstd},
+		{name: "lz4", path: "disk.lz4", header: []byte{0x04, 0x22, 0x4D, 0x18, 0x00}, want: Lz4},
+		{name: "zip", path: "disk.zip", header: []byte{0x50, 0x4B, 0x03, 0x04, 0x00}, want: Zip},
+		{name: "magic without extension", path: "disk", header: []byte{0x28, 0xB5, 0x2F, 0xFD}, want: Zstd},
+		{name: "zip without magic", path: "disk.ZIP", header: []byte("not a magic"), want: Zip},
+		{name: "uncompressed", path: "disk.qcow2", header: []byte("QFI\xfb"), want: Uncompressed},
+		{name: "empty", path: "disk.raw", want: Uncompressed},
+		{name: "7-zip", path: "disk.raw", header: []byte{0x37, 0x7A, 0xBC, 0xAF, 0x27, 0x1C}, wantErr: true},
+		{name: "rar", path: "disk", header: []byte{0x52, 0x61, 0x72, 0x21, 0x1A, 0x07, 0x00}, wantErr: true},
+		{name: "lzip", path: "disk", header: []byte("LZIP\x01"), wantErr: true},
+		{name: "unsupported extension", path: "disk.img.lzma", header: []byte("unknown"), wantErr: true},
+		{name: "extension not matching content", path: "disk.img.xz", header: []byte("QFI\xfb"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Detect(tt.path, tt.header)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// compress returns content compressed by the writer newWriter returns
+func compress(t *testing.T, content []byte, newWriter func(io.Writer) (io.WriteCloser, error)) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w, err := newWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// tarball returns a tarball of the given files, in order
+func tarball(t *testing.T, files ...string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	if err := tw.WriteHeader(&tar.Header{Name: "image/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(testDisk))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(testDisk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func zipArchive(t *testing.T, files ...string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, name := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(testDisk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	gzipWriter := func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil }
+	xzWriter := func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) }
+	zstdWriter := func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) }
+	lz4Writer := func(w io.Writer) (io.WriteCloser, error) { return lz4.NewWriter(w), nil }
+
+	tests := []struct {
+		name    string
+		file    string
+		content []byte
+		wantErr bool
+	}{
+		{name: "uncompressed", file: "disk.raw", content: testDisk},
+		{name: "gzip", file: "disk.raw.gz", content: compress(t, testDisk, gzipWriter)},
+		{name: "xz", file: "disk.raw.xz", content: compress(t, testDisk, xzWriter)},
+		{name: "zstd", file: "disk.raw.zst", content: compress(t, testDisk, zstdWriter)},
+		{name: "lz4", file: "disk.raw.lz4", content: compress(t, testDisk, lz4Writer)},
+		{name: "zip", file: "disk.zip", content: zipArchive(t, "disk.raw")},
+		{name: "tar", file: "disk.tar", content: tarball(t, "image/disk.raw")},
+		{name: "compressed tar", file: "disk.tar.gz", content: compress(t, tarball(t, "image/disk.raw"), gzipWriter)},
+		{name: "lz4 tar", file: "disk.tar.lz4", content: compress(t, tarball(t, "image/disk.raw"), lz4Writer)},
+		{name: "multi-file tar", file: "disk.tar", content: tarball(t, "image/disk.raw", "image/disk2.raw"), wantErr: true},
+		{name: "compressed multi-file tar", file: "disk.tar.zst", content: compress(t, tarball(t, "disk.raw", "README"), zstdWriter), wantErr: true},
+		{name: "empty tar", file: "disk.tar", content: tarball(t), wantErr: true},
+		{name: "multi-file zip", file: "disk.zip", content: zipArchive(t, "disk.raw", "README"), wantErr: true},
+		{name: "corrupted", file: "disk.raw.gz", content: compress(t, testDisk, gzipWriter)[:100], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, tt.file)
+			if err := os.WriteFile(src, tt.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			srcFile, err := define.NewMachineFile(src, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dest := filepath.Join(dir, "disk")
+			err = Decompress(srcFile, dest)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, testDisk) {
+				t.Errorf("extracted %d bytes differing from the disk image", len(got))
+			}
+		})
+	}
+}
+
+// memFile is an in-memory file counting the bytes written to it
+type memFile struct {
+	data    []byte
+	offset  int64
+	written int
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	if end := f.offset + int64(len(b)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	copy(f.data[f.offset:], b)
+	f.offset += int64(len(b))
+	f.written += len(b)
+	return len(b), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		f.offset = offset
+	case io.SeekCurrent:
+		f.offset += offset
+	case io.SeekEnd:
+		f.offset = int64(len(f.data)) + offset
+	}
+	return f.offset, nil
+}
+
+func TestSparseWriter(t *testing.T) {
+	data := bytes.Repeat([]byte("data"), 256)
+	tests := []struct {
+		name        string
+		writes      [][]byte
+		wantWritten int
+	}{
+		{name: "no zeros", writes: [][]byte{data}, wantWritten: len(data)},
+		{name: "short zero run", writes: [][]byte{append(append(append([]byte{}, data...), make([]byte, zerosThreshold-1)...), data...)}, wantWritten: 2*len(data) + zerosThreshold - 1},
+		{name: "hole", writes: [][]byte{data, make([]byte, 8192), data}, wantWritten: 2 * len(data)},
+		{name: "hole within a write", writes: [][]byte{append(append(append([]byte{}, data...), make([]byte, 8192)...), data...)}, wantWritten: 2 * len(data)},
+		{name: "leading hole", writes: [][]byte{make([]byte, 8192), data}, wantWritten: len(data)},
+		// the last byte is written for the file to have its full size
+		{name: "trailing hole", writes: [][]byte{data, make([]byte, 8192)}, wantWritten: len(data) + 1},
+		{name: "only zeros", writes: [][]byte{make([]byte, 4096), make([]byte, 4096)}, wantWritten: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &memFile{}
+			w := NewSparseWriter(f)
+			var want []byte
+			for _, b := range tt.writes {
+				if _, err := w.Write(b); err != nil {
+					t.Fatal(err)
+				}
+				want = append(want, b...)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(f.data, want) {
+				t.Errorf("got %d bytes differing from the %d bytes written", len(f.data), len(want))
+			}
+			if f.written != tt.wantWritten {
+				t.Errorf("wrote %d bytes, want %d", f.written, tt.wantWritten)
+			}
+		})
+	}
+}
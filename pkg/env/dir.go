@@ -0,0 +1,213 @@
+package env
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/storage/pkg/homedir"
+)
+
+// HomeEnvVar is the environment variable used to relocate all of macadam's
+// machine state (configuration, data, runtime files and cache) to a single
+// directory
+const HomeEnvVar = "MACADAM_HOME"
+
+const (
+	configSubDir  = "config"
+	dataSubDir    = "data"
+	runtimeSubDir = "run"
+	cacheSubDir   = "cache"
+)
+
+var homeDir string
+
+// SetHome relocates all of macadam's machine state to dir. It takes
+// precedence over the MACADAM_HOME environment variable. An empty dir
+// restores the default layout.
+func SetHome(dir string) {
+	homeDir = dir
+}
+
+// Relocated returns whether macadam's machine state has been relocated with
+// SetHome or the MACADAM_HOME environment variable
+func Relocated() bool {
+	_, ok := home()
+	return ok
+}
+
+// home returns the directory all of macadam's machine state has been
+// relocated to, if any
+func home() (string, bool) {
+	if homeDir != "" {
+		return homeDir, true
+	}
+	if dir, ok := os.LookupEnv(HomeEnvVar); ok && dir != "" {
+		return dir, true
+	}
+	return "", false
+}
+
+// GetCacheDir returns the dir where VM images are downloaded into when pulled
+func GetCacheDir(vmType define.VMType) (string, error) {
+	cacheDirPrefix, err := CacheDirPrefix()
+	if err != nil {
+		return "", err
+	}
+	cacheDir := filepath.Join(cacheDirPrefix, vmType.String())
+	return cacheDir, os.MkdirAll(cacheDir, 0755)
+}
+
+// GetDataDir returns the filepath where vm images should live for macadam
+func GetDataDir(vmType define.VMType) (string, error) {
+	dataDirPrefix, err := DataDirPrefix()
+	if err != nil {
+		return "", err
+	}
+	dataDir := filepath.Join(dataDirPrefix, vmType.String())
+	return dataDir, os.MkdirAll(dataDir, 0755)
+}
+
+// GetGlobalDataDir returns the root of all backends for shared machine data
+func GetGlobalDataDir() (string, error) {
+	dataDir, err := DataDirPrefix()
+	if err != nil {
+		return "", err
+	}
+	return dataDir, os.MkdirAll(dataDir, 0755)
+}
+
+// GetConfDir returns the filepath to where configuration files for macadam
+// machines should live
+func GetConfDir(vmType define.VMType) (string, error) {
+	confDirPrefix, err := ConfDirPrefix()
+	if err != nil {
+		return "", err
+	}
+	confDir := filepath.Join(confDirPrefix, vmType.String())
+	return confDir, os.MkdirAll(confDir, 0755)
+}
+
+// GetRuntimeDir returns the filepath where the sockets, pid and log files
+// of running machines live
+func GetRuntimeDir() (string, error) {
+	rtDir, err := RuntimeDirPrefix()
+	if err != nil {
+		return "", err
+	}
+	return rtDir, os.MkdirAll(rtDir, 0755)
+}
+
+// GetMachineDirs returns the macadam directories of the machines of the
+// given provider, all of them are created if needed
+func GetMachineDirs(vmType define.VMType) (*define.MachineDirs, error) {
+	rtDir, err := GetRuntimeDir()
+	if err != nil {
+		return nil, err
+	}
+	rtDirFile, err := define.NewMachineFile(rtDir, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	configDir, err := GetConfDir(vmType)
+	if err != nil {
+		return nil, err
+	}
+	configDirFile, err := define.NewMachineFile(configDir, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	dataDir, err := GetDataDir(vmType)
+	if err != nil {
+		return nil, err
+	}
+	dataDirFile, err := define.NewMachineFile(dataDir, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheDir, err := GetCacheDir(vmType)
+	if err != nil {
+		return nil, err
+	}
+	imageCacheDir, err := define.NewMachineFile(cacheDir, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &define.MachineDirs{
+		ConfigDir:     configDirFile,
+		DataDir:       dataDirFile,
+		ImageCacheDir: imageCacheDir,
+		RuntimeDir:    rtDirFile,
+	}, nil
+}
+
+// ConfDirPrefix returns the path prefix for all machine config files
+func ConfDirPrefix() (string, error) {
+	if dir, ok := home(); ok {
+		return filepath.Join(dir, configSubDir), nil
+	}
+	conf, err := homedir.GetConfigHome()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(conf, "macadam", "machine"), nil
+}
+
+// DataDirPrefix returns the path prefix for all machine data files
+func DataDirPrefix() (string, error) {
+	if dir, ok := home(); ok {
+		return filepath.Join(dir, dataSubDir), nil
+	}
+	data, err := homedir.GetDataHome()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(data, "macadam", "machine"), nil
+}
+
+// CacheDirPrefix returns the path prefix for all cached machine images
+func CacheDirPrefix() (string, error) {
+	if dir, ok := home(); ok {
+		return filepath.Join(dir, cacheSubDir), nil
+	}
+	cache, err := homedir.GetCacheHome()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cache, "macadam", "machine"), nil
+}
+
+// RuntimeDirPrefix returns the path prefix for all machine runtime files
+func RuntimeDirPrefix() (string, error) {
+	if dir, ok := home(); ok {
+		return filepath.Join(dir, runtimeSubDir), nil
+	}
+	rtDir, err := getRuntimeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(rtDir, "macadam"), nil
+}
+
+// GetSSHIdentityPath returns the path to the expected SSH private key
+func GetSSHIdentityPath(name string) (string, error) {
+	datadir, err := GetGlobalDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(datadir, name), nil
+}
+
+// WithMacadamPrefix returns name prefixed with "macadam-" unless it already
+// is
+func WithMacadamPrefix(name string) string {
+	if !strings.HasPrefix(name, "macadam") {
+		name = "macadam-" + name
+	}
+	return name
+}
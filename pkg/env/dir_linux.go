@@ -0,0 +1,14 @@
+package env
+
+import (
+	"os"
+
+	"github.com/containers/storage/pkg/homedir"
+)
+
+func getRuntimeDir() (string, error) {
+	if os.Geteuid() == 0 {
+		return "/run", nil
+	}
+	return homedir.GetRuntimeDir()
+}
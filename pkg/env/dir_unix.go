@@ -0,0 +1,13 @@
+//go:build darwin || freebsd
+
+package env
+
+import "os"
+
+func getRuntimeDir() (string, error) {
+	tmpDir, ok := os.LookupEnv("TMPDIR")
+	if !ok {
+		tmpDir = "/tmp"
+	}
+	return tmpDir, nil
+}
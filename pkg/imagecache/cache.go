@@ -0,0 +1,510 @@
+package imagecache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/lockfile"
+	crcos "github.com/crc-org/crc/v2/pkg/os"
+	"github.com/crc-org/macadam/pkg/compression"
+	"github.com/crc-org/macadam/pkg/lock"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// entryFileExtension is the extension of the metadata file stored next
+	// to each cached image
+	entryFileExtension = ".json"
+	// tempDir is the subdirectory of the cache holding the files which are
+	// still being downloaded or decompressed
+	tempDir = "tmp"
+	// partialDownloadPrefix is the prefix of the partial HTTP downloads kept
+	// in the data directory, machine names cannot start with a dot
+	partialDownloadPrefix = ".download-"
+)
+
+// Kind is the type of source a cached image was fetched from
+type Kind string
+
+const (
+	// OCIKind images are disk artifacts pulled from an OCI registry
+	OCIKind Kind = "oci"
+	// HTTPKind images are downloaded from an http(s) URL
+	HTTPKind Kind = "http"
+	// LocalKind images are read from a file on the host
+	LocalKind Kind = "local"
+)
+
+// ErrNotFound is returned when an image is not present in the cache
+var ErrNotFound = errors.New("image not found in cache")
+
+// Entry describes a decompressed disk image stored in the cache
+type Entry struct {
+	// Key identifies the entry, it is derived from the OCI digest of the
+	// disk artifact, the URL of the image or the local file it was read
+	// from
+	Key string
+	// Kind is the type of source the image was fetched from
+	Kind Kind
+	// Source is the image as given by the user
+	Source string
+	// Digest is the digest of the image as fetched, before decompression,
+	// when it is known
+	Digest digest.Digest `json:",omitempty"`
+	// ETag and LastModified are the validators returned by the server
+	// for HTTP images, they are part of the key so that updated images
+	// are downloaded again
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+	// Format is the format of the decompressed image, as detected from its
+	// header. Images are converted to the format of the provider when they
+	// are cached.
+	Format DiskFormat `json:",omitempty"`
+	// Size is the size of the cached image in bytes
+	Size int64
+	// Created is when the image was added to the cache
+	Created time.Time
+	// LastUsed is when a machine was last created from the image
+	LastUsed time.Time
+}
+
+// Cache stores decompressed disk images so that machines created from the
+// same image do not download and decompress it again
+type Cache struct {
+	dir string
+	// dataDir holds the partial HTTP downloads so that they are resumed
+	dataDir string
+	vmType  define.VMType
+}
+
+// New returns the image cache of the given provider, stored in the image
+// cache directory of the machine directories
+func New(dirs *define.MachineDirs, vmType define.VMType) *Cache {
+	return &Cache{
+		dir:     dirs.ImageCacheDir.GetPath(),
+		dataDir: dirs.DataDir.GetPath(),
+		vmType:  vmType,
+	}
+}
+
+// ImagePath returns the path of the decompressed image of the entry
+func (c *Cache) ImagePath(e *Entry) string {
+	return filepath.Join(c.dir, e.Key+"."+c.vmType.ImageFormat().Kind())
+}
+
+func (c *Cache) entryPath(key string) string {
+	return filepath.Join(c.dir, key+entryFileExtension)
+}
+
+// lock returns the lock of the whole cache, see lock.GetImageCacheLock
+func (c *Cache) lock() (*lockfile.LockFile, error) {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return nil, err
+	}
+	return lock.GetImageCacheLock(c.dir)
+}
+
+// List returns all the entries of the cache, most recently used first
+func (c *Cache) List() ([]*Entry, error) {
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	entries := make([]*Entry, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != entryFileExtension {
+			continue
+		}
+		e, err := c.Get(strings.TrimSuffix(f.Name(), entryFileExtension))
+		if err != nil {
+			logrus.Warnf("skipping cached image %q: %v", f.Name(), err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+	return entries, nil
+}
+
+// Get returns the entry with the given key. ErrNotFound is returned when
+// there is no such entry or when its image is missing.
+func (c *Cache) Get(key string) (*Entry, error) {
+	b, err := os.ReadFile(c.entryPath(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		}
+		return nil, err
+	}
+	e := new(Entry)
+	if err := json.Unmarshal(b, e); err != nil {
+		return nil, fmt.Errorf("parsing cache entry %q: %w", key, err)
+	}
+	if _, err := os.Stat(c.ImagePath(e)); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		}
+		return nil, err
+	}
+	return e, nil
+}
+
+// lookup is Get returning nil when the image is not cached
+func (c *Cache) lookup(key string) (*Entry, error) {
+	e, err := c.Get(key)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	logrus.Debugf("using cached image %s for %s", e.Key, e.Source)
+	return e, nil
+}
+
+// Find returns the entry matching a key or a unique key prefix, or the
+// source of an image
+func (c *Cache) Find(nameOrKey string) (*Entry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	var matches []*Entry
+	for _, e := range entries {
+		if e.Key == nameOrKey || e.Source == nameOrKey {
+			return e, nil
+		}
+		if strings.HasPrefix(e.Key, nameOrKey) {
+			matches = append(matches, e)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("%s: %w", nameOrKey, ErrNotFound)
+	case 1:
+		return matches[0], nil
+	}
+	return nil, fmt.Errorf("%q matches %d cached images, use a longer key", nameOrKey, len(matches))
+}
+
+func (c *Cache) write(e *Entry) error {
+	b, err := json.MarshalIndent(e, "", " ")
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(c.entryPath(e.Key), b, 0644)
+}
+
+// Remove deletes the entry and its image from the cache
+func (c *Cache) Remove(e *Entry) error {
+	cacheLock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	return c.remove(e)
+}
+
+func (c *Cache) remove(e *Entry) error {
+	var errs []error
+	for _, path := range []string{c.ImagePath(e), c.entryPath(e.Key)} {
+		// read-only files cannot be removed on Windows
+		if err := os.Chmod(path, 0644); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+			continue
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Prune removes the entries for which inUse returns false, as well as
+// leftovers of interrupted downloads. The removed entries are returned.
+// It waits for the images being added to the cache.
+func (c *Cache) Prune(inUse func(*Entry) bool) ([]*Entry, error) {
+	cacheLock, err := c.lock()
+	if err != nil {
+		return nil, err
+	}
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		errs    []error
+		removed []*Entry
+	)
+	for _, e := range entries {
+		if inUse(e) {
+			continue
+		}
+		if err := c.remove(e); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, e)
+	}
+
+	if err := os.RemoveAll(filepath.Join(c.dir, tempDir)); err != nil {
+		errs = append(errs, err)
+	}
+	// no download is in progress while the cache is locked
+	partials, err := filepath.Glob(filepath.Join(c.dataDir, partialDownloadPrefix+"*"))
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, partial := range partials {
+		if err := os.Remove(partial); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+// PullOptions alter how images are fetched into the cache
+type PullOptions struct {
+	// Verify is the integrity check of HTTP and local images
+	Verify Verification
+	// Retries is the number of times a failed HTTP download is retried,
+	// partial downloads are resumed when the server supports it
+	Retries int
+	// RetryDelay is the delay before the first retry, it doubles after
+	// each attempt. DefaultRetryDelay is used when unset.
+	RetryDelay time.Duration
+	// Progress is called as HTTP downloads progress
+	Progress ProgressFunc
+	// OCI selects the disk artifact of OCI images
+	OCI OCIOptions
+}
+
+// GetDisk copies the disk image identified by the user input to imagePath.
+// The image is fetched and decompressed into the cache first unless it is
+// already there. The input can be empty for the default image, a docker://
+// reference, an oci-dir: or oci-archive: local OCI layout, an http(s) URL or
+// a local path.
+func (c *Cache) GetDisk(userInputPath string, opts *PullOptions, imagePath *define.VMFile) (*Entry, error) {
+	return c.getDisk(userInputPath, opts, func(e *Entry) error {
+		logrus.Debugf("copying cached image %s to %s", c.ImagePath(e), imagePath.GetPath())
+		if err := crcos.CopyFileSparse(c.ImagePath(e), imagePath.GetPath()); err != nil {
+			return fmt.Errorf("copying cached image: %w", err)
+		}
+		// the copy has the mode of the read-only cached image
+		return os.Chmod(imagePath.GetPath(), 0644)
+	})
+}
+
+// GetOverlay is GetDisk for qcow2 disks, the image at imagePath is a
+// copy-on-write overlay backed by the cached image instead of a full copy.
+// The cached image must then be kept for as long as the overlay exists.
+func (c *Cache) GetOverlay(userInputPath string, opts *PullOptions, imagePath *define.VMFile) (*Entry, error) {
+	return c.getDisk(userInputPath, opts, func(e *Entry) error {
+		logrus.Debugf("creating overlay %s of cached image %s", imagePath.GetPath(), c.ImagePath(e))
+		return createOverlay(c.ImagePath(e), imagePath.GetPath())
+	})
+}
+
+func (c *Cache) getDisk(userInputPath string, opts *PullOptions, layDisk func(e *Entry) error) (*Entry, error) {
+	src, err := c.newSource(userInputPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	// the image must not be pruned until the disk is laid
+	cacheLock, err := c.lock()
+	if err != nil {
+		return nil, err
+	}
+	cacheLock.RLock()
+	defer cacheLock.Unlock()
+
+	e, err := c.get(src, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := layDisk(e); err != nil {
+		return nil, err
+	}
+
+	e.LastUsed = time.Now()
+	if err := c.write(e); err != nil {
+		logrus.Warnf("updating cache entry %s: %v", e.Key, err)
+	}
+	return e, nil
+}
+
+func (c *Cache) get(src source, opts *PullOptions) (*Entry, error) {
+	tmp := filepath.Join(c.dir, tempDir)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return nil, err
+	}
+	key, err := src.key()
+	if err != nil {
+		return nil, err
+	}
+
+	// verified images are cached separately, the cache key includes the
+	// digest they were checked against
+	var expected digest.Digest
+	if opts.Verify.IsSet() {
+		f, ok := src.(fileSource)
+		if !ok {
+			return nil, errors.New("image verification is only supported for HTTP and local images")
+		}
+		if expected, err = opts.Verify.expectedDigest(f.fileName()); err != nil {
+			return nil, err
+		}
+		key = hashKey(key, expected.String())
+	}
+	e, err := c.lookup(key)
+	if err != nil || e != nil {
+		return e, err
+	}
+
+	// concurrent fetches of the same image would write to the same files
+	entryLock, err := lock.GetImageCacheEntryLock(tmp, key)
+	if err != nil {
+		return nil, err
+	}
+	entryLock.Lock()
+	defer entryLock.Unlock()
+	// the image may have been cached while waiting for the lock
+	if e, err := c.lookup(key); err != nil || e != nil {
+		return e, err
+	}
+
+	e = &Entry{
+		Key:     key,
+		Created: time.Now(),
+	}
+	compressed, cleanup, err := src.fetch(tmp, e, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	if expected != "" {
+		if e.Digest != expected {
+			if err := verifyFile(compressed.GetPath(), expected); err != nil {
+				return nil, err
+			}
+		}
+		e.Digest = expected
+	}
+
+	partial := filepath.Join(tmp, filepath.Base(c.ImagePath(e)))
+	logrus.Debugf("decompressing (if needed) %s to %s", compressed.GetPath(), partial)
+	if err := compression.Decompress(compressed, partial); err != nil {
+		_ = os.Remove(partial)
+		return nil, err
+	}
+	if err := c.convert(e, partial); err != nil {
+		_ = os.Remove(partial)
+		return nil, err
+	}
+	fi, err := os.Stat(partial)
+	if err != nil {
+		return nil, err
+	}
+	e.Size = fi.Size()
+	// cached images are shared between machines, and may back their disks,
+	// they must not be modified
+	if err := os.Chmod(partial, 0444); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(partial, c.ImagePath(e)); err != nil {
+		return nil, err
+	}
+	if err := c.write(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// source is a location disk images can be fetched from
+type source interface {
+	// key returns the cache key of the image. The key changes when the
+	// image changes, cached images are never replaced as they may back
+	// the disk of existing machines.
+	key() (string, error)
+	// fetch makes the possibly compressed image available on the host,
+	// filling the source related fields of the entry. Temporary files are
+	// created in tmpDir, except HTTP downloads which are resumed from the
+	// data directory. The returned function removes them.
+	fetch(tmpDir string, e *Entry, opts *PullOptions) (*define.VMFile, func(), error)
+}
+
+// fileSource is a source fetching a single file, whose name can be looked
+// up in checksums files
+type fileSource interface {
+	source
+	fileName() string
+}
+
+func (c *Cache) newSource(userInputPath string, opts *PullOptions) (source, error) {
+	switch {
+	case userInputPath == "" || strings.HasPrefix(userInputPath, "docker://"),
+		strings.HasPrefix(userInputPath, ociDirPrefix), strings.HasPrefix(userInputPath, ociArchivePrefix):
+		return newOCISource(userInputPath, c.vmType, &opts.OCI)
+	case strings.HasPrefix(userInputPath, "http://") || strings.HasPrefix(userInputPath, "https://"):
+		return newHTTPSource(userInputPath, c.dataDir)
+	default:
+		return newLocalSource(userInputPath)
+	}
+}
+
+// hashKey derives a cache key from the given parts
+func hashKey(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// convert detects the format of the decompressed image at path and converts
+// it in place to the format of the provider if they differ
+func (c *Cache) convert(e *Entry, path string) error {
+	format, err := DetectDiskFormat(path)
+	if err != nil {
+		return err
+	}
+	// cached images back the disks of machines, they must not give the
+	// guest access to other files of the host
+	if err := CheckSelfContained(path, format); err != nil {
+		return err
+	}
+	e.Format = format
+	target := providerDiskFormat(c.vmType)
+	if format == target {
+		return nil
+	}
+	converted := path + ".converted"
+	if err := ConvertDisk(path, format, converted, target); err != nil {
+		_ = os.Remove(converted)
+		return err
+	}
+	return os.Rename(converted, path)
+}
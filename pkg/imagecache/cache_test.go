@@ -0,0 +1,151 @@
+package imagecache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+)
+
+// newTestCache returns a cache in a temporary directory. Raw disks are used
+// so that images are cached without qemu-img.
+func newTestCache(t *testing.T) (*Cache, string) {
+	t.Helper()
+	dir := t.TempDir()
+	cacheDir, err := define.NewMachineFile(filepath.Join(dir, "cache"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataDir, err := define.NewMachineFile(filepath.Join(dir, "data"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{cacheDir.GetPath(), dataDir.GetPath()} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dirs := &define.MachineDirs{ImageCacheDir: cacheDir, DataDir: dataDir}
+	return New(dirs, define.AppleHvVirt), dir
+}
+
+func TestConcurrentGetDisk(t *testing.T) {
+	c, dir := newTestCache(t)
+	image := filepath.Join(dir, "disk.raw")
+	content := bytes.Repeat([]byte("macadam"), 1<<20)
+	if err := os.WriteFile(image, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const machines = 8
+	var wg sync.WaitGroup
+	errs := make([]error, machines)
+	for i := 0; i < machines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			disk, err := define.NewMachineFile(filepath.Join(dir, fmt.Sprintf("m%d.raw", i)), nil)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			_, errs[i] = c.GetDisk(image, &PullOptions{}, disk)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("machine %d: %v", i, err)
+		}
+		b, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("m%d.raw", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, content) {
+			t.Errorf("disk of machine %d differs from the image", i)
+		}
+	}
+	entries, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d cache entries, want 1", len(entries))
+	}
+}
+
+func TestPruneKeepsImagesInUse(t *testing.T) {
+	c, dir := newTestCache(t)
+	var keep *Entry
+	for _, name := range []string{"a.raw", "b.raw"} {
+		image := filepath.Join(dir, name)
+		if err := os.WriteFile(image, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		disk, err := define.NewMachineFile(filepath.Join(dir, "m-"+name), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := c.GetDisk(image, &PullOptions{}, disk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keep = e
+	}
+
+	removed, err := c.Prune(func(e *Entry) bool { return e.Key == keep.Key })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].Key == keep.Key {
+		t.Errorf("pruned %v, want only the image not in use", removed)
+	}
+	if _, err := c.Get(keep.Key); err != nil {
+		t.Errorf("image in use was pruned: %v", err)
+	}
+}
+
+func TestPruneRemovesPartialDownloads(t *testing.T) {
+	c, dir := newTestCache(t)
+	partial := filepath.Join(dir, "data", partialDownloadPrefix+"key-disk.raw.xz")
+	disk := filepath.Join(dir, "data", "download-amd64.qcow2")
+	for _, path := range []string{partial, disk} {
+		if err := os.WriteFile(path, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := c.Prune(func(*Entry) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(partial); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial download was not removed: %v", err)
+	}
+	if _, err := os.Stat(disk); err != nil {
+		t.Errorf("disk of machine %q was removed: %v", "download", err)
+	}
+}
+
+func TestGetDiskRejectsBackingFile(t *testing.T) {
+	c, dir := newTestCache(t)
+	image := filepath.Join(dir, "disk.qcow2")
+	if err := os.WriteFile(image, qcow2Header(3, 0x200, 0), 0644); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := define.NewMachineFile(filepath.Join(dir, "m.raw"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetDisk(image, &PullOptions{}, disk); !errors.Is(err, ErrExternalFile) {
+		t.Fatalf("got %v, want ErrExternalFile", err)
+	}
+	if entries, err := c.List(); err != nil || len(entries) != 0 {
+		t.Errorf("image with a backing file was cached: %v, %v", entries, err)
+	}
+}
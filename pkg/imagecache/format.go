@@ -0,0 +1,181 @@
+package imagecache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/containers/common/pkg/config"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/sirupsen/logrus"
+)
+
+// DiskFormat is the format of a disk image, named after the qemu-img format
+// names
+type DiskFormat string
+
+const (
+	RawFormat   DiskFormat = "raw"
+	Qcow2Format DiskFormat = "qcow2"
+	VMDKFormat  DiskFormat = "vmdk"
+	VHDXFormat  DiskFormat = "vhdx"
+	VHDFormat   DiskFormat = "vpc"
+)
+
+var (
+	qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+	// vmdkMagic starts monolithic sparse extents, vmdkDescriptor starts
+	// text descriptors
+	vmdkMagic      = []byte("KDMV")
+	vmdkDescriptor = []byte("# Disk DescriptorFile")
+	vhdxMagic      = []byte("vhdxfile")
+	// vhdMagic is the cookie of the VHD footer, which is at the end of
+	// fixed images and copied at the start of dynamic ones
+	vhdMagic = []byte("conectix")
+)
+
+// footerSize is the size of the VHD footer
+const footerSize = 512
+
+const (
+	// qcow2HeaderSize is the size of the version 3 qcow2 header, version 2
+	// headers are shorter and have no feature bits
+	qcow2HeaderSize = 104
+	// qcow2ExternalDataFile is the incompatible feature bit of qcow2 images
+	// whose data is stored in another file
+	qcow2ExternalDataFile = 1 << 2
+	// vmdkMaxDescriptorSize bounds the read of the descriptor embedded in
+	// VMDK sparse extents
+	vmdkMaxDescriptorSize = 1 << 20
+	sectorSize            = 512
+)
+
+// ErrExternalFile is returned for disk images which reference other files,
+// their content would be read from the host and exposed to the guest
+var ErrExternalFile = errors.New("disk image references external files")
+
+// DetectDiskFormat returns the format of the disk image at path from its
+// header, images which are not recognized are raw images
+func DetectDiskFormat(path string) (DiskFormat, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, len(vmdkDescriptor))
+	if _, err := io.ReadFull(f, header); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	switch {
+	case bytes.HasPrefix(header, qcow2Magic):
+		return Qcow2Format, nil
+	case bytes.HasPrefix(header, vmdkMagic), bytes.HasPrefix(header, vmdkDescriptor):
+		return VMDKFormat, nil
+	case bytes.HasPrefix(header, vhdxMagic):
+		return VHDXFormat, nil
+	case bytes.HasPrefix(header, vhdMagic):
+		return VHDFormat, nil
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if fi.Size() >= footerSize {
+		footer := make([]byte, len(vhdMagic))
+		if _, err := f.ReadAt(footer, fi.Size()-footerSize); err != nil {
+			return "", err
+		}
+		if bytes.Equal(footer, vhdMagic) {
+			return VHDFormat, nil
+		}
+	}
+	return RawFormat, nil
+}
+
+// CheckSelfContained returns ErrExternalFile when the disk image at path, of
+// the given format, references other files: backing or data files of qcow2
+// images, extents of VMDK descriptors or parents of VMDK sparse extents.
+// Images are flattened with qemu-img convert to be used.
+func CheckSelfContained(path string, format DiskFormat) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := make([]byte, qcow2HeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return err
+	}
+	header = header[:n]
+	switch {
+	case format == Qcow2Format && len(header) >= 20:
+		if binary.BigEndian.Uint64(header[8:16]) != 0 {
+			return fmt.Errorf("%w: qcow2 image %s has a backing file", ErrExternalFile, path)
+		}
+		if binary.BigEndian.Uint32(header[4:8]) >= 3 && len(header) >= 80 && binary.BigEndian.Uint64(header[72:80])&qcow2ExternalDataFile != 0 {
+			return fmt.Errorf("%w: qcow2 image %s has an external data file", ErrExternalFile, path)
+		}
+	case format == VMDKFormat && bytes.HasPrefix(header, vmdkDescriptor):
+		return fmt.Errorf("%w: VMDK image %s is a descriptor of extent files", ErrExternalFile, path)
+	case format == VMDKFormat && len(header) >= 44:
+		offset := binary.LittleEndian.Uint64(header[28:36])
+		size := binary.LittleEndian.Uint64(header[36:44])
+		if offset == 0 || size == 0 {
+			return nil
+		}
+		desc := make([]byte, min(size*sectorSize, vmdkMaxDescriptorSize))
+		n, err := f.ReadAt(desc, int64(offset*sectorSize))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if bytes.Contains(desc[:n], []byte("parentFileNameHint")) {
+			return fmt.Errorf("%w: VMDK image %s has a parent image", ErrExternalFile, path)
+		}
+	}
+	return nil
+}
+
+// providerDiskFormat returns the disk format the machines of vmType boot
+func providerDiskFormat(vmType define.VMType) DiskFormat {
+	switch vmType.ImageFormat() {
+	case define.Qcow:
+		return Qcow2Format
+	case define.Vhdx:
+		return VHDXFormat
+	}
+	return RawFormat
+}
+
+// qemuImg returns the path of the qemu-img binary
+func qemuImg() (string, error) {
+	cfg, err := config.Default()
+	if err != nil {
+		return "", err
+	}
+	return cfg.FindHelperBinary("qemu-img", true)
+}
+
+// ConvertDisk converts the disk image at src to dst in the given format,
+// the zeroed blocks of src are not allocated in dst
+func ConvertDisk(src string, srcFormat DiskFormat, dst string, dstFormat DiskFormat) error {
+	bin, err := qemuImg()
+	if err != nil {
+		return fmt.Errorf("converting %s image to %s: %w", srcFormat, dstFormat, err)
+	}
+	logrus.Debugf("converting %s image %s to %s image %s", srcFormat, src, dstFormat, dst)
+	cmd := exec.Command(bin, "convert", "-f", string(srcFormat), "-O", string(dstFormat), src, dst)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("converting %s image to %s: %w", srcFormat, dstFormat, err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package imagecache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectDiskFormat(t *testing.T) {
+	// fixedVHD is a fixed VHD image, whose only footer is at its end
+	fixedVHD := append(make([]byte, 4096), vhdMagic...)
+	fixedVHD = append(fixedVHD, make([]byte, footerSize-len(vhdMagic))...)
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    DiskFormat
+	}{
+		{name: "qcow2", content: append(append([]byte{}, qcow2Magic...), 0, 0, 0, 3), want: Qcow2Format},
+		{name: "vmdk sparse extent", content: append(append([]byte{}, vmdkMagic...), make([]byte, 508)...), want: VMDKFormat},
+		{name: "vmdk descriptor", content: []byte("# Disk DescriptorFile\nversion=1\n"), want: VMDKFormat},
+		{name: "vhdx", content: append(append([]byte{}, vhdxMagic...), make([]byte, 1024)...), want: VHDXFormat},
+		{name: "dynamic vhd", content: append(append([]byte{}, vhdMagic...), make([]byte, 1024)...), want: VHDFormat},
+		{name: "fixed vhd", content: fixedVHD, want: VHDFormat},
+		{name: "raw", content: bytes.Repeat([]byte{0}, 4096), want: RawFormat},
+		{name: "shorter than magic", content: []byte("QF"), want: RawFormat},
+		{name: "empty", content: nil, want: RawFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "disk")
+			if err := os.WriteFile(path, tt.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := DetectDiskFormat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectDiskFormatMissingFile(t *testing.T) {
+	if _, err := DetectDiskFormat(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("got no error for a missing image")
+	}
+}
+
+// qcow2Header returns a qcow2 header of the given version, backing file
+// offset and incompatible features
+func qcow2Header(version uint32, backingOffset, features uint64) []byte {
+	header := make([]byte, qcow2HeaderSize)
+	copy(header, qcow2Magic)
+	binary.BigEndian.PutUint32(header[4:], version)
+	binary.BigEndian.PutUint64(header[8:], backingOffset)
+	binary.BigEndian.PutUint64(header[72:], features)
+	return header
+}
+
+// vmdkSparse returns a VMDK sparse extent embedding the given descriptor
+func vmdkSparse(descriptor string) []byte {
+	extent := make([]byte, 2*sectorSize)
+	copy(extent, vmdkMagic)
+	binary.LittleEndian.PutUint64(extent[28:], 1)
+	binary.LittleEndian.PutUint64(extent[36:], 1)
+	copy(extent[sectorSize:], descriptor)
+	return extent
+}
+
+func TestCheckSelfContained(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+		format  DiskFormat
+		wantErr bool
+	}{
+		{name: "qcow2", content: qcow2Header(3, 0, 0), format: Qcow2Format},
+		{name: "qcow2 v2", content: qcow2Header(2, 0, 0)[:72], format: Qcow2Format},
+		{name: "qcow2 backing file", content: qcow2Header(3, 0x200, 0), format: Qcow2Format, wantErr: true},
+		{name: "qcow2 v2 backing file", content: qcow2Header(2, 0x200, 0)[:72], format: Qcow2Format, wantErr: true},
+		{name: "qcow2 external data file", content: qcow2Header(3, 0, qcow2ExternalDataFile), format: Qcow2Format, wantErr: true},
+		{name: "vmdk descriptor", content: []byte("# Disk DescriptorFile\nRW 8 FLAT \"/dev/sda\" 0\n"), format: VMDKFormat, wantErr: true},
+		{name: "vmdk sparse", content: vmdkSparse("createType=\"monolithicSparse\"\n"), format: VMDKFormat},
+		{name: "vmdk sparse with parent", content: vmdkSparse("parentFileNameHint=\"/home/u/.ssh/id_rsa\"\n"), format: VMDKFormat, wantErr: true},
+		{name: "raw", content: bytes.Repeat([]byte{0}, 4096), format: RawFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "disk")
+			if err := os.WriteFile(path, tt.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			format, err := DetectDiskFormat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != tt.format {
+				t.Fatalf("detected %s, want %s", format, tt.format)
+			}
+			err = CheckSelfContained(path, format)
+			if tt.wantErr {
+				if !errors.Is(err, ErrExternalFile) {
+					t.Errorf("got %v, want ErrExternalFile", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
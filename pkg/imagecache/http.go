@@ -0,0 +1,335 @@
+package imagecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// dialTimeout, tlsHandshakeTimeout and responseHeaderTimeout bound the
+	// wait for the server before the image starts downloading
+	dialTimeout           = 30 * time.Second
+	tlsHandshakeTimeout   = 10 * time.Second
+	responseHeaderTimeout = 30 * time.Second
+)
+
+// idleTimeout is how long a download may receive no data before the attempt
+// is aborted, and retried
+var idleTimeout = time.Minute
+
+// httpClient is the client of the image downloads. It has no overall timeout
+// as large images take long to download, stalled downloads are aborted by
+// idleReader instead.
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+// httpSource is an image downloaded from an http(s) URL
+type httpSource struct {
+	u *url.URL
+	// downloadDir holds the partial download of the image
+	downloadDir string
+
+	// etag and lastModified are the validators of the image, they are set
+	// when the key is computed
+	etag         string
+	lastModified string
+}
+
+func newHTTPSource(input, downloadDir string) (*httpSource, error) {
+	u, err := url.Parse(input)
+	if err != nil {
+		return nil, err
+	}
+	if path.Base(u.Path) == "" || path.Base(u.Path) == "/" {
+		return nil, fmt.Errorf("invalid url: unable to determine image name in %q", input)
+	}
+	return &httpSource{u: u, downloadDir: downloadDir}, nil
+}
+
+// key identifies the image by its URL and the validators returned by the
+// server, an updated image gets a new key. Only the URL is used when the
+// server provides no validators.
+func (s *httpSource) key() (string, error) {
+	resp, err := s.lookup(http.MethodHead)
+	if err != nil {
+		// some servers and presigned URLs reject HEAD requests, the GET
+		// of the first byte returns the same validators
+		logrus.Debugf("HEAD %s failed, falling back to GET: %v", s.u.String(), err)
+		resp, err = s.lookup(http.MethodGet)
+	}
+	if err != nil {
+		return "", fmt.Errorf("looking up VM image %s: %w", s.u.String(), err)
+	}
+	s.etag = resp.Header.Get("ETag")
+	s.lastModified = resp.Header.Get("Last-Modified")
+	return hashKey(string(HTTPKind), s.u.String(), s.etag, s.lastModified), nil
+}
+
+// lookup requests the headers of the image with the given method, GET
+// requests only ask for its first byte
+func (s *httpSource) lookup(method string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if method == http.MethodGet {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.Body.Close(); err != nil {
+		logrus.Error(err)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, errors.New(resp.Status)
+	}
+	return resp, nil
+}
+
+func (s *httpSource) fileName() string {
+	return path.Base(s.u.Path)
+}
+
+// fetch downloads the image. A download which fails is kept in downloadDir
+// so that the next attempt resumes it, the key of the entry changes along
+// with the image validators so that the bytes of different images are never
+// mixed.
+func (s *httpSource) fetch(_ string, e *Entry, opts *PullOptions) (*define.VMFile, func(), error) {
+	e.Kind = HTTPKind
+	e.Source = s.u.String()
+	e.ETag = s.etag
+	e.LastModified = s.lastModified
+
+	// keep the name of the remote file so that compressed images which are
+	// only detected by their extension, i.e. zip, can be decompressed
+	if err := os.MkdirAll(s.downloadDir, 0755); err != nil {
+		return nil, nil, err
+	}
+	tempPath := filepath.Join(s.downloadDir, partialDownloadPrefix+e.Key+"-"+path.Base(s.u.Path))
+	cleanup := func() {
+		if err := os.Remove(tempPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.Warnf("removing downloaded image: %v", err)
+		}
+	}
+	if err := s.download(tempPath, opts); err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(tempPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	if e.Digest, err = digest.SHA256.FromReader(f); err != nil {
+		return nil, nil, err
+	}
+
+	vmFile, err := define.NewMachineFile(tempPath, nil)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return vmFile, cleanup, nil
+}
+
+// permanentError marks download failures which are not worth retrying
+type permanentError struct {
+	error
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.error
+}
+
+// download fetches the image to dest, retrying failed attempts with an
+// exponential backoff
+func (s *httpSource) download(dest string, opts *PullOptions) error {
+	delay := opts.RetryDelay
+	if delay <= 0 {
+		delay = DefaultRetryDelay
+	}
+	for attempt := 1; ; attempt++ {
+		err := s.downloadAttempt(dest, attempt, opts.Progress)
+		var permanent *permanentError
+		if err == nil || errors.As(err, &permanent) || attempt > opts.Retries {
+			return err
+		}
+		logrus.Warnf("downloading VM image %s failed, retrying in %s: %v", s.u.String(), delay, err)
+		time.Sleep(delay)
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+// downloadAttempt downloads the image to dest, resuming from the bytes
+// already in dest when the server supports range requests
+func (s *httpSource) downloadAttempt(dest string, attempt int, report ProgressFunc) (retErr error) {
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return &permanentError{err}
+	}
+	defer func() {
+		if err := out.Close(); err != nil {
+			logrus.Error(err)
+		}
+	}()
+	offset, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.u.String(), nil)
+	if err != nil {
+		return &permanentError{err}
+	}
+	// only resume when the server can tell whether the image changed since
+	// the partial download started
+	validator := s.etag
+	if validator == "" {
+		validator = s.lastModified
+	}
+	if offset > 0 && validator != "" {
+		logrus.Debugf("resuming download of %s at byte %d", s.u.String(), offset)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", validator)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logrus.Error(err)
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			return s.restart(out, fmt.Errorf("unexpected content range %q", resp.Header.Get("Content-Range")))
+		}
+	case http.StatusOK:
+		// the whole image is sent, either because the server does not
+		// support ranges or because the image changed
+		if err := out.Truncate(0); err != nil {
+			return &permanentError{err}
+		}
+		if offset, err = out.Seek(0, io.SeekStart); err != nil {
+			return &permanentError{err}
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the previous attempt may have failed after downloading the
+		// whole image
+		var size int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes */%d", &size); err == nil && size == offset {
+			return nil
+		}
+		return s.restart(out, errors.New(resp.Status))
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return fmt.Errorf("downloading VM image %s: %s", s.u.String(), resp.Status)
+	default:
+		err := fmt.Errorf("downloading VM image %s: %s", s.u.String(), resp.Status)
+		if resp.StatusCode < http.StatusInternalServerError {
+			return &permanentError{err}
+		}
+		return err
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	body := newIdleReader(resp.Body, idleTimeout, cancel)
+	defer body.stop()
+	pr := newProgressReader(body, Progress{
+		Image:     s.u.String(),
+		Attempt:   attempt,
+		Completed: offset,
+		Total:     total,
+	}, report)
+	defer func() {
+		pr.done(retErr)
+	}()
+
+	if _, err := io.Copy(out, pr); err != nil {
+		return err
+	}
+	if total >= 0 && pr.progress.Completed != total {
+		return fmt.Errorf("downloading VM image %s: got %d bytes out of %d", s.u.String(), pr.progress.Completed, total)
+	}
+	return nil
+}
+
+// restart discards the partial download, the next attempt starts over
+func (s *httpSource) restart(out *os.File, reason error) error {
+	logrus.Debugf("unable to resume download of %s: %v", s.u.String(), reason)
+	if err := out.Truncate(0); err != nil {
+		return &permanentError{err}
+	}
+	return fmt.Errorf("resuming download of VM image %s: %w", s.u.String(), reason)
+}
+
+// idleReader cancels the request whose body it reads when no data is
+// received for the given timeout
+type idleReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+	idle    atomic.Bool
+}
+
+func newIdleReader(r io.Reader, timeout time.Duration, cancel context.CancelFunc) *idleReader {
+	ir := &idleReader{
+		r:       r,
+		timeout: timeout,
+	}
+	ir.timer = time.AfterFunc(timeout, func() {
+		ir.idle.Store(true)
+		cancel()
+	})
+	return ir
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	if ir.idle.Load() {
+		return n, fmt.Errorf("no data received for %s", ir.timeout)
+	}
+	ir.timer.Reset(ir.timeout)
+	return n, err
+}
+
+// stop disarms the idle timer once the body is read
+func (ir *idleReader) stop() {
+	ir.timer.Stop()
+}
@@ -0,0 +1,220 @@
+package imagecache
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testImage = bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+// serveImage serves testImage with the given ETag, honouring range and
+// If-Range requests
+func serveImage(etag string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "disk.raw", time.Time{}, bytes.NewReader(testImage))
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	tests := []struct {
+		name string
+		// partial is the number of bytes of the image already downloaded
+		partial int
+		// etag is the validator the source got when computing its key
+		etag       string
+		serverETag string
+		wantRange  bool
+	}{
+		{name: "fresh download", etag: `"v1"`, serverETag: `"v1"`},
+		{name: "resume", partial: 1000, etag: `"v1"`, serverETag: `"v1"`, wantRange: true},
+		{name: "image changed", partial: 1000, etag: `"v1"`, serverETag: `"v2"`, wantRange: true},
+		{name: "already complete", partial: len(testImage), etag: `"v1"`, serverETag: `"v1"`, wantRange: true},
+		{name: "no validator", partial: 1000, serverETag: `"v1"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotRange atomic.Bool
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Range") != "" {
+					gotRange.Store(true)
+				}
+				serveImage(tt.serverETag)(w, r)
+			}))
+			defer server.Close()
+
+			dest := filepath.Join(t.TempDir(), "disk.raw")
+			partial := append([]byte(nil), testImage[:tt.partial]...)
+			if tt.serverETag != tt.etag {
+				// the bytes of the previous version of the image
+				partial = bytes.Repeat([]byte("x"), tt.partial)
+			}
+			if err := os.WriteFile(dest, partial, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := newHTTPSource(server.URL+"/disk.raw", t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.etag = tt.etag
+			if err := s.download(dest, &PullOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if gotRange.Load() != tt.wantRange {
+				t.Errorf("range requested: %v, want %v", gotRange.Load(), tt.wantRange)
+			}
+			b, err := os.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, testImage) {
+				t.Errorf("downloaded %d bytes differing from the image", len(b))
+			}
+		})
+	}
+}
+
+func TestDownloadRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		failStatus   int
+		retries      int
+		wantRequests int32
+		wantErr      bool
+	}{
+		{name: "no failure", retries: 3, wantRequests: 1},
+		{name: "server errors", failures: 2, failStatus: http.StatusServiceUnavailable, retries: 3, wantRequests: 3},
+		{name: "rate limited", failures: 1, failStatus: http.StatusTooManyRequests, retries: 3, wantRequests: 2},
+		{name: "retries exhausted", failures: 5, failStatus: http.StatusBadGateway, retries: 2, wantRequests: 3, wantErr: true},
+		{name: "not found", failures: 5, failStatus: http.StatusNotFound, retries: 3, wantRequests: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if int(requests.Add(1)) <= tt.failures {
+					w.WriteHeader(tt.failStatus)
+					return
+				}
+				serveImage(`"v1"`)(w, r)
+			}))
+			defer server.Close()
+
+			s, err := newHTTPSource(server.URL+"/disk.raw", t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var attempts []int
+			opts := &PullOptions{
+				Retries:    tt.retries,
+				RetryDelay: time.Millisecond,
+				Progress: func(p Progress) {
+					if p.Done {
+						attempts = append(attempts, p.Attempt)
+					}
+				},
+			}
+			dest := filepath.Join(t.TempDir(), "disk.raw")
+			err = s.download(dest, opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, want error %v", err, tt.wantErr)
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("got %d requests, want %d", got, tt.wantRequests)
+			}
+			if !tt.wantErr && (len(attempts) != 1 || attempts[0] != int(tt.wantRequests)) {
+				t.Errorf("got progress of attempts %v, want only the last one", attempts)
+			}
+		})
+	}
+}
+
+func TestDownloadIdleTimeout(t *testing.T) {
+	defer func(timeout time.Duration) {
+		idleTimeout = timeout
+	}(idleTimeout)
+	idleTimeout = 100 * time.Millisecond
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) > 1 {
+			serveImage(`"v1"`)(w, r)
+			return
+		}
+		// the first attempt stalls half way
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(testImage)))
+		_, _ = w.Write(testImage[:len(testImage)/2])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	s, err := newHTTPSource(server.URL+"/disk.raw", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.etag = `"v1"`
+	dest := filepath.Join(t.TempDir(), "disk.raw")
+	if err := s.download(dest, &PullOptions{Retries: 1, RetryDelay: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, testImage) {
+		t.Errorf("downloaded %d bytes differing from the image", len(b))
+	}
+}
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		rejectHEAD bool
+		etag       string
+	}{
+		{name: "HEAD", etag: `"v1"`},
+		{name: "GET fallback", rejectHEAD: true, etag: `"v1"`},
+		{name: "no validators", etag: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodHead && tt.rejectHEAD {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				if r.Method == http.MethodGet && r.Header.Get("Range") != "bytes=0-0" {
+					t.Errorf("GET lookup requested range %q", r.Header.Get("Range"))
+				}
+				serveImage(tt.etag)(w, r)
+			}))
+			defer server.Close()
+
+			s, err := newHTTPSource(server.URL+"/disk.raw", t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := s.key()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.etag != tt.etag {
+				t.Errorf("got ETag %q, want %q", s.etag, tt.etag)
+			}
+			if want := hashKey(string(HTTPKind), s.u.String(), tt.etag, ""); key != want {
+				t.Errorf("got key %s, want %s", key, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package imagecache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/containers/podman/v5/pkg/machine/define"
+)
+
+// localSource is an image file on the host
+type localSource struct {
+	path string
+	info os.FileInfo
+}
+
+func newLocalSource(path string) (*localSource, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("image %q is a directory", path)
+	}
+	return &localSource{path: abs, info: fi}, nil
+}
+
+// key identifies the file by its path, size and modification time, hashing
+// its content would cost about as much as decompressing it again
+func (s *localSource) key() (string, error) {
+	return hashKey(string(LocalKind), s.path, strconv.FormatInt(s.info.Size(), 10), strconv.FormatInt(s.info.ModTime().UnixNano(), 10)), nil
+}
+
+func (s *localSource) fileName() string {
+	return filepath.Base(s.path)
+}
+
+func (s *localSource) fetch(_ string, e *Entry, _ *PullOptions) (*define.VMFile, func(), error) {
+	e.Kind = LocalKind
+	e.Source = s.path
+	f, err := define.NewMachineFile(s.path, nil)
+	return f, func() {}, err
+}
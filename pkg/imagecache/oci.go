@@ -0,0 +1,392 @@
+package imagecache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/pkg/docker/config"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/ocipull"
+	"github.com/containers/podman/v5/version"
+	"github.com/opencontainers/go-digest"
+	specV1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRepository = "quay.io/podman/machine-os"
+	machineOS         = "linux"
+	// LatestTag follows the most recent image of the repository
+	LatestTag = "latest"
+
+	// ociDirPrefix and ociArchivePrefix select disk artifacts stored in a
+	// local OCI layout directory or in a tarball of one, for hosts without
+	// access to a registry
+	ociDirPrefix     = "oci-dir:"
+	ociArchivePrefix = "oci-archive:"
+	// titleAnnotation is the original file name of the disk image layer
+	titleAnnotation = "org.opencontainers.image.title"
+)
+
+// OCIOptions select the disk artifact of OCI images
+type OCIOptions struct {
+	// Repository is the registry repository the default image is pulled
+	// from, it defaults to quay.io/podman/machine-os
+	Repository string
+	// Tag is the tag of the default image, LatestTag follows the most
+	// recent image. It defaults to the podman major.minor version.
+	Tag string
+	// Digest pins the default image to the digest of its manifest list
+	Digest string
+	// AuthFile is the containers auth.json holding the registry
+	// credentials, the default auth files are used when empty
+	AuthFile string
+	// DiskType is the disktype annotation of the artifact instance to use,
+	// it defaults to the disk type of the provider
+	DiskType string
+}
+
+// Validate checks the OCI options are consistent with the image they are
+// used for
+func (o *OCIOptions) Validate(image string) error {
+	if (o.Repository != "" || o.Tag != "" || o.Digest != "") && image != "" {
+		return errors.New("an image repository, tag or digest can only be used with the default image")
+	}
+	if o.Tag != "" && o.Digest != "" {
+		return errors.New("an image tag and digest cannot both be used")
+	}
+	named, err := reference.ParseNormalizedNamed(o.repository())
+	if err != nil {
+		return fmt.Errorf("invalid image repository %q: %w", o.Repository, err)
+	}
+	if !reference.IsNameOnly(named) {
+		return fmt.Errorf("invalid image repository %q: it must not have a tag or digest", o.Repository)
+	}
+	if o.Tag != "" {
+		if _, err := reference.WithTag(named, o.Tag); err != nil {
+			return fmt.Errorf("invalid image tag %q: %w", o.Tag, err)
+		}
+	}
+	if o.Digest != "" {
+		if _, err := digest.Parse(o.Digest); err != nil {
+			return fmt.Errorf("invalid image manifest digest %q: %w", o.Digest, err)
+		}
+	}
+	return nil
+}
+
+func (o *OCIOptions) repository() string {
+	if o.Repository != "" {
+		return o.Repository
+	}
+	return defaultRepository
+}
+
+// endpoint returns the reference of the default image
+func (o *OCIOptions) endpoint() string {
+	repository := o.repository()
+	switch {
+	case o.Digest != "":
+		return fmt.Sprintf("docker://%s@%s", repository, o.Digest)
+	case o.Tag != "":
+		return fmt.Sprintf("docker://%s:%s", repository, o.Tag)
+	}
+	return fmt.Sprintf("docker://%s:%d.%d", repository, version.Version.Major, version.Version.Minor)
+}
+
+// systemContext returns the context registries are accessed with
+func (o *OCIOptions) systemContext() *types.SystemContext {
+	sys := &types.SystemContext{AuthFilePath: o.AuthFile}
+	if sys.AuthFilePath == "" {
+		sys.AuthFilePath = os.Getenv("REGISTRY_AUTH_FILE")
+	}
+	return sys
+}
+
+// ociSource is a disk artifact stored in an OCI registry or in a local OCI
+// layout. The artifact is a manifest list whose instances are single layer
+// images annotated with the disk type, the matching instance is selected
+// from the host architecture and the disk type of the provider.
+type ociSource struct {
+	ctx      context.Context
+	endpoint string
+	arch     string
+	diskType string
+	sys      *types.SystemContext
+
+	// ref, artifactDigest and layer are set when the artifact is resolved,
+	// ref is the artifact itself for registries and the layout it is
+	// stored in for local artifacts
+	ref            types.ImageReference
+	artifactDigest digest.Digest
+	layer          specV1.Descriptor
+}
+
+func newOCISource(endpoint string, vmType define.VMType, opts *OCIOptions) (*ociSource, error) {
+	var arch string
+	switch runtime.GOARCH {
+	case "amd64":
+		arch = "x86_64"
+	case "arm64":
+		arch = "aarch64"
+	default:
+		return nil, fmt.Errorf("unsupported machine arch: %s", runtime.GOARCH)
+	}
+
+	if endpoint == "" {
+		endpoint = opts.endpoint()
+	}
+	diskType := opts.DiskType
+	if diskType == "" {
+		diskType = vmType.DiskType()
+	}
+	return &ociSource{
+		ctx:      context.Background(),
+		endpoint: endpoint,
+		arch:     arch,
+		diskType: diskType,
+		sys:      opts.systemContext(),
+	}, nil
+}
+
+// key resolves the disk artifact in the registry, its digest is the key so
+// that tags are looked up again every time but the image is only pulled
+// when it changed
+func (s *ociSource) key() (string, error) {
+	if err := s.resolve(); err != nil {
+		return "", err
+	}
+	return s.artifactDigest.Encoded(), nil
+}
+
+// imageReference parses the endpoint, oci-dir: is an alias of the oci:
+// transport
+func (s *ociSource) imageReference() (types.ImageReference, error) {
+	if dir, ok := strings.CutPrefix(s.endpoint, ociDirPrefix); ok {
+		return layout.ParseReference(dir)
+	}
+	return alltransports.ParseImageName(s.endpoint)
+}
+
+// isLocal reports whether the artifact is stored in a local OCI layout
+func (s *ociSource) isLocal() bool {
+	return s.ref.Transport().Name() != docker.Transport.Name()
+}
+
+func (s *ociSource) resolve() error {
+	imgRef, err := s.imageReference()
+	if err != nil {
+		return err
+	}
+	// the messages go to stderr, stdout may hold the JSON progress events
+	if imgRef.DockerReference() != nil {
+		fmt.Fprintf(os.Stderr, "Looking up machine image at %s to create VM\n", imgRef.DockerReference())
+	} else {
+		fmt.Fprintf(os.Stderr, "Looking up machine image in %s to create VM\n", s.endpoint)
+	}
+	imgSrc, err := imgRef.NewImageSource(s.ctx, s.sys)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := imgSrc.Close(); err != nil {
+			logrus.Warn(err)
+		}
+	}()
+
+	artifactDigest, layer, err := s.diskArtifactReference(imgSrc)
+	if err != nil {
+		return err
+	}
+	s.artifactDigest = artifactDigest
+	s.layer = layer
+	s.ref = imgRef
+	if s.isLocal() {
+		return nil
+	}
+
+	digestedRef, err := reference.WithDigest(reference.TrimNamed(imgRef.DockerReference()), artifactDigest)
+	if err != nil {
+		return err
+	}
+	ref, err := docker.NewReference(digestedRef)
+	if err != nil {
+		return err
+	}
+	s.ref = ref
+	return nil
+}
+
+// diskArtifactReference returns the digest of the manifest list instance
+// matching the host and provider, and its layer. It is a fork of
+// ocipull.GetDiskArtifactReference, whose options cannot be set outside of
+// podman.
+func (s *ociSource) diskArtifactReference(imgSrc types.ImageSource) (digest.Digest, specV1.Descriptor, error) {
+	rawManifest, manifestType, err := imgSrc.GetManifest(s.ctx, nil)
+	if err != nil {
+		return "", specV1.Descriptor{}, err
+	}
+	if !manifest.MIMETypeIsMultiImage(manifestType) {
+		return "", specV1.Descriptor{}, fmt.Errorf("wrong manifest type for disk artifact: %s", manifestType)
+	}
+	manifestList, err := manifest.ListFromBlob(rawManifest, manifestType)
+	if err != nil {
+		return "", specV1.Descriptor{}, fmt.Errorf("failed to parse manifest list from blob: %q", err)
+	}
+
+	var artifactDigest digest.Digest
+	for _, d := range manifestList.Instances() {
+		instance, err := manifestList.Instance(d)
+		if err != nil {
+			return "", specV1.Descriptor{}, err
+		}
+		if instance.ReadOnly.Annotations["disktype"] != s.diskType ||
+			instance.ReadOnly.Platform == nil ||
+			instance.ReadOnly.Platform.Architecture != s.arch ||
+			instance.ReadOnly.Platform.OS != machineOS {
+			continue
+		}
+		artifactDigest = d
+		logrus.Debugf("found image in digest: %q", artifactDigest.String())
+		break
+	}
+	if artifactDigest == "" {
+		return "", specV1.Descriptor{}, fmt.Errorf("no valid %s disk artifact found for %s/%s", s.diskType, machineOS, s.arch)
+	}
+
+	rawArtifactManifest, _, err := imgSrc.GetManifest(s.ctx, &artifactDigest)
+	if err != nil {
+		return "", specV1.Descriptor{}, err
+	}
+	artifactManifest := specV1.Manifest{}
+	if err := json.Unmarshal(rawArtifactManifest, &artifactManifest); err != nil {
+		return "", specV1.Descriptor{}, err
+	}
+	if layerLen := len(artifactManifest.Layers); layerLen != 1 {
+		return "", specV1.Descriptor{}, fmt.Errorf("machine images should have exactly 1 layer: %d found", layerLen)
+	}
+	return artifactDigest, artifactManifest.Layers[0], nil
+}
+
+// fetch pulls the artifact into an OCI layout directory and returns the
+// path of its only blob, the compressed disk image
+func (s *ociSource) fetch(tmpDir string, e *Entry, _ *PullOptions) (*define.VMFile, func(), error) {
+	e.Kind = OCIKind
+	e.Source = s.endpoint
+	e.Digest = s.artifactDigest
+	if s.isLocal() {
+		return s.fetchLocal(tmpDir)
+	}
+
+	layoutDir, err := define.NewMachineFile(filepath.Join(tmpDir, s.artifactDigest.Encoded()), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		if err := os.RemoveAll(layoutDir.GetPath()); err != nil {
+			logrus.Warnf("removing pulled image: %v", err)
+		}
+	}
+	pullOpts, err := s.pullOptions()
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if err := ocipull.Pull(s.ctx, s.ref, layoutDir, pullOpts); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to pull %s: %w", s.ref.DockerReference(), err)
+	}
+	blobInfo, err := ocipull.GetLocalBlob(s.ctx, layoutDir.GetPath())
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("unable to get local manifest for %s: %q", layoutDir.GetPath(), err)
+	}
+	blob, err := define.NewMachineFile(filepath.Join(layoutDir.GetPath(), "blobs", blobInfo.Digest.Algorithm().String(), blobInfo.Digest.Encoded()), nil)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return blob, cleanup, nil
+}
+
+// pullOptions passes the credentials of the registry found in the auth
+// files to ocipull.Pull, which only takes a username and password
+func (s *ociSource) pullOptions() (*ocipull.PullOptions, error) {
+	opts := &ocipull.PullOptions{TLSVerify: true}
+	auth, err := config.GetCredentials(s.sys, s.ref.DockerReference().Name())
+	if err != nil {
+		return nil, fmt.Errorf("reading registry credentials: %w", err)
+	}
+	switch {
+	case auth.Username != "" && auth.Password != "":
+		opts.Credentials = auth.Username + ":" + auth.Password
+	case auth.IdentityToken != "":
+		return nil, fmt.Errorf("identity token credentials are not supported for %s", s.ref.DockerReference().Name())
+	}
+	return opts, nil
+}
+
+// fetchLocal copies the disk image layer out of a local OCI layout, there is
+// nothing to pull
+func (s *ociSource) fetchLocal(tmpDir string) (*define.VMFile, func(), error) {
+	imgSrc, err := s.ref.NewImageSource(s.ctx, s.sys)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err := imgSrc.Close(); err != nil {
+			logrus.Warn(err)
+		}
+	}()
+	r, _, err := imgSrc.GetBlob(s.ctx, types.BlobInfo{Digest: s.layer.Digest, Size: s.layer.Size}, none.NoCache)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading disk image layer %s: %w", s.layer.Digest, err)
+	}
+	defer r.Close()
+
+	// the original file name helps detecting the compression of the image
+	name := filepath.Base(s.layer.Annotations[titleAnnotation])
+	if name == "." || name == string(filepath.Separator) {
+		name = s.layer.Digest.Encoded()
+	}
+	blob, err := define.NewMachineFile(filepath.Join(tmpDir, s.artifactDigest.Encoded()+"-"+name), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		if err := blob.Delete(); err != nil {
+			logrus.Warnf("removing copied image: %v", err)
+		}
+	}
+	f, err := os.Create(blob.GetPath())
+	if err != nil {
+		return nil, nil, err
+	}
+	verifier := s.layer.Digest.Verifier()
+	_, err = io.Copy(io.MultiWriter(f, verifier), r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !verifier.Verified() {
+		err = fmt.Errorf("%w: disk image layer does not match digest %s", ErrVerification, s.layer.Digest)
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return blob, cleanup, nil
+}
@@ -0,0 +1,28 @@
+package imagecache
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// createOverlay creates a qcow2 image at path using base as its backing
+// file. The overlay has the virtual size of base, it is resized along with
+// the machine disk.
+func createOverlay(base, path string) error {
+	format, err := DetectDiskFormat(base)
+	if err != nil {
+		return err
+	}
+	bin, err := qemuImg()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(bin, "create", "-q", "-f", "qcow2", "-b", base, "-F", string(format), path)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("creating overlay of %s: %w", base, err)
+	}
+	return nil
+}
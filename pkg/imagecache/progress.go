@@ -0,0 +1,79 @@
+package imagecache
+
+import (
+	"io"
+	"time"
+)
+
+const (
+	// DefaultRetries is the number of times a failed download is retried
+	DefaultRetries = 3
+	// DefaultRetryDelay is the delay before the first retry of a failed
+	// download, it doubles after each attempt
+	DefaultRetryDelay = 2 * time.Second
+	// maxRetryDelay caps the delay between download attempts
+	maxRetryDelay = time.Minute
+	// progressInterval is the minimum interval between two progress reports
+	progressInterval = 200 * time.Millisecond
+)
+
+// Progress is a progress report of an image download
+type Progress struct {
+	// Image is the URL of the image being downloaded
+	Image string
+	// Attempt is the download attempt the report is about, starting at 1
+	Attempt int
+	// Completed is the number of bytes downloaded so far, including the
+	// ones resumed from an earlier attempt
+	Completed int64
+	// Total is the size of the image, it is -1 when unknown
+	Total int64
+	// Done is set on the last report of an attempt
+	Done bool
+	// Err is the reason the attempt failed, if it did
+	Err error
+}
+
+// ProgressFunc is called as image downloads progress
+type ProgressFunc func(Progress)
+
+// progressReader reports the progress of the reads of an image download
+type progressReader struct {
+	io.Reader
+	progress   Progress
+	report     ProgressFunc
+	lastReport time.Time
+}
+
+func newProgressReader(r io.Reader, progress Progress, report ProgressFunc) *progressReader {
+	pr := &progressReader{
+		Reader:   r,
+		progress: progress,
+		report:   report,
+	}
+	pr.send()
+	return pr
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.Reader.Read(p)
+	pr.progress.Completed += int64(n)
+	if time.Since(pr.lastReport) >= progressInterval {
+		pr.send()
+	}
+	return n, err
+}
+
+// done sends the last report of the download attempt
+func (pr *progressReader) done(err error) {
+	pr.progress.Done = true
+	pr.progress.Err = err
+	pr.send()
+}
+
+func (pr *progressReader) send() {
+	pr.lastReport = time.Now()
+	if pr.report != nil {
+		pr.report(pr.progress)
+	}
+}
@@ -0,0 +1,256 @@
+package imagecache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	_ "crypto/sha256" // register the digest algorithms images can be verified with
+	_ "crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/opencontainers/go-digest"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrVerification is returned when a disk image does not match its expected
+// digest or when the checksums listing it cannot be trusted
+var ErrVerification = errors.New("image verification failed")
+
+// Verification describes how HTTP and local images are checked before they
+// are decompressed. OCI images are always verified by their digest.
+type Verification struct {
+	// Digest is the expected digest of the image as fetched, i.e. before
+	// decompression, in the sha256:<hex> or sha512:<hex> form
+	Digest string
+	// Checksums is the URL or path of a SHA256SUMS/SHA512SUMS style file
+	// listing the digest of the image by file name. Both the GNU coreutils
+	// and the BSD formats are supported.
+	Checksums string
+	// Signature is the URL or path of a detached signature of the
+	// checksums file. It is not needed for clearsigned checksums files.
+	Signature string
+	// PublicKey is the path of the key the checksums file is signed with,
+	// either a GPG public keyring, armored or not, or a PEM encoded public
+	// key for sigstore signatures (cosign sign-blob). Unsigned checksums
+	// files are rejected when it is set.
+	PublicKey string
+}
+
+// IsSet reports whether any verification was requested
+func (v *Verification) IsSet() bool {
+	return v.Digest != "" || v.Checksums != ""
+}
+
+// Validate checks the verification options are consistent
+func (v *Verification) Validate() error {
+	switch {
+	case v.Digest != "" && v.Checksums != "":
+		return errors.New("an image digest and a checksums file cannot both be used")
+	case v.Checksums == "" && (v.Signature != "" || v.PublicKey != ""):
+		return errors.New("a signature or public key requires a checksums file")
+	case v.Signature != "" && v.PublicKey == "":
+		return errors.New("a public key is needed to verify the checksums signature")
+	}
+	if v.Digest != "" {
+		if _, err := parseDigest(v.Digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseDigest(input string) (digest.Digest, error) {
+	d, err := digest.Parse(input)
+	if err != nil {
+		return "", fmt.Errorf("invalid image digest %q: %w", input, err)
+	}
+	if d.Algorithm() != digest.SHA256 && d.Algorithm() != digest.SHA512 {
+		return "", fmt.Errorf("invalid image digest %q: only sha256 and sha512 are supported", input)
+	}
+	return d, nil
+}
+
+// expectedDigest returns the digest the image named fileName must have,
+// reading and authenticating the checksums file when needed
+func (v *Verification) expectedDigest(fileName string) (digest.Digest, error) {
+	if v.Digest != "" {
+		return parseDigest(v.Digest)
+	}
+
+	sums, err := readURLOrFile(v.Checksums)
+	if err != nil {
+		return "", fmt.Errorf("reading checksums: %w", err)
+	}
+	if sums, err = v.authenticate(sums); err != nil {
+		return "", err
+	}
+	return findChecksum(sums, fileName)
+}
+
+// authenticate verifies the signature of the checksums file and returns its
+// signed content. Once a public key is given, the checksums must be
+// clearsigned or come with a detached signature.
+func (v *Verification) authenticate(sums []byte) ([]byte, error) {
+	block, _ := clearsign.Decode(sums)
+	switch {
+	case block != nil && v.PublicKey == "":
+		return nil, fmt.Errorf("%w: checksums file %s is signed but no public key was provided to verify it", ErrVerification, v.Checksums)
+	case block != nil:
+		keyring, err := readGPGKeyring(v.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body, nil); err != nil {
+			return nil, fmt.Errorf("%w: checksums signature: %v", ErrVerification, err)
+		}
+		return block.Plaintext, nil
+	case v.Signature == "" && v.PublicKey != "":
+		return nil, fmt.Errorf("%w: checksums file %s is not signed and no signature was provided", ErrVerification, v.Checksums)
+	case v.Signature == "":
+		return sums, nil
+	}
+
+	sig, err := readURLOrFile(v.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("reading checksums signature: %w", err)
+	}
+	key, err := os.ReadFile(v.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(key, []byte("-----BEGIN PUBLIC KEY-----")) {
+		err = verifySigstore(key, sig, sums)
+	} else {
+		err = verifyGPG(v.PublicKey, sig, sums)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: checksums signature: %v", ErrVerification, err)
+	}
+	return sums, nil
+}
+
+func readGPGKeyring(path string) (openpgp.EntityList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	if head, _ := br.Peek(10); bytes.HasPrefix(head, []byte("-----BEGIN")) {
+		return openpgp.ReadArmoredKeyRing(br)
+	}
+	return openpgp.ReadKeyRing(br)
+}
+
+func verifyGPG(keyPath string, sig, signed []byte) error {
+	keyring, err := readGPGKeyring(keyPath)
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(signed), bytes.NewReader(sig), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(signed), bytes.NewReader(sig), nil)
+	}
+	return err
+}
+
+// verifySigstore checks a signature made with cosign sign-blob, which is
+// base64 encoded
+func verifySigstore(key, sig, signed []byte) error {
+	pub, err := cryptoutils.UnmarshalPEMToPublicKey(key)
+	if err != nil {
+		return err
+	}
+	verifier, err := signature.LoadVerifier(pub, crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig))); err == nil {
+		sig = decoded
+	}
+	return verifier.VerifySignature(bytes.NewReader(sig), bytes.NewReader(signed))
+}
+
+var (
+	// gnuChecksum matches the sha256sum/sha512sum output, "<hex>  <name>",
+	// with a '*' before the name in binary mode
+	gnuChecksum = regexp.MustCompile(`^([0-9a-fA-F]+) [ *](.+)$`)
+	// bsdChecksum matches the BSD tagged output, "SHA256 (<name>) = <hex>"
+	bsdChecksum = regexp.MustCompile(`^(SHA256|SHA512) \((.+)\) = ([0-9a-fA-F]+)$`)
+)
+
+// findChecksum returns the digest of fileName in a checksums file
+func findChecksum(sums []byte, fileName string) (digest.Digest, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var name, hex string
+		if m := gnuChecksum.FindStringSubmatch(line); m != nil {
+			hex, name = m[1], m[2]
+		} else if m := bsdChecksum.FindStringSubmatch(line); m != nil {
+			name, hex = m[2], m[3]
+		}
+		if name != fileName {
+			continue
+		}
+		algorithm := digest.SHA256
+		if len(hex) == digest.SHA512.Size()*2 {
+			algorithm = digest.SHA512
+		}
+		return parseDigest(string(algorithm) + ":" + strings.ToLower(hex))
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("%w: no checksum for %s", ErrVerification, fileName)
+}
+
+// verifyFile checks the file at path has the expected digest
+func verifyFile(path string, expected digest.Digest) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	verifier := expected.Verifier()
+	if _, err := io.Copy(verifier, f); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("%w: %s does not match digest %s", ErrVerification, path, expected)
+	}
+	return nil
+}
+
+func readURLOrFile(location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		return os.ReadFile(location)
+	}
+	resp, err := httpClient.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logrus.Error(err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %s: %s", location, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,230 @@
+package imagecache
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/opencontainers/go-digest"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+)
+
+const (
+	sha256Hex = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	sha512Hex = "ee26b0dd4af7e749aa1a8ee3c10ae9923f618980772e473f8819a5d4940e0db27ac185f8a0e1d5f84f88bc887fd67b143732c304cc5fa9ad8e6f57f50028a8ff"
+)
+
+func TestFindChecksum(t *testing.T) {
+	sums := "# comment\n" +
+		sha256Hex + "  disk.qcow2.xz\n" +
+		strings.ToUpper(sha256Hex) + " *binary.raw\n" +
+		"SHA512 (bsd.img) = " + sha512Hex + "\n" +
+		sha256Hex + "  name with spaces.img\n"
+
+	tests := []struct {
+		name     string
+		fileName string
+		want     digest.Digest
+		wantErr  bool
+	}{
+		{name: "gnu", fileName: "disk.qcow2.xz", want: "sha256:" + sha256Hex},
+		{name: "gnu binary mode", fileName: "binary.raw", want: "sha256:" + sha256Hex},
+		{name: "bsd sha512", fileName: "bsd.img", want: "sha512:" + sha512Hex},
+		{name: "spaces", fileName: "name with spaces.img", want: "sha256:" + sha256Hex},
+		{name: "missing", fileName: "other.img", wantErr: true},
+		{name: "prefix only", fileName: "disk.qcow2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := findChecksum([]byte(sums), tt.fileName)
+			if tt.wantErr {
+				if !errors.Is(err, ErrVerification) {
+					t.Fatalf("got %v, want ErrVerification", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       Verification
+		wantErr bool
+	}{
+		{name: "none", v: Verification{}},
+		{name: "sha256 digest", v: Verification{Digest: "sha256:" + sha256Hex}},
+		{name: "sha512 digest", v: Verification{Digest: "sha512:" + sha512Hex}},
+		{name: "checksums", v: Verification{Checksums: "SHA256SUMS"}},
+		{name: "signed checksums", v: Verification{Checksums: "SHA256SUMS", Signature: "SHA256SUMS.sig", PublicKey: "key"}},
+		{name: "digest and checksums", v: Verification{Digest: "sha256:" + sha256Hex, Checksums: "SHA256SUMS"}, wantErr: true},
+		{name: "key without checksums", v: Verification{PublicKey: "key"}, wantErr: true},
+		{name: "signature without key", v: Verification{Checksums: "SHA256SUMS", Signature: "SHA256SUMS.sig"}, wantErr: true},
+		{name: "md5 digest", v: Verification{Digest: "md5:d41d8cd98f00b204e9800998ecf8427e"}, wantErr: true},
+		{name: "malformed digest", v: Verification{Digest: "sha256:xyz"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.v.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// signingFixtures are the keys and signatures authenticate is tested with
+type signingFixtures struct {
+	sums         []byte
+	clearsigned  []byte
+	otherSigned  []byte
+	gpgKey       string
+	gpgSignature string
+	sigstoreKey  string
+	sigstoreSig  string
+	badSignature string
+}
+
+func writeTestFile(t *testing.T, dir, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newGPGEntity(t *testing.T) *openpgp.Entity {
+	t.Helper()
+	entity, err := openpgp.NewEntity("macadam", "", "macadam@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entity
+}
+
+func clearsignWith(t *testing.T, entity *openpgp.Entity, content []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := clearsign.Encode(&buf, entity.PrivateKey, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newSigningFixtures(t *testing.T) *signingFixtures {
+	t.Helper()
+	dir := t.TempDir()
+	f := &signingFixtures{sums: []byte(sha256Hex + "  disk.raw\n")}
+
+	entity := newGPGEntity(t)
+	var key bytes.Buffer
+	w, err := armor.Encode(&key, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.gpgKey = writeTestFile(t, dir, "key.asc", key.Bytes())
+
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, entity, bytes.NewReader(f.sums), nil); err != nil {
+		t.Fatal(err)
+	}
+	f.gpgSignature = writeTestFile(t, dir, "SHA256SUMS.asc", sig.Bytes())
+	f.clearsigned = clearsignWith(t, entity, f.sums)
+	f.otherSigned = clearsignWith(t, newGPGEntity(t), f.sums)
+
+	sig.Reset()
+	if err := openpgp.ArmoredDetachSign(&sig, entity, strings.NewReader("something else"), nil); err != nil {
+		t.Fatal(err)
+	}
+	f.badSignature = writeTestFile(t, dir, "bad.asc", sig.Bytes())
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pem, err := cryptoutils.MarshalPublicKeyToPEM(priv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.sigstoreKey = writeTestFile(t, dir, "cosign.pub", pem)
+	sum := sha256.Sum256(f.sums)
+	raw, err := ecdsa.SignASN1(rand.Reader, priv, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.sigstoreSig = writeTestFile(t, dir, "SHA256SUMS.sig", []byte(base64.StdEncoding.EncodeToString(raw)))
+	return f
+}
+
+func TestAuthenticate(t *testing.T) {
+	f := newSigningFixtures(t)
+
+	tests := []struct {
+		name      string
+		sums      []byte
+		signature string
+		publicKey string
+		wantErr   bool
+	}{
+		{name: "unsigned without key", sums: f.sums},
+		{name: "unsigned with key", sums: f.sums, publicKey: f.gpgKey, wantErr: true},
+		{name: "unsigned with sigstore key", sums: f.sums, publicKey: f.sigstoreKey, wantErr: true},
+		{name: "clearsigned", sums: f.clearsigned, publicKey: f.gpgKey},
+		{name: "clearsigned without key", sums: f.clearsigned, wantErr: true},
+		{name: "clearsigned by another key", sums: f.otherSigned, publicKey: f.gpgKey, wantErr: true},
+		{name: "gpg detached signature", sums: f.sums, signature: f.gpgSignature, publicKey: f.gpgKey},
+		{name: "gpg signature of other content", sums: f.sums, signature: f.badSignature, publicKey: f.gpgKey, wantErr: true},
+		{name: "sigstore signature", sums: f.sums, signature: f.sigstoreSig, publicKey: f.sigstoreKey},
+		{name: "sigstore signature of tampered checksums", sums: append([]byte("x"), f.sums...), signature: f.sigstoreSig, publicKey: f.sigstoreKey, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := Verification{Checksums: "SHA256SUMS", Signature: tt.signature, PublicKey: tt.publicKey}
+			got, err := v.authenticate(tt.sums)
+			if tt.wantErr {
+				if !errors.Is(err, ErrVerification) {
+					t.Fatalf("got %v, want ErrVerification", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(bytes.TrimSpace(got), bytes.TrimSpace(f.sums)) {
+				t.Errorf("got checksums %q, want %q", got, f.sums)
+			}
+		})
+	}
+}
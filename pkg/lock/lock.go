@@ -0,0 +1,59 @@
+package lock
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/containers/storage/pkg/lockfile"
+	"github.com/crc-org/macadam/pkg/env"
+)
+
+func GetMachineLock(name string, machineConfigDir string) (*lockfile.LockFile, error) {
+	lockPath := filepath.Join(machineConfigDir, name+".lock")
+	lock, err := lockfile.GetLockFile(lockPath)
+	if err != nil {
+		return nil, fmt.Errorf("creating lockfile for VM: %w", err)
+	}
+	return lock, nil
+}
+
+const machineStartLockName = "machine-start.lock"
+
+// GetMachineStartLock is a lock only used to prevent starting different machines at the same time,
+// This is required as most provides support at max 1 running VM and to check this race free we
+// cannot allows starting two machine.
+func GetMachineStartLock() (*lockfile.LockFile, error) {
+	lockDir, err := env.GetGlobalDataDir()
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := lockfile.GetLockFile(filepath.Join(lockDir, machineStartLockName))
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+const imageCacheLockName = "cache.lock"
+
+// GetImageCacheLock returns the lock of the image cache in cacheDir. It is
+// held shared while images are added to the cache and exclusively while
+// the cache is cleaned up.
+func GetImageCacheLock(cacheDir string) (*lockfile.LockFile, error) {
+	lock, err := lockfile.GetLockFile(filepath.Join(cacheDir, imageCacheLockName))
+	if err != nil {
+		return nil, fmt.Errorf("creating lockfile for image cache: %w", err)
+	}
+	return lock, nil
+}
+
+// GetImageCacheEntryLock returns the lock serializing the fetch of the
+// image cache entry with the given key
+func GetImageCacheEntryLock(lockDir string, key string) (*lockfile.LockFile, error) {
+	lock, err := lockfile.GetLockFile(filepath.Join(lockDir, key+".lock"))
+	if err != nil {
+		return nil, fmt.Errorf("creating lockfile for cached image: %w", err)
+	}
+	return lock, nil
+}
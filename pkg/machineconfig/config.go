@@ -0,0 +1,419 @@
+package machineconfig
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containers/podman/v5/pkg/machine/connection"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/sirupsen/logrus"
+)
+
+// configFileExtension is the extension of the macadam configuration file of a
+// machine. It must not be ".json" as vmconfigs.LoadMachinesInDir would then
+// try to load it as a podman machine configuration.
+const configFileExtension = ".macadam"
+
+// Provisioner is the mechanism used to configure the guest on its first boot
+type Provisioner string
+
+const (
+	// IgnitionProvisioner passes an ignition config to the guest, this
+	// requires a Fedora CoreOS based image
+	IgnitionProvisioner Provisioner = "ignition"
+	// CloudInitProvisioner attaches a NoCloud seed ISO to the guest, this
+	// works with most distributions' cloud images
+	CloudInitProvisioner Provisioner = "cloud-init"
+)
+
+// Paused is the state of machines whose guest is paused, podman's define
+// package has no such status
+const Paused define.Status = "paused"
+
+// ParseProvisioner converts a user provided string to a Provisioner
+func ParseProvisioner(input string) (Provisioner, error) {
+	switch p := Provisioner(input); p {
+	case IgnitionProvisioner, CloudInitProvisioner:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown provisioner %q, must be %q or %q", input, IgnitionProvisioner, CloudInitProvisioner)
+}
+
+// MachineConfig holds the macadam specific configuration of a machine. It
+// complements podman's vmconfigs.MachineConfig, which cannot be extended, and
+// is stored next to it in the machine configuration directory.
+type MachineConfig struct {
+	// Provisioner is used to configure the guest on first boot
+	Provisioner Provisioner
+	// Image is the image the machine was created from, as given on creation
+	Image string `json:",omitempty"`
+	// CachedImage is the key of the image cache entry the disk of the
+	// machine was created from, if any
+	CachedImage string `json:",omitempty"`
+	// ImageFormat is the format of the image the machine was created from,
+	// before it was converted to the disk format of the provider
+	ImageFormat string `json:",omitempty"`
+	// IgnitionPath is the user provided ignition file, if any
+	IgnitionPath string `json:",omitempty"`
+	// TimeZone is the time zone the guest was configured with on creation
+	TimeZone string `json:",omitempty"`
+	// CloudInitISO is the NoCloud seed ISO attached to cloud-init machines
+	CloudInitISO *define.VMFile `json:",omitempty"`
+	// Connection is how the machine is reached over SSH
+	Connection Connection
+	// PodmanConnections are the podman system connections registered for
+	// the machine, if any
+	PodmanConnections []string `json:",omitempty"`
+	// Snapshots are the internal snapshots of the machine disk, oldest
+	// first
+	Snapshots []Snapshot `json:",omitempty"`
+	// DataDisks are the disks attached to the machine besides its boot
+	// disk
+	DataDisks []DataDisk `json:",omitempty"`
+	// PortForwards are the host ports forwarded to the guest besides the
+	// SSH port
+	PortForwards []PortForward `json:",omitempty"`
+	// SocketForwards are the guest unix sockets forwarded to the host
+	// besides the podman API socket
+	SocketForwards []SocketForward `json:",omitempty"`
+	// SavedState is the state of the suspended machine, if any
+	SavedState *SavedState `json:",omitempty"`
+
+	// configPath can be used for reading, writing, removing
+	configPath *define.VMFile
+}
+
+// Connection describes how to reach a machine over SSH
+type Connection struct {
+	// URI is the SSH URI of the machine, ssh://user@127.0.0.1:port
+	URI string
+	// IdentityPath is the private key used to authenticate
+	IdentityPath string
+	// Port is the host port forwarded to the SSH server of the guest
+	Port int
+}
+
+// SavedState is the memory and device state of a suspended machine. It is
+// only valid as long as the disks of the machine are unchanged.
+type SavedState struct {
+	// Path is the file the state was saved to
+	Path    string
+	Created time.Time
+}
+
+// Snapshot is an internal snapshot of the disk of a machine
+type Snapshot struct {
+	Name    string
+	Created time.Time
+	// DiskSize is the virtual size of the disk in bytes when the snapshot
+	// was taken, the disk is resized back to it on restore
+	DiskSize int64
+	// VMStateSize is the size in bytes of the memory and device state saved
+	// along with the disk, it is zero for snapshots of stopped machines
+	VMStateSize int64
+}
+
+// Snapshot returns the snapshot with the given name, or nil
+func (c *MachineConfig) Snapshot(name string) *Snapshot {
+	for i := range c.Snapshots {
+		if c.Snapshots[i].Name == name {
+			return &c.Snapshots[i]
+		}
+	}
+	return nil
+}
+
+// RemoveSnapshot removes the snapshot with the given name from the
+// configuration
+func (c *MachineConfig) RemoveSnapshot(name string) {
+	c.Snapshots = slices.DeleteFunc(c.Snapshots, func(s Snapshot) bool {
+		return s.Name == name
+	})
+}
+
+// DataDisk is a disk attached to a machine besides its boot disk
+type DataDisk struct {
+	Name string
+	// Serial is the serial number of the disk, the guest lists it as
+	// /dev/disk/by-id/virtio-<serial>
+	Serial string
+	Path   string
+	// Format is the qemu-img name of the disk format
+	Format string
+	// Size is the virtual size of the disk in bytes
+	Size int64
+	// Owned is set for the disks created by macadam, which are deleted
+	// along with them. Existing image files are attached in place and left
+	// on removal.
+	Owned bool
+}
+
+// DataDisk returns the data disk with the given name, or nil
+func (c *MachineConfig) DataDisk(name string) *DataDisk {
+	for i := range c.DataDisks {
+		if c.DataDisks[i].Name == name {
+			return &c.DataDisks[i]
+		}
+	}
+	return nil
+}
+
+// RemoveDataDisk removes the data disk with the given name from the
+// configuration
+func (c *MachineConfig) RemoveDataDisk(name string) {
+	c.DataDisks = slices.DeleteFunc(c.DataDisks, func(d DataDisk) bool {
+		return d.Name == name
+	})
+}
+
+// PortForward forwards a host port to a guest port
+type PortForward struct {
+	HostPort  int
+	GuestPort int
+	// Protocol is tcp or udp
+	Protocol string
+}
+
+// ParsePortForward converts a user provided host[:guest][/tcp|udp] string to
+// a PortForward, the guest port defaults to the host port and the protocol
+// to tcp
+func ParsePortForward(input string) (PortForward, error) {
+	fwd := PortForward{Protocol: "tcp"}
+	spec, protocol, ok := strings.Cut(input, "/")
+	if ok {
+		if protocol != "tcp" && protocol != "udp" {
+			return fwd, fmt.Errorf("invalid port forward %q: protocol must be tcp or udp", input)
+		}
+		fwd.Protocol = protocol
+	}
+	host, guest, ok := strings.Cut(spec, ":")
+	if !ok {
+		guest = host
+	}
+	var err error
+	if fwd.HostPort, err = parsePort(host); err != nil {
+		return fwd, fmt.Errorf("invalid port forward %q: %w", input, err)
+	}
+	if fwd.GuestPort, err = parsePort(guest); err != nil {
+		return fwd, fmt.Errorf("invalid port forward %q: %w", input, err)
+	}
+	return fwd, nil
+}
+
+func parsePort(input string) (int, error) {
+	port, err := strconv.Atoi(input)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", input)
+	}
+	return port, nil
+}
+
+func (f PortForward) String() string {
+	return fmt.Sprintf("%d:%d/%s", f.HostPort, f.GuestPort, f.Protocol)
+}
+
+// PortForward returns the forward of the host port with the given protocol,
+// or nil
+func (c *MachineConfig) PortForward(hostPort int, protocol string) *PortForward {
+	for i := range c.PortForwards {
+		if c.PortForwards[i].HostPort == hostPort && c.PortForwards[i].Protocol == protocol {
+			return &c.PortForwards[i]
+		}
+	}
+	return nil
+}
+
+// RemovePortForward removes the forward of the host port with the given
+// protocol from the configuration
+func (c *MachineConfig) RemovePortForward(hostPort int, protocol string) {
+	c.PortForwards = slices.DeleteFunc(c.PortForwards, func(f PortForward) bool {
+		return f.HostPort == hostPort && f.Protocol == protocol
+	})
+}
+
+// SocketForward forwards a guest unix socket to a host unix socket or TCP
+// address over SSH
+type SocketForward struct {
+	// Guest is the path of the socket in the guest
+	Guest string
+	// Host is the path of the host socket, or tcp://address:port
+	Host string
+	// User is the guest user the socket is reached as, the SSH user of the
+	// machine when empty
+	User string `json:",omitempty"`
+}
+
+// ParseSocketForward converts a user provided [USER@]GUEST_PATH:HOST string
+// to a SocketForward. HOST is a socket path, a port on the host loopback
+// address or tcp://address:port.
+func ParseSocketForward(input string) (SocketForward, error) {
+	var fwd SocketForward
+	spec := input
+	if user, rest, ok := strings.Cut(input, "@"); ok && !strings.HasPrefix(input, "/") {
+		if user == "" {
+			return fwd, fmt.Errorf("invalid socket forward %q: empty user", input)
+		}
+		fwd.User, spec = user, rest
+	}
+	guest, host, ok := strings.Cut(spec, ":")
+	if !ok || !path.IsAbs(guest) {
+		return fwd, fmt.Errorf("invalid socket forward %q: must be [USER@]GUEST_PATH:HOST with an absolute guest path", input)
+	}
+	fwd.Guest = guest
+	var err error
+	if fwd.Host, err = ParseSocketForwardHost(host); err != nil {
+		return fwd, fmt.Errorf("invalid socket forward %q: %w", input, err)
+	}
+	return fwd, nil
+}
+
+// ParseSocketForwardHost converts the host end of a socket forward, a socket
+// path, a port on the host loopback address or tcp://address:port, to the
+// form it is stored in
+func ParseSocketForwardHost(host string) (string, error) {
+	switch {
+	case strings.HasPrefix(host, "tcp://"):
+		_, port, err := net.SplitHostPort(strings.TrimPrefix(host, "tcp://"))
+		if err != nil {
+			return "", err
+		}
+		if _, err := parsePort(port); err != nil {
+			return "", err
+		}
+		return host, nil
+	case host != "" && strings.Trim(host, "0123456789") == "":
+		port, err := parsePort(host)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("tcp://127.0.0.1:%d", port), nil
+	case filepath.IsAbs(host):
+		return host, nil
+	}
+	return "", fmt.Errorf("host %q must be an absolute socket path, a port or tcp://address:port", host)
+}
+
+// TCPAddress returns the host address of TCP forwards, it is empty for
+// unix socket forwards
+func (f SocketForward) TCPAddress() string {
+	if addr, ok := strings.CutPrefix(f.Host, "tcp://"); ok {
+		return addr
+	}
+	return ""
+}
+
+func (f SocketForward) String() string {
+	if f.User != "" {
+		return fmt.Sprintf("%s@%s:%s", f.User, f.Guest, f.Host)
+	}
+	return f.Guest + ":" + f.Host
+}
+
+// SocketForward returns the forward to the given host socket or address, or
+// nil
+func (c *MachineConfig) SocketForward(host string) *SocketForward {
+	for i := range c.SocketForwards {
+		if c.SocketForwards[i].Host == host {
+			return &c.SocketForwards[i]
+		}
+	}
+	return nil
+}
+
+// RemoveSocketForward removes the forward to the given host socket or
+// address from the configuration
+func (c *MachineConfig) RemoveSocketForward(host string) {
+	c.SocketForwards = slices.DeleteFunc(c.SocketForwards, func(f SocketForward) bool {
+		return f.Host == host
+	})
+}
+
+func configFile(mc *vmconfigs.MachineConfig) (*define.VMFile, error) {
+	configDir, err := mc.ConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	return configDir.AppendToNewVMFile(mc.Name+configFileExtension, nil)
+}
+
+// New creates the macadam configuration of a newly created machine. It is
+// not written to disk until Write is called.
+func New(mc *vmconfigs.MachineConfig) (*MachineConfig, error) {
+	cf, err := configFile(mc)
+	if err != nil {
+		return nil, err
+	}
+	return &MachineConfig{
+		Provisioner: IgnitionProvisioner,
+		configPath:  cf,
+	}, nil
+}
+
+// Load reads the macadam configuration of an existing machine. Machines
+// which do not have one get the default configuration.
+func Load(mc *vmconfigs.MachineConfig) (*MachineConfig, error) {
+	macadamConfig, err := New(mc)
+	if err != nil {
+		return nil, err
+	}
+	b, err := macadamConfig.configPath.Read()
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			macadamConfig.UpdateConnection(mc)
+			return macadamConfig, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, macadamConfig); err != nil {
+		return nil, fmt.Errorf("unable to load macadam machine config file: %q", err)
+	}
+	return macadamConfig, nil
+}
+
+// UpdateConnection records the SSH settings of mc as the connection to the
+// machine
+func (c *MachineConfig) UpdateConnection(mc *vmconfigs.MachineConfig) {
+	uri := url.URL{
+		Scheme: "ssh",
+		User:   url.User(mc.SSH.RemoteUsername),
+		Host:   net.JoinHostPort(connection.LocalhostIP, strconv.Itoa(mc.SSH.Port)),
+	}
+	c.Connection = Connection{
+		URI:          uri.String(),
+		IdentityPath: mc.SSH.IdentityPath,
+		Port:         mc.SSH.Port,
+	}
+}
+
+// Write writes the configuration file to disk. As with the podman
+// configuration, the caller is expected to hold the machine lock.
+func (c *MachineConfig) Write() error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("writing macadam configuration file %q", c.configPath.GetPath())
+	return ioutils.AtomicWriteFile(c.configPath.GetPath(), b, define.DefaultFilePerm)
+}
+
+// Path returns the path of the configuration file
+func (c *MachineConfig) Path() string {
+	return c.configPath.GetPath()
+}
+
+// Remove deletes the configuration file
+func (c *MachineConfig) Remove() error {
+	return c.configPath.Delete()
+}
@@ -0,0 +1,123 @@
+package machineconfig
+
+import "testing"
+
+func TestParseSocketForward(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    SocketForward
+		wantErr bool
+	}{
+		{input: "/run/podman/podman.sock:/tmp/podman.sock", want: SocketForward{Guest: "/run/podman/podman.sock", Host: "/tmp/podman.sock"}},
+		{input: "root@/run/podman/podman.sock:/tmp/podman.sock", want: SocketForward{Guest: "/run/podman/podman.sock", Host: "/tmp/podman.sock", User: "root"}},
+		{input: "/run/docker.sock:2375", want: SocketForward{Guest: "/run/docker.sock", Host: "tcp://127.0.0.1:2375"}},
+		{input: "/run/docker.sock:tcp://0.0.0.0:2375", want: SocketForward{Guest: "/run/docker.sock", Host: "tcp://0.0.0.0:2375"}},
+		{input: "/run/user@1000.sock:/tmp/user.sock", want: SocketForward{Guest: "/run/user@1000.sock", Host: "/tmp/user.sock"}},
+		{input: "@/run/docker.sock:/tmp/docker.sock", wantErr: true},
+		{input: "/run/docker.sock", wantErr: true},
+		{input: "run/docker.sock:/tmp/docker.sock", wantErr: true},
+		{input: "/run/docker.sock:docker.sock", wantErr: true},
+		{input: "/run/docker.sock:", wantErr: true},
+		{input: "/run/docker.sock:0", wantErr: true},
+		{input: "/run/docker.sock:65536", wantErr: true},
+		{input: "/run/docker.sock:tcp://localhost", wantErr: true},
+		{input: "/run/docker.sock:tcp://localhost:http", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseSocketForward(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			// forwards are displayed the way they are given
+			if parsed, err := ParseSocketForward(got.String()); err != nil || parsed != got {
+				t.Errorf("%s does not parse back: %+v, %v", got, parsed, err)
+			}
+		})
+	}
+}
+
+func TestSocketForwardTCPAddress(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "tcp://127.0.0.1:2375", want: "127.0.0.1:2375"},
+		{host: "tcp://[::1]:2375", want: "[::1]:2375"},
+		{host: "/tmp/podman.sock", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := (SocketForward{Host: tt.host}).TCPAddress(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePortForward(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    PortForward
+		wantErr bool
+	}{
+		{input: "8080", want: PortForward{HostPort: 8080, GuestPort: 8080, Protocol: "tcp"}},
+		{input: "8080:80", want: PortForward{HostPort: 8080, GuestPort: 80, Protocol: "tcp"}},
+		{input: "5353:53/udp", want: PortForward{HostPort: 5353, GuestPort: 53, Protocol: "udp"}},
+		{input: "53/udp", want: PortForward{HostPort: 53, GuestPort: 53, Protocol: "udp"}},
+		{input: "8080/tcp", want: PortForward{HostPort: 8080, GuestPort: 8080, Protocol: "tcp"}},
+		{input: "65535:1", want: PortForward{HostPort: 65535, GuestPort: 1, Protocol: "tcp"}},
+		{input: "", wantErr: true},
+		{input: "http", wantErr: true},
+		{input: "0", wantErr: true},
+		{input: "65536", wantErr: true},
+		{input: "8080:", wantErr: true},
+		{input: ":80", wantErr: true},
+		{input: "8080:-80", wantErr: true},
+		{input: "8080/sctp", wantErr: true},
+		{input: "8080/", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParsePortForward(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if parsed, err := ParsePortForward(got.String()); err != nil || parsed != got {
+				t.Errorf("%s does not parse back: %+v, %v", got, parsed, err)
+			}
+		})
+	}
+}
+
+func TestRemovePortForward(t *testing.T) {
+	c := &MachineConfig{PortForwards: []PortForward{
+		{HostPort: 53, GuestPort: 53, Protocol: "tcp"},
+		{HostPort: 53, GuestPort: 53, Protocol: "udp"},
+	}}
+	c.RemovePortForward(53, "udp")
+	if c.PortForward(53, "udp") != nil {
+		t.Error("udp forward was not removed")
+	}
+	if c.PortForward(53, "tcp") == nil {
+		t.Error("tcp forward of the same port was removed")
+	}
+}
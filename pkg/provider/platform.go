@@ -0,0 +1,39 @@
+//go:build !windows && !darwin
+
+package provider
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/common/pkg/config"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/qemu"
+	"github.com/sirupsen/logrus"
+)
+
+// Get returns the macadam provider for the configured virtualization
+// provider
+func Get() (vmconfigs.VMProvider, error) {
+	cfg, err := config.Default()
+	if err != nil {
+		return nil, err
+	}
+	provider := cfg.Machine.Provider
+	if providerOverride, found := os.LookupEnv("CONTAINERS_MACHINE_PROVIDER"); found {
+		provider = providerOverride
+	}
+	resolvedVMType, err := define.ParseVMType(provider, define.QemuVirt)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Debugf("Using macadam machine with `%s` virtualization provider", resolvedVMType.String())
+	switch resolvedVMType {
+	case define.QemuVirt:
+		return new(qemu.QEMUStubber), nil
+	default:
+		return nil, fmt.Errorf("unsupported virtualization provider: `%s`", resolvedVMType.String())
+	}
+}
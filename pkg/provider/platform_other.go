@@ -0,0 +1,23 @@
+//go:build windows || darwin
+
+package provider
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/containers/podman/v5/pkg/machine/provider"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/env"
+)
+
+// Get returns the macadam provider for the configured virtualization
+// provider. podman's providers are used as-is on this platform, they keep
+// some of their files in podman's machine directories, so macadam's
+// machine state cannot be relocated.
+func Get() (vmconfigs.VMProvider, error) {
+	if env.Relocated() {
+		return nil, fmt.Errorf("relocating the machine state with --home or $%s is not supported on %s: its providers keep some of their files in podman's machine directories", env.HomeEnvVar, runtime.GOOS)
+	}
+	return provider.Get()
+}
@@ -0,0 +1,32 @@
+//go:build linux || freebsd
+
+package qemu
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containers/podman/v5/pkg/machine/qemu/command"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+)
+
+// setCDROM attaches a read-only CD-ROM drive backed by the ISO image at
+// isoPath. A virtio-scsi controller is used as IDE is not available on all
+// architectures.
+func setCDROM(q *command.QemuCmd, isoPath string) {
+	*q = append(*q,
+		"-device", "virtio-scsi-pci,id=scsi0",
+		"-drive", "if=none,id=cdrom0,media=cdrom,readonly=on,format=raw,file="+isoPath,
+		"-device", "scsi-cd,bus=scsi0.0,drive=cdrom0")
+}
+
+// setDataDisk attaches the data disk as a virtio block device carrying its
+// serial number, so that the guest can find it under /dev/disk/by-id
+func setDataDisk(q *command.QemuCmd, disk machineconfig.DataDisk) {
+	id := "data-" + disk.Name
+	// commas in option values are escaped by doubling them
+	path := strings.ReplaceAll(disk.Path, ",", ",,")
+	*q = append(*q,
+		"-drive", fmt.Sprintf("if=none,id=%s,format=%s,file=%s", id, disk.Format, path),
+		"-device", fmt.Sprintf("virtio-blk-pci,drive=%s,serial=%s", id, disk.Serial))
+}
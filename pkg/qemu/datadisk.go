@@ -0,0 +1,27 @@
+//go:build linux || freebsd
+
+package qemu
+
+import (
+	"fmt"
+
+	"github.com/containers/common/pkg/strongunits"
+)
+
+// CreateDataDisk creates an empty qcow2 data disk of the given size at path
+func (q *QEMUStubber) CreateDataDisk(path string, size strongunits.GiB) error {
+	if _, err := runQEMUImg("create", "-q", "-f", "qcow2", path, fmt.Sprintf("%dG", size)); err != nil {
+		return fmt.Errorf("creating data disk %s: %w", path, err)
+	}
+	return nil
+}
+
+// DataDiskInfo returns the format and the virtual size in bytes of the disk
+// image at path
+func (q *QEMUStubber) DataDiskInfo(path string) (string, int64, error) {
+	info, err := imageInfo(path)
+	if err != nil {
+		return "", 0, err
+	}
+	return info.Format, info.VirtualSize, nil
+}
@@ -0,0 +1,8 @@
+//go:build freebsd && amd64
+
+package qemu
+
+func addArchOptions() []string {
+	opts := []string{"-machine", "q35,accel=hvf:tcg", "-cpu", "host"}
+	return opts
+}
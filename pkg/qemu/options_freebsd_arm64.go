@@ -0,0 +1,11 @@
+//go:build freebsd && arm64
+
+package qemu
+
+func addArchOptions() []string {
+	opts := []string{
+		"-machine", "virt",
+		"-accel", "tcg",
+		"-cpu", "host"}
+	return opts
+}
@@ -0,0 +1,11 @@
+//go:build linux && amd64
+
+package qemu
+
+func addArchOptions() []string {
+	opts := []string{
+		"-accel", "kvm",
+		"-cpu", "host",
+	}
+	return opts
+}
@@ -0,0 +1,32 @@
+//go:build linux && arm64
+
+package qemu
+
+import (
+	"path/filepath"
+
+	"github.com/containers/storage/pkg/fileutils"
+)
+
+func addArchOptions() []string {
+	opts := []string{
+		"-accel", "kvm",
+		"-cpu", "host",
+		"-M", "virt,gic-version=max",
+		"-bios", getQemuUefiFile("QEMU_EFI.fd"),
+	}
+	return opts
+}
+
+func getQemuUefiFile(name string) string {
+	dirs := []string{
+		"/usr/share/qemu-efi-aarch64",
+		"/usr/share/edk2/aarch64",
+	}
+	for _, dir := range dirs {
+		if err := fileutils.Exists(dir); err == nil {
+			return filepath.Join(dir, name)
+		}
+	}
+	return name
+}
@@ -0,0 +1,45 @@
+//go:build linux || freebsd
+
+package qemu
+
+import (
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/containers/storage/pkg/fileutils"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/sirupsen/logrus"
+)
+
+// State is podman's State, which reports every machine which is not running
+// as stopped, with support for paused machines
+func (q *QEMUStubber) State(mc *vmconfigs.MachineConfig, bypass bool) (define.Status, error) {
+	state, err := q.QEMUStubber.State(mc, bypass)
+	if err != nil || state != define.Stopped {
+		return state, err
+	}
+	if err := fileutils.Exists(mc.QEMUHypervisor.QMPMonitor.Address.GetPath()); err != nil {
+		return state, nil
+	}
+	status, err := queryStatus(mc)
+	if err != nil {
+		// the stale monitor socket of a machine which was not cleaned up
+		logrus.Debugf("querying status of machine %q: %v", mc.Name, err)
+		return state, nil
+	}
+	if status == "paused" {
+		return machineconfig.Paused, nil
+	}
+	return state, nil
+}
+
+// PauseVM stops the vCPUs of the running machine
+func (q *QEMUStubber) PauseVM(mc *vmconfigs.MachineConfig) error {
+	_, err := runQMP(mc, "stop", nil)
+	return err
+}
+
+// ResumeVM restarts the vCPUs of the paused machine
+func (q *QEMUStubber) ResumeVM(mc *vmconfigs.MachineConfig) error {
+	_, err := runQMP(mc, "cont", nil)
+	return err
+}
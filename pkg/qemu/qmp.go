@@ -0,0 +1,71 @@
+//go:build linux || freebsd
+
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/digitalocean/go-qemu/qmp"
+	"github.com/sirupsen/logrus"
+)
+
+// qmpCommand is a QMP command, see the QEMU QMP reference
+type qmpCommand struct {
+	Execute   string `json:"execute"`
+	Arguments any    `json:"arguments,omitempty"`
+}
+
+// runQMP runs a command on the QMP monitor of the running machine and
+// returns the content of its return value
+func runQMP(mc *vmconfigs.MachineConfig, execute string, arguments any) (json.RawMessage, error) {
+	input, err := json.Marshal(qmpCommand{Execute: execute, Arguments: arguments})
+	if err != nil {
+		return nil, err
+	}
+	monitor, err := qmp.NewSocketMonitor(mc.QEMUHypervisor.QMPMonitor.Network, mc.QEMUHypervisor.QMPMonitor.Address.GetPath(), mc.QEMUHypervisor.QMPMonitor.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := monitor.Connect(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := monitor.Disconnect(); err != nil {
+			logrus.Error(err)
+		}
+	}()
+
+	logrus.Debugf("running QMP command %s", input)
+	output, err := monitor.Run(input)
+	if err != nil {
+		return nil, fmt.Errorf("QMP command %s: %w", execute, err)
+	}
+	var response struct {
+		Return json.RawMessage `json:"return"`
+	}
+	if err := json.Unmarshal(output, &response); err != nil {
+		return nil, fmt.Errorf("QMP command %s: %w", execute, err)
+	}
+	return response.Return, nil
+}
+
+// runHMP runs a human monitor command through QMP, for the operations QMP
+// has no stable command for. HMP reports errors as output, commands which
+// succeed print nothing.
+func runHMP(mc *vmconfigs.MachineConfig, commandLine string) error {
+	ret, err := runQMP(mc, "human-monitor-command", map[string]string{"command-line": commandLine})
+	if err != nil {
+		return err
+	}
+	var output string
+	if err := json.Unmarshal(ret, &output); err != nil {
+		return err
+	}
+	if output = strings.TrimSpace(output); output != "" {
+		return fmt.Errorf("%s: %s", commandLine, output)
+	}
+	return nil
+}
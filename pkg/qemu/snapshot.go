@@ -0,0 +1,226 @@
+//go:build linux || freebsd
+
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/containers/common/pkg/config"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/sirupsen/logrus"
+)
+
+// qemuImgInfo is the part of the `qemu-img info --output=json` output
+// snapshots and data disks need
+type qemuImgInfo struct {
+	Format      string `json:"format"`
+	VirtualSize int64  `json:"virtual-size"`
+	Snapshots   []struct {
+		Name        string `json:"name"`
+		VMStateSize int64  `json:"vm-state-size"`
+		DateSec     int64  `json:"date-sec"`
+	} `json:"snapshots"`
+}
+
+// runQEMUImg runs qemu-img with the given arguments and returns its output
+func runQEMUImg(args ...string) ([]byte, error) {
+	cfg, err := config.Default()
+	if err != nil {
+		return nil, err
+	}
+	qemuImg, err := cfg.FindHelperBinary("qemu-img", true)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debugf("running %s %v", qemuImg, args)
+	cmd := exec.Command(qemuImg, args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("qemu-img %s: %w", args[0], err)
+	}
+	return out, nil
+}
+
+// diskInfo reads the information of the disk of the machine, the disk is
+// not locked so that it can be read while the machine is running
+func diskInfo(mc *vmconfigs.MachineConfig) (*qemuImgInfo, error) {
+	return imageInfo(mc.ImagePath.GetPath())
+}
+
+// imageInfo reads the information of the disk image at path
+func imageInfo(path string) (*qemuImgInfo, error) {
+	out, err := runQEMUImg("info", "--force-share", "--output=json", path)
+	if err != nil {
+		return nil, err
+	}
+	info := new(qemuImgInfo)
+	if err := json.Unmarshal(out, info); err != nil {
+		return nil, fmt.Errorf("parsing qemu-img info output: %w", err)
+	}
+	return info, nil
+}
+
+// snapshotDisks returns the disk images of the machine the savevm, loadvm and
+// delvm monitor commands operate on: the boot disk and the qcow2 data disks
+func snapshotDisks(mc *vmconfigs.MachineConfig) ([]string, error) {
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return nil, err
+	}
+	disks := []string{mc.ImagePath.GetPath()}
+	for _, disk := range macadamConfig.DataDisks {
+		if disk.Format == "qcow2" {
+			disks = append(disks, disk.Path)
+		}
+	}
+	return disks, nil
+}
+
+// hasSnapshot returns whether the disk image at path has the internal
+// snapshot name
+func hasSnapshot(path, name string) (bool, error) {
+	info, err := imageInfo(path)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range info.Snapshots {
+		if s.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// createOfflineSnapshot takes the internal snapshot name of every disk of the
+// stopped machine, the snapshots already taken are deleted when one fails
+func createOfflineSnapshot(mc *vmconfigs.MachineConfig, name string) error {
+	disks, err := snapshotDisks(mc)
+	if err != nil {
+		return err
+	}
+	for i, disk := range disks {
+		if _, err := runQEMUImg("snapshot", "-c", name, disk); err != nil {
+			for _, done := range disks[:i] {
+				if _, err := runQEMUImg("snapshot", "-d", name, done); err != nil {
+					logrus.Error(err)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreOfflineSnapshot reverts every disk of the stopped machine to the
+// internal snapshot name. Like loadvm, it fails without changing any disk
+// when one of them does not have the snapshot.
+func restoreOfflineSnapshot(mc *vmconfigs.MachineConfig, name string) error {
+	disks, err := snapshotDisks(mc)
+	if err != nil {
+		return err
+	}
+	for _, disk := range disks {
+		found, err := hasSnapshot(disk, name)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("disk %s has no snapshot %q, it was attached after the snapshot was taken", disk, name)
+		}
+	}
+	for _, disk := range disks {
+		if _, err := runQEMUImg("snapshot", "-a", name, disk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteOfflineSnapshot deletes the internal snapshot name of the disks of
+// the stopped machine which have it
+func deleteOfflineSnapshot(mc *vmconfigs.MachineConfig, name string) error {
+	disks, err := snapshotDisks(mc)
+	if err != nil {
+		return err
+	}
+	for _, disk := range disks {
+		found, err := hasSnapshot(disk, name)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		if _, err := runQEMUImg("snapshot", "-d", name, disk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateSnapshot takes an internal snapshot of the boot disk and the qcow2
+// data disks of the machine. The memory and device state of running machines
+// is saved along with the disks using the savevm monitor command.
+func (q *QEMUStubber) CreateSnapshot(mc *vmconfigs.MachineConfig, name string, running bool) (*machineconfig.Snapshot, error) {
+	var err error
+	if running {
+		err = runHMP(mc, "savevm "+name)
+	} else {
+		err = createOfflineSnapshot(mc, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating snapshot %q: %w", name, err)
+	}
+
+	info, err := diskInfo(mc)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range info.Snapshots {
+		if s.Name == name {
+			return &machineconfig.Snapshot{
+				Name:        name,
+				Created:     time.Unix(s.DateSec, 0),
+				DiskSize:    info.VirtualSize,
+				VMStateSize: s.VMStateSize,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("snapshot %q not found in %s after its creation", name, mc.ImagePath.GetPath())
+}
+
+// RestoreSnapshot reverts the disks of the machine to the snapshot. Running
+// machines are reverted to the saved memory and device state, they must
+// have been snapshotted while running.
+func (q *QEMUStubber) RestoreSnapshot(mc *vmconfigs.MachineConfig, snapshot *machineconfig.Snapshot, running bool) error {
+	var err error
+	if running {
+		err = runHMP(mc, "loadvm "+snapshot.Name)
+	} else {
+		err = restoreOfflineSnapshot(mc, snapshot.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("restoring snapshot %q: %w", snapshot.Name, err)
+	}
+	return nil
+}
+
+// DeleteSnapshot deletes the internal snapshot of the disks of the machine
+func (q *QEMUStubber) DeleteSnapshot(mc *vmconfigs.MachineConfig, name string, running bool) error {
+	var err error
+	if running {
+		err = runHMP(mc, "delvm "+name)
+	} else {
+		err = deleteOfflineSnapshot(mc, name)
+	}
+	if err != nil {
+		return fmt.Errorf("deleting snapshot %q: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+//go:build linux || freebsd
+
+package qemu
+
+import (
+	"time"
+
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+)
+
+var stopPollInterval = 500 * time.Millisecond
+
+// PowerdownVM asks the guest to shut down with an ACPI power button event
+func (q *QEMUStubber) PowerdownVM(mc *vmconfigs.MachineConfig) error {
+	_, err := runQMP(mc, "system_powerdown", nil)
+	return err
+}
+
+// WaitVMStopped waits up to timeout for QEMU to exit and returns whether it
+// did
+func (q *QEMUStubber) WaitVMStopped(mc *vmconfigs.MachineConfig, timeout time.Duration) (bool, error) {
+	pid, err := mc.QEMUHypervisor.QEMUPidPath.ReadPIDFrom()
+	if err != nil {
+		return false, err
+	}
+	deadline := time.Now().Add(timeout)
+	for isProcessAlive(pid) {
+		if time.Now().After(deadline) {
+			return false, nil
+		}
+		time.Sleep(stopPollInterval)
+	}
+	return true, mc.QEMUHypervisor.QMPMonitor.Address.Delete()
+}
+
+// KillVM kills QEMU without giving the guest a chance to shut down
+func (q *QEMUStubber) KillVM(mc *vmconfigs.MachineConfig) error {
+	pid, err := mc.QEMUHypervisor.QEMUPidPath.ReadPIDFrom()
+	if err != nil {
+		return err
+	}
+	if err := sigKill(pid); err != nil {
+		return err
+	}
+	for isProcessAlive(pid) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return mc.QEMUHypervisor.QMPMonitor.Address.Delete()
+}
@@ -0,0 +1,229 @@
+//go:build linux || freebsd
+
+package qemu
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/containers/common/pkg/config"
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/qemu"
+	"github.com/containers/podman/v5/pkg/machine/qemu/command"
+	"github.com/containers/podman/v5/pkg/machine/sockets"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/sirupsen/logrus"
+)
+
+// QEMUStubber is podman's QEMU provider with a macadam specific QEMU command
+// line, which is needed to support the additional features of macadam
+// machines
+type QEMUStubber struct {
+	qemu.QEMUStubber
+
+	// readyTimeout bounds the wait for the guest to report it booted, there
+	// is no limit when unset
+	readyTimeout time.Duration
+	// restoreState is the saved state the next start loads, the machine
+	// boots when unset
+	restoreState string
+}
+
+// SetReadyTimeout sets the maximum time the machine is given to report it
+// booted on the ready socket
+func (q *QEMUStubber) SetReadyTimeout(timeout time.Duration) {
+	q.readyTimeout = timeout
+}
+
+var (
+	gvProxyWaitBackoff        = 500 * time.Millisecond
+	gvProxyMaxBackoffAttempts = 6
+)
+
+// findQEMUBinary locates and returns the QEMU binary
+func findQEMUBinary() (string, error) {
+	cfg, err := config.Default()
+	if err != nil {
+		return "", err
+	}
+	return cfg.FindHelperBinary(qemu.QemuCommand, true)
+}
+
+func (q *QEMUStubber) setQEMUCommandLine(mc *vmconfigs.MachineConfig) error {
+	qemuBinary, err := findQEMUBinary()
+	if err != nil {
+		return err
+	}
+
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return err
+	}
+
+	readySocket, err := mc.ReadySocket()
+	if err != nil {
+		return err
+	}
+
+	q.QEMUPidPath = mc.QEMUHypervisor.QEMUPidPath
+
+	q.Command = command.NewQemuBuilder(qemuBinary, addArchOptions())
+	q.Command.SetBootableImage(mc.ImagePath.GetPath())
+	for _, disk := range macadamConfig.DataDisks {
+		setDataDisk(&q.Command, disk)
+	}
+	q.Command.SetMemory(mc.Resources.Memory)
+	q.Command.SetCPUs(mc.Resources.CPUs)
+
+	switch macadamConfig.Provisioner {
+	case machineconfig.CloudInitProvisioner:
+		if macadamConfig.CloudInitISO == nil {
+			return fmt.Errorf("no cloud-init seed ISO for machine %q", mc.Name)
+		}
+		setCDROM(&q.Command, macadamConfig.CloudInitISO.GetPath())
+	default:
+		ignitionFile, err := mc.IgnitionFile()
+		if err != nil {
+			return err
+		}
+		q.Command.SetIgnitionFile(*ignitionFile)
+	}
+
+	q.Command.SetQmpMonitor(mc.QEMUHypervisor.QMPMonitor)
+	gvProxySock, err := mc.GVProxySocket()
+	if err != nil {
+		return err
+	}
+	if err := q.Command.SetNetwork(gvProxySock); err != nil {
+		return err
+	}
+	q.Command.SetSerialPort(*readySocket, *mc.QEMUHypervisor.QEMUPidPath, mc.Name)
+
+	// Add volumes to qemu command line
+	for _, mount := range mc.Mounts {
+		// the index provided in this case is thrown away
+		_, _, _, _, securityModel := vmconfigs.SplitVolume(0, mount.OriginalInput)
+		q.Command.SetVirtfsMount(mount.Source, mount.Tag, securityModel, mount.ReadOnly)
+	}
+
+	q.Command.SetUSBHostPassthrough(mc.Resources.USBs)
+
+	if q.restoreState != "" {
+		q.Command = append(q.Command, "-incoming", "file:"+q.restoreState)
+	}
+
+	return nil
+}
+
+func runStartVMCommand(cmd *exec.Cmd) error {
+	err := cmd.Start()
+	if err != nil {
+		// check if qemu was not found
+		// look up qemu again maybe the path was changed, https://github.com/containers/podman/issues/13394
+		cfg, err := config.Default()
+		if err != nil {
+			return err
+		}
+		qemuBinaryPath, err := cfg.FindHelperBinary(qemu.QemuCommand, true)
+		if err != nil {
+			return err
+		}
+		cmd.Path = qemuBinaryPath
+		err = cmd.Start()
+		if err != nil {
+			return fmt.Errorf("unable to execute %q: %w", cmd, err)
+		}
+	}
+	return nil
+}
+
+func (q *QEMUStubber) StartVM(mc *vmconfigs.MachineConfig) (func() error, func() error, error) {
+	if err := q.setQEMUCommandLine(mc); err != nil {
+		return nil, nil, fmt.Errorf("unable to generate qemu command line: %q", err)
+	}
+
+	readySocket, err := mc.ReadySocket()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gvProxySock, err := mc.GVProxySocket()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Wait on gvproxy to be running and aware
+	if err := sockets.WaitForSocketWithBackoffs(gvProxyMaxBackoffAttempts, gvProxyWaitBackoff, gvProxySock.GetPath(), "gvproxy"); err != nil {
+		return nil, nil, err
+	}
+
+	dnr, dnw, err := machine.GetDevNullFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer dnr.Close()
+	defer dnw.Close()
+
+	cmdLine := q.Command
+
+	// Disable graphic window when not in debug mode
+	// Done in start, so we're not suck with the debug level we used on init
+	if !logrus.IsLevelEnabled(logrus.DebugLevel) {
+		cmdLine.SetDisplay("none")
+	}
+
+	logrus.Debugf("qemu cmd: %v", cmdLine)
+
+	stderrBuf := &bytes.Buffer{}
+
+	// actually run the command that starts the virtual machine
+	cmd := &exec.Cmd{
+		Args:   cmdLine,
+		Path:   cmdLine[0],
+		Stdin:  dnr,
+		Stdout: dnw,
+		Stderr: stderrBuf,
+	}
+
+	if err := runStartVMCommand(cmd); err != nil {
+		return nil, nil, err
+	}
+	logrus.Debugf("Started qemu pid %d", cmd.Process.Pid)
+
+	readyFunc := func() error {
+		return waitForReady(readySocket, cmd.Process.Pid, stderrBuf, q.readyTimeout)
+	}
+	if q.restoreState != "" {
+		readyFunc = func() error {
+			return waitForRestore(mc, cmd.Process.Pid, stderrBuf)
+		}
+	}
+
+	// if this is not the last line in the func, make it a defer
+	return cmd.Process.Release, readyFunc, nil
+}
+
+func waitForReady(readySocket *define.VMFile, pid int, stdErrBuffer *bytes.Buffer, timeout time.Duration) error {
+	defaultBackoff := 500 * time.Millisecond
+	maxBackoffs := 6
+	conn, err := sockets.DialSocketWithBackoffsAndProcCheck(maxBackoffs, defaultBackoff, readySocket.GetPath(), checkProcessStatus, "qemu", pid, stdErrBuffer)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// qemu listens on the ready socket right away, the guest only writes
+	// to it once booted
+	if timeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+	}
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	return err
+}
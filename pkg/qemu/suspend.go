@@ -0,0 +1,174 @@
+//go:build linux || freebsd
+
+package qemu
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	migrationPollInterval = 500 * time.Millisecond
+	// migrationTimeout bounds the time spent saving the state of a machine
+	migrationTimeout = 10 * time.Minute
+	// migrationCancelTimeout bounds the wait for a cancelled migration to end
+	migrationCancelTimeout = 30 * time.Second
+)
+
+// queryStatus returns the run state of the guest of the running machine
+func queryStatus(mc *vmconfigs.MachineConfig) (string, error) {
+	ret, err := runQMP(mc, "query-status", nil)
+	if err != nil {
+		return "", err
+	}
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(ret, &status); err != nil {
+		return "", err
+	}
+	return status.Status, nil
+}
+
+// migrationStatus returns the status of the migration of the machine, the
+// outgoing one on suspend and the incoming one on restore
+func migrationStatus(mc *vmconfigs.MachineConfig) (string, error) {
+	ret, err := runQMP(mc, "query-migrate", nil)
+	if err != nil {
+		return "", err
+	}
+	var info struct {
+		Status    string `json:"status"`
+		ErrorDesc string `json:"error-desc"`
+	}
+	if err := json.Unmarshal(ret, &info); err != nil {
+		return "", err
+	}
+	switch info.Status {
+	case "failed", "cancelled":
+		if info.ErrorDesc != "" {
+			return "", errors.New(info.ErrorDesc)
+		}
+		return "", fmt.Errorf("migration %s", info.Status)
+	}
+	return info.Status, nil
+}
+
+// waitForMigration waits for the outgoing migration of the machine to end.
+// The migration is cancelled when it does not end within migrationTimeout.
+func waitForMigration(mc *vmconfigs.MachineConfig) error {
+	deadline := time.Now().Add(migrationTimeout)
+	for {
+		status, err := migrationStatus(mc)
+		if err != nil {
+			return fmt.Errorf("saving state: %w", err)
+		}
+		if status == "completed" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(migrationPollInterval)
+	}
+
+	if _, err := runQMP(mc, "migrate_cancel", nil); err != nil {
+		return fmt.Errorf("cancelling the save of the state after %s: %w", migrationTimeout, err)
+	}
+	// the guest is continued once the migration is over, QEMU ends it at
+	// its next iteration
+	for deadline = time.Now().Add(migrationCancelTimeout); time.Now().Before(deadline); {
+		status, err := migrationStatus(mc)
+		if err != nil || status == "completed" {
+			break
+		}
+		time.Sleep(migrationPollInterval)
+	}
+	return fmt.Errorf("saving state: timed out after %s", migrationTimeout)
+}
+
+// SuspendVM saves the memory and device state of the running machine to
+// path and stops QEMU. The guest is stopped first so that the disk matches
+// the saved state, it is continued again when saving fails.
+func (q *QEMUStubber) SuspendVM(mc *vmconfigs.MachineConfig, path string) (err error) {
+	status, err := queryStatus(mc)
+	if err != nil {
+		return err
+	}
+	if _, err := runQMP(mc, "stop", nil); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil && status == "running" {
+			if _, err := runQMP(mc, "cont", nil); err != nil {
+				logrus.Error(err)
+			}
+		}
+	}()
+
+	if _, err := runQMP(mc, "migrate", map[string]string{"uri": "file:" + path}); err != nil {
+		return err
+	}
+	if err := waitForMigration(mc); err != nil {
+		return err
+	}
+
+	pid, err := mc.QEMUHypervisor.QEMUPidPath.ReadPIDFrom()
+	if err != nil {
+		return err
+	}
+	// QEMU may exit before it answers
+	if _, err := runQMP(mc, "quit", nil); err != nil {
+		logrus.Debugf("QMP command quit: %v", err)
+	}
+	for isProcessAlive(pid) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return mc.QEMUHypervisor.QMPMonitor.Address.Delete()
+}
+
+// SetRestoreState makes the next start load the state saved by SuspendVM
+// from path instead of booting the machine
+func (q *QEMUStubber) SetRestoreState(path string) {
+	q.restoreState = path
+}
+
+// waitForRestore waits for QEMU to load the saved state of the machine and
+// continues its guest. The guest is stopped when its state is saved, so QEMU
+// leaves it paused once the state is loaded. Restored guests do not report
+// on the ready socket as they do not boot.
+func waitForRestore(mc *vmconfigs.MachineConfig, pid int, stdErrBuffer *bytes.Buffer) error {
+	for {
+		if err := checkProcessStatus("qemu", pid, stdErrBuffer); err != nil {
+			return err
+		}
+		status, err := queryStatus(mc)
+		switch {
+		case errors.Is(err, syscall.ENOENT), errors.Is(err, syscall.ECONNREFUSED):
+			// the monitor is not up yet
+		case err != nil:
+			return err
+		case status == "running":
+			return nil
+		case status == "paused":
+			migration, err := migrationStatus(mc)
+			if err != nil {
+				return fmt.Errorf("restoring saved state: %w", err)
+			}
+			if migration == "completed" {
+				_, err := runQMP(mc, "cont", nil)
+				return err
+			}
+		case status != "inmigrate":
+			return fmt.Errorf("restoring saved state: machine is %s", status)
+		}
+		time.Sleep(migrationPollInterval)
+	}
+}
@@ -0,0 +1,575 @@
+package shim
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/containers/podman/v5/pkg/machine/connection"
+	machineDefine "github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/ignition"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/containers/storage/pkg/fileutils"
+	"github.com/crc-org/macadam/pkg/compression"
+	"github.com/crc-org/macadam/pkg/env"
+	"github.com/crc-org/macadam/pkg/imagecache"
+	"github.com/crc-org/macadam/pkg/lock"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+)
+
+// A machine bundle is a zstd compressed tarball holding the manifest, the
+// ignition file, the SSH key pair when requested and the disk image last, so
+// that bundles can be imported in a single pass.
+const (
+	bundleVersion      = 1
+	bundleManifestName = "manifest.json"
+	bundleIgnitionName = "ignition.ign"
+	bundleIdentityName = "identity"
+	bundleDiskName     = "disk"
+)
+
+// bundleManifest describes the machine of a bundle
+type bundleManifest struct {
+	Version int
+	VMType  string
+	Arch    string
+	// Disk is the name of the disk image in the bundle
+	Disk               string
+	UserModeNetworking bool
+	// Machine and Macadam are the configurations of the machine without
+	// the host specific fields
+	Machine *vmconfigs.MachineConfig
+	Macadam *machineconfig.MachineConfig
+}
+
+// ExportOptions are the options of Export
+type ExportOptions struct {
+	// IncludeSSHKey adds the SSH key pair of the machine to the bundle.
+	// The guest only authorizes the key it was provisioned with, without
+	// it the machine cannot be reached after import once it booted.
+	IncludeSSHKey bool
+}
+
+// Export writes the stopped machine mc to the bundle at path. QEMU overlays
+// are flattened so that the bundle does not depend on the image cache,
+// internal snapshots, data disks and socket forwards, whose host sockets are
+// specific to this host, are not exported.
+func Export(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, path string, opts ExportOptions) (err error) {
+	mc.Lock()
+	defer mc.Unlock()
+	if err := mc.Refresh(); err != nil {
+		return fmt.Errorf("reload config: %w", err)
+	}
+	state, err := mp.State(mc, false)
+	if err != nil {
+		return err
+	}
+	if state != machineDefine.Stopped {
+		return fmt.Errorf("machine %q must be stopped to be exported", mc.Name)
+	}
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return err
+	}
+
+	manifest := bundleManifest{
+		Version:            bundleVersion,
+		VMType:             mp.VMType().String(),
+		Arch:               runtime.GOARCH,
+		Disk:               bundleDiskName + filepath.Ext(mc.ImagePath.GetPath()),
+		UserModeNetworking: mp.UserModeNetworkEnabled(mc),
+		Machine:            portableMachineConfig(mc),
+		Macadam:            portableMacadamConfig(macadamConfig),
+	}
+
+	disk := mc.ImagePath.GetPath()
+	format, err := imagecache.DetectDiskFormat(disk)
+	if err != nil {
+		return err
+	}
+	if format == imagecache.Qcow2Format {
+		flat := filepath.Join(filepath.Dir(disk), mc.Name+"-export.qcow2")
+		if err := imagecache.ConvertDisk(disk, format, flat, format); err != nil {
+			return fmt.Errorf("flattening disk of machine %q: %w", mc.Name, err)
+		}
+		defer os.Remove(flat)
+		disk = flat
+		if len(manifest.Macadam.Snapshots) > 0 {
+			logrus.Warnf("snapshots of machine %q are not exported", mc.Name)
+			manifest.Macadam.Snapshots = nil
+		}
+	}
+	if len(macadamConfig.DataDisks) > 0 {
+		logrus.Warnf("data disks of machine %q are not exported", mc.Name)
+	}
+	if len(macadamConfig.SocketForwards) > 0 {
+		logrus.Warnf("socket forwards of machine %q are not exported", mc.Name)
+	}
+	if macadamConfig.SavedState != nil {
+		logrus.Warnf("the saved state of machine %q is not exported", mc.Name)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+			logrus.Error(err)
+		}
+		if err != nil {
+			if err := os.Remove(path); err != nil {
+				logrus.Error(err)
+			}
+		}
+	}()
+	bw, err := newBundleWriter(f)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(manifest, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := bw.addBytes(bundleManifestName, b, 0644); err != nil {
+		return err
+	}
+
+	ignitionFile, err := mc.IgnitionFile()
+	if err != nil {
+		return err
+	}
+	switch b, err := ignitionFile.Read(); {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := bw.addBytes(bundleIgnitionName, b, 0644); err != nil {
+			return err
+		}
+	}
+
+	if opts.IncludeSSHKey {
+		if err := bw.addFile(bundleIdentityName, mc.SSH.IdentityPath); err != nil {
+			return err
+		}
+		if err := bw.addFile(bundleIdentityName+".pub", mc.SSH.IdentityPath+".pub"); err != nil {
+			return err
+		}
+	}
+
+	if err := bw.addFile(manifest.Disk, disk); err != nil {
+		return fmt.Errorf("exporting disk of machine %q: %w", mc.Name, err)
+	}
+	if err := bw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// ImportOptions are the options of Import
+type ImportOptions struct {
+	// Name is the name of the machine, the name of the exported machine is
+	// used when empty
+	Name string
+	// KeepMounts shares the host directories the bundle mounts with the
+	// guest. They are chosen by the author of the bundle, the mounts are
+	// dropped unless set.
+	KeepMounts bool
+}
+
+// Import creates a machine from the bundle at path. The machine gets its own
+// SSH port, runtime files and the host user ID. It uses the SSH key pair of
+// the bundle if any, the default key otherwise.
+//
+// Machines which never booted are provisioned again for this host, the
+// ignition file of the bundle is used as-is for the others.
+func Import(path string, mp vmconfigs.VMProvider, importOpts ImportOptions) (_ string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return "", fmt.Errorf("reading bundle %s: %w", path, err)
+	}
+	if hdr.Name != bundleManifestName {
+		return "", fmt.Errorf("%s is not a machine bundle", path)
+	}
+	var manifest bundleManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return "", fmt.Errorf("reading bundle manifest: %w", err)
+	}
+	switch {
+	case manifest.Machine == nil || manifest.Macadam == nil:
+		return "", fmt.Errorf("%s is not a machine bundle", path)
+	case manifest.Version != bundleVersion:
+		return "", fmt.Errorf("unsupported bundle version %d", manifest.Version)
+	case manifest.VMType != mp.VMType().String():
+		return "", fmt.Errorf("bundle holds a %s machine, cannot import it as a %s machine", manifest.VMType, mp.VMType())
+	case manifest.Arch != runtime.GOARCH:
+		return "", fmt.Errorf("bundle holds a %s machine, cannot import it on %s", manifest.Arch, runtime.GOARCH)
+	}
+
+	name := importOpts.Name
+	if name == "" {
+		name = manifest.Machine.Name
+	}
+	// the name comes from the bundle when not given, it must not lead
+	// outside of the machine directories
+	if err := ValidateMachineName(name); err != nil {
+		return "", err
+	}
+	if _, exists, err := VMExists(name, []vmconfigs.VMProvider{mp}); err != nil {
+		return "", err
+	} else if exists {
+		return "", fmt.Errorf("%s: %w", name, machineDefine.ErrVMAlreadyExists)
+	}
+
+	callbackFuncs := machine.CleanUp()
+	defer callbackFuncs.CleanIfErr(&err)
+	go callbackFuncs.CleanOnSignal()
+
+	dirs, err := env.GetMachineDirs(mp.VMType())
+	if err != nil {
+		return "", err
+	}
+	sshIdentityPath, err := env.GetSSHIdentityPath(machineDefine.DefaultIdentityName)
+	if err != nil {
+		return "", err
+	}
+
+	machineLock, err := lock.GetMachineLock(name, dirs.ConfigDir.GetPath())
+	if err != nil {
+		return "", err
+	}
+	machineLock.Lock()
+	defer machineLock.Unlock()
+
+	src := manifest.Macadam
+	opts := InitOptions{
+		Provisioner:          src.Provisioner,
+		SkipPodmanConnection: len(src.PodmanConnections) == 0,
+	}
+	opts.Name = name
+	opts.Username = manifest.Machine.SSH.RemoteUsername
+	opts.TimeZone = src.TimeZone
+	opts.Rootful = manifest.Machine.HostUser.Rootful
+
+	mc, err := newMachineConfig(opts.InitOptions, dirs, sshIdentityPath, mp.VMType())
+	if err != nil {
+		return "", err
+	}
+	callbackFuncs.Add(func() error {
+		return removeMachineConfig(mc)
+	})
+	mc.Resources = manifest.Machine.Resources
+	mc.Rosetta = manifest.Machine.Rosetta
+	for _, m := range manifest.Machine.Mounts {
+		if !importOpts.KeepMounts {
+			logrus.Warnf("not sharing %s of this host with the guest on %s, the mounts of bundles are only kept on request", m.Source, m.Target)
+			continue
+		}
+		logrus.Infof("sharing %s of this host with the guest on %s", m.Source, m.Target)
+		if err := fileutils.Exists(m.Source); err != nil {
+			logrus.Warnf("source %s of mount %s does not exist on this host", m.Source, m.Target)
+		}
+		mc.Mounts = append(mc.Mounts, m)
+	}
+
+	macadamConfig, err := machineconfig.New(mc)
+	if err != nil {
+		return "", err
+	}
+	macadamConfig.Provisioner = src.Provisioner
+	macadamConfig.Image = src.Image
+	macadamConfig.ImageFormat = src.ImageFormat
+	macadamConfig.IgnitionPath = src.IgnitionPath
+	macadamConfig.TimeZone = src.TimeZone
+	macadamConfig.Snapshots = src.Snapshots
+	macadamConfig.PortForwards = src.PortForwards
+
+	mc.ImagePath, err = dirs.DataDir.AppendToNewVMFile(fmt.Sprintf("%s-%s%s", name, runtime.GOARCH, filepath.Ext(manifest.Disk)), nil)
+	if err != nil {
+		return "", err
+	}
+
+	var ignitionData, identity, identityPub []byte
+	var hasDisk bool
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("reading bundle %s: %w", path, err)
+		}
+		switch hdr.Name {
+		case bundleIgnitionName:
+			ignitionData, err = io.ReadAll(tr)
+		case bundleIdentityName:
+			identity, err = io.ReadAll(tr)
+		case bundleIdentityName + ".pub":
+			identityPub, err = io.ReadAll(tr)
+		case manifest.Disk:
+			logrus.Debugf("extracting disk to %s", mc.ImagePath.GetPath())
+			callbackFuncs.Add(mc.ImagePath.Delete)
+			err = extractBundleDisk(mc.ImagePath.GetPath(), tr)
+			hasDisk = true
+		default:
+			logrus.Debugf("skipping %s in machine bundle", hdr.Name)
+		}
+		if err != nil {
+			return "", fmt.Errorf("reading %s from bundle: %w", hdr.Name, err)
+		}
+	}
+	if !hasDisk {
+		return "", fmt.Errorf("bundle %s has no disk image", path)
+	}
+	// bundles are not necessarily written by Export, the disk must not
+	// give the guest access to other files of the host
+	format, err := imagecache.DetectDiskFormat(mc.ImagePath.GetPath())
+	if err != nil {
+		return "", err
+	}
+	if err := imagecache.CheckSelfContained(mc.ImagePath.GetPath(), format); err != nil {
+		return "", err
+	}
+
+	if identity != nil {
+		identityFile, err := importedIdentityFile(mc)
+		if err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(identityFile.GetPath(), identity, 0600); err != nil {
+			return "", err
+		}
+		callbackFuncs.Add(identityFile.Delete)
+		if err := os.WriteFile(identityFile.GetPath()+".pub", identityPub, 0644); err != nil {
+			return "", err
+		}
+		callbackFuncs.Add(func() error {
+			return os.Remove(identityFile.GetPath() + ".pub")
+		})
+		mc.SSH.IdentityPath = identityFile.GetPath()
+	}
+	sshKey, err := machine.GetSSHKeys(mc.SSH.IdentityPath)
+	if err != nil {
+		return "", err
+	}
+
+	ignitionFile, err := mc.IgnitionFile()
+	if err != nil {
+		return "", err
+	}
+	ignBuilder := ignition.NewIgnitionBuilder(ignition.DynamicIgnition{
+		Name:      opts.Username,
+		Key:       sshKey,
+		TimeZone:  opts.TimeZone,
+		UID:       mc.HostUser.UID,
+		VMName:    name,
+		VMType:    mp.VMType(),
+		WritePath: ignitionFile.GetPath(),
+		Rootful:   opts.Rootful,
+	})
+	// ignition only runs on the first boot of the disk
+	regenerateIgnition := src.IgnitionPath == "" && manifest.Machine.LastUp.IsZero()
+	switch {
+	case opts.Provisioner == machineconfig.CloudInitProvisioner:
+		if err := prepareCloudInit(mc, macadamConfig, sshKey, opts); err != nil {
+			return "", err
+		}
+		callbackFuncs.Add(macadamConfig.CloudInitISO.Delete)
+	case regenerateIgnition:
+		if err := generateIgnition(mp, mc, &ignBuilder); err != nil {
+			return "", err
+		}
+	case ignitionData == nil:
+		return "", fmt.Errorf("bundle %s has no ignition file", path)
+	default:
+		if err := os.WriteFile(ignitionFile.GetPath(), ignitionData, 0644); err != nil {
+			return "", err
+		}
+		callbackFuncs.Add(ignitionFile.Delete)
+	}
+
+	if !opts.SkipPodmanConnection {
+		if err := connection.AddSSHConnectionsToPodmanSocket(mc.HostUser.UID, mc.SSH.Port, mc.SSH.IdentityPath, mc.Name, mc.SSH.RemoteUsername, opts.InitOptions); err != nil {
+			return "", err
+		}
+		macadamConfig.PodmanConnections = []string{mc.Name, mc.Name + "-root"}
+		callbackFuncs.Add(func() error {
+			return connection.RemoveConnections(macadamConfig.PodmanConnections...)
+		})
+	}
+
+	createOpts := machineDefine.CreateVMOpts{
+		Name:               name,
+		Dirs:               dirs,
+		UserModeNetworking: manifest.UserModeNetworking,
+	}
+	if err := mp.CreateVM(createOpts, mc, &ignBuilder); err != nil {
+		return "", err
+	}
+
+	if opts.Provisioner == machineconfig.IgnitionProvisioner && regenerateIgnition {
+		if err := ignBuilder.Build(); err != nil {
+			return "", err
+		}
+		callbackFuncs.Add(ignitionFile.Delete)
+	}
+
+	macadamConfig.UpdateConnection(mc)
+	if err := macadamConfig.Write(); err != nil {
+		return "", err
+	}
+	callbackFuncs.Add(macadamConfig.Remove)
+
+	return name, mc.Write()
+}
+
+// portableMachineConfig returns the podman configuration of mc without the
+// fields specific to this host: SSH port and key, host user ID, disk path,
+// runtime files and provider state
+func portableMachineConfig(mc *vmconfigs.MachineConfig) *vmconfigs.MachineConfig {
+	return &vmconfigs.MachineConfig{
+		Created:   mc.Created,
+		HostUser:  vmconfigs.HostUser{Rootful: mc.HostUser.Rootful},
+		LastUp:    mc.LastUp,
+		Mounts:    mc.Mounts,
+		Name:      mc.Name,
+		Resources: mc.Resources,
+		SSH:       vmconfigs.SSHConfig{RemoteUsername: mc.SSH.RemoteUsername},
+		Version:   mc.Version,
+		Rosetta:   mc.Rosetta,
+	}
+}
+
+// portableMacadamConfig returns the macadam configuration of a machine
+// without the fields specific to this host: cached image, cloud-init seed
+// ISO, SSH connection and socket forwards
+func portableMacadamConfig(c *machineconfig.MachineConfig) *machineconfig.MachineConfig {
+	return &machineconfig.MachineConfig{
+		Provisioner:       c.Provisioner,
+		Image:             c.Image,
+		ImageFormat:       c.ImageFormat,
+		IgnitionPath:      c.IgnitionPath,
+		TimeZone:          c.TimeZone,
+		PodmanConnections: c.PodmanConnections,
+		Snapshots:         c.Snapshots,
+		PortForwards:      c.PortForwards,
+	}
+}
+
+// importedIdentityFile returns the private key file of mc when it was
+// imported along with its SSH key pair
+func importedIdentityFile(mc *vmconfigs.MachineConfig) (*machineDefine.VMFile, error) {
+	dataDir, err := mc.DataDir()
+	if err != nil {
+		return nil, err
+	}
+	return dataDir.AppendToNewVMFile(mc.Name+"-identity", nil)
+}
+
+// extractBundleDisk writes the disk image r to path, holes are created for
+// the zeroed blocks of the image
+func extractBundleDisk(path string, r io.Reader) (retErr error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	sparseWriter := compression.NewSparseWriter(f)
+	defer func() {
+		if err := sparseWriter.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	_, err = io.Copy(sparseWriter, r)
+	return err
+}
+
+// bundleWriter writes the files of a machine bundle
+type bundleWriter struct {
+	zw *zstd.Encoder
+	tw *tar.Writer
+}
+
+func newBundleWriter(w io.Writer) (*bundleWriter, error) {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	return &bundleWriter{zw: zw, tw: tar.NewWriter(zw)}, nil
+}
+
+// addBytes adds the file name with content b to the bundle
+func (bw *bundleWriter) addBytes(name string, b []byte, mode int64) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     mode,
+		Size:     int64(len(b)),
+		ModTime:  time.Now(),
+	}
+	if err := bw.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := bw.tw.Write(b)
+	return err
+}
+
+// addFile adds the file at path to the bundle as name
+func (bw *bundleWriter) addFile(name string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(fi.Mode().Perm()),
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime(),
+	}
+	if err := bw.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(bw.tw, f)
+	return err
+}
+
+// Close flushes the bundle, it does not close the underlying writer
+func (bw *bundleWriter) Close() error {
+	if err := bw.tw.Close(); err != nil {
+		return err
+	}
+	return bw.zw.Close()
+}
@@ -0,0 +1,188 @@
+package shim
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	ldefine "github.com/containers/podman/v5/libpod/define"
+	machineDefine "github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/ignition"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/env"
+	"github.com/crc-org/macadam/pkg/imagecache"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/klauspost/compress/zstd"
+)
+
+// fakeProvider is a provider of the given type without machines, it records
+// the machines created, its other methods must not be called
+type fakeProvider struct {
+	vmconfigs.VMProvider
+	vmType  machineDefine.VMType
+	created *vmconfigs.MachineConfig
+}
+
+func (p *fakeProvider) VMType() machineDefine.VMType {
+	return p.vmType
+}
+
+func (p *fakeProvider) Exists(string) (bool, error) {
+	return false, nil
+}
+
+func (p *fakeProvider) CreateVM(_ machineDefine.CreateVMOpts, mc *vmconfigs.MachineConfig, _ *ignition.IgnitionBuilder) error {
+	p.created = mc
+	return nil
+}
+
+// writeBundle writes a machine bundle with the given manifest and files
+func writeBundle(t *testing.T, path string, manifest *bundleManifest, files map[string][]byte) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw, err := zstd.NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(zw)
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, content []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(bundleManifestName, b)
+	for name, content := range files {
+		write(name, content)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportRejectsInvalidName(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(env.HomeEnvVar, filepath.Join(home, "macadam"))
+
+	mp := &fakeProvider{vmType: machineDefine.QemuVirt}
+	bundle := filepath.Join(home, "bundle.tar.zst")
+	writeBundle(t, bundle, &bundleManifest{
+		Version: bundleVersion,
+		VMType:  mp.VMType().String(),
+		Arch:    runtime.GOARCH,
+		Disk:    bundleDiskName + ".raw",
+		Machine: &vmconfigs.MachineConfig{Name: "../../escaped"},
+		Macadam: &machineconfig.MachineConfig{},
+	}, map[string][]byte{bundleDiskName + ".raw": make([]byte, 512)})
+
+	if _, err := Import(bundle, mp, ImportOptions{}); !errors.Is(err, ldefine.RegexError) {
+		t.Fatalf("got %v, want an invalid name error", err)
+	}
+	matches, err := filepath.Glob(filepath.Join(home, "*", "escaped*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) > 0 {
+		t.Errorf("import wrote outside of the machine directories: %v", matches)
+	}
+}
+
+func TestImportRejectsBackingFile(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(env.HomeEnvVar, filepath.Join(home, "macadam"))
+
+	// a qcow2 header whose backing file starts at offset 0x200
+	disk := make([]byte, 1024)
+	copy(disk, "QFI\xfb\x00\x00\x00\x03\x00\x00\x00\x00\x00\x00\x02\x00")
+	mp := &fakeProvider{vmType: machineDefine.QemuVirt}
+	bundle := filepath.Join(home, "bundle.tar.zst")
+	writeBundle(t, bundle, &bundleManifest{
+		Version: bundleVersion,
+		VMType:  mp.VMType().String(),
+		Arch:    runtime.GOARCH,
+		Disk:    bundleDiskName + ".qcow2",
+		Machine: &vmconfigs.MachineConfig{Name: "crafted"},
+		Macadam: &machineconfig.MachineConfig{},
+	}, map[string][]byte{bundleDiskName + ".qcow2": disk})
+
+	if _, err := Import(bundle, mp, ImportOptions{}); !errors.Is(err, imagecache.ErrExternalFile) {
+		t.Fatalf("got %v, want ErrExternalFile", err)
+	}
+	dirs, err := env.GetMachineDirs(mp.VMType())
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := os.ReadDir(dirs.DataDir.GetPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		t.Errorf("%s was left behind", f.Name())
+	}
+}
+
+func TestImportMounts(t *testing.T) {
+	tests := []struct {
+		name       string
+		keepMounts bool
+		wantMounts int
+	}{
+		{name: "dropped by default"},
+		{name: "kept on request", keepMounts: true, wantMounts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+			t.Setenv(env.HomeEnvVar, filepath.Join(home, "macadam"))
+
+			mp := &fakeProvider{vmType: machineDefine.QemuVirt}
+			bundle := filepath.Join(home, "bundle.tar.zst")
+			writeBundle(t, bundle, &bundleManifest{
+				Version: bundleVersion,
+				VMType:  mp.VMType().String(),
+				Arch:    runtime.GOARCH,
+				Disk:    bundleDiskName + ".raw",
+				Machine: &vmconfigs.MachineConfig{
+					Name:   "shared",
+					Mounts: []*vmconfigs.Mount{{Source: home, Target: "/mnt/home", Type: "virtfs"}},
+				},
+				Macadam: &machineconfig.MachineConfig{
+					Provisioner:  machineconfig.IgnitionProvisioner,
+					IgnitionPath: "/tmp/user.ign",
+				},
+			}, map[string][]byte{
+				bundleDiskName + ".raw":     make([]byte, 1024),
+				bundleIgnitionName:          []byte("{}"),
+				bundleIdentityName:          []byte("private key"),
+				bundleIdentityName + ".pub": []byte("ssh-ed25519 AAAA test"),
+			})
+
+			if _, err := Import(bundle, mp, ImportOptions{KeepMounts: tt.keepMounts}); err != nil {
+				t.Fatal(err)
+			}
+			if got := len(mp.created.Mounts); got != tt.wantMounts {
+				t.Errorf("got %d mounts, want %d", got, tt.wantMounts)
+			}
+		})
+	}
+}
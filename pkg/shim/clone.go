@@ -0,0 +1,206 @@
+package shim
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/containers/podman/v5/pkg/machine/connection"
+	machineDefine "github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/ignition"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	crcos "github.com/crc-org/crc/v2/pkg/os"
+	"github.com/crc-org/macadam/pkg/env"
+	"github.com/crc-org/macadam/pkg/lock"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/sirupsen/logrus"
+)
+
+// Clone creates the machine name from the stopped machine src. The disk of
+// src is copied, QEMU overlays remain backed by the cached image src was
+// created from, and the first boot configuration is generated again for the
+// new name. The clone gets its own SSH port, data disks are not cloned.
+//
+// Ignition only runs on the first boot of a disk, so ignition machines can
+// only be cloned before their first start: the clone would otherwise keep the
+// hostname, machine ID and SSH host keys of src. Cloud-init runs again as the
+// instance ID changes and sets the new hostname.
+func Clone(src *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, name string) (err error) {
+	src.Lock()
+	defer src.Unlock()
+	if err := src.Refresh(); err != nil {
+		return fmt.Errorf("reload config: %w", err)
+	}
+	state, err := mp.State(src, false)
+	if err != nil {
+		return err
+	}
+	if state != machineDefine.Stopped {
+		return fmt.Errorf("machine %q must be stopped to be cloned", src.Name)
+	}
+	srcConfig, err := machineconfig.Load(src)
+	if err != nil {
+		return err
+	}
+	if srcConfig.Provisioner == machineconfig.IgnitionProvisioner && !src.LastUp.IsZero() {
+		return fmt.Errorf("machine %q was provisioned by ignition on its first start, a clone would keep its hostname, machine ID and SSH host keys: only cloud-init machines and ignition machines never started can be cloned", src.Name)
+	}
+	if _, exists, err := VMExists(name, []vmconfigs.VMProvider{mp}); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("%s: %w", name, machineDefine.ErrVMAlreadyExists)
+	}
+
+	callbackFuncs := machine.CleanUp()
+	defer callbackFuncs.CleanIfErr(&err)
+	go callbackFuncs.CleanOnSignal()
+
+	dirs, err := env.GetMachineDirs(mp.VMType())
+	if err != nil {
+		return err
+	}
+	sshKey, err := machine.GetSSHKeys(src.SSH.IdentityPath)
+	if err != nil {
+		return err
+	}
+
+	machineLock, err := lock.GetMachineLock(name, dirs.ConfigDir.GetPath())
+	if err != nil {
+		return err
+	}
+	machineLock.Lock()
+	defer machineLock.Unlock()
+
+	opts := InitOptions{
+		Provisioner:          srcConfig.Provisioner,
+		SkipPodmanConnection: len(srcConfig.PodmanConnections) == 0,
+	}
+	opts.Name = name
+	opts.Username = src.SSH.RemoteUsername
+	opts.TimeZone = srcConfig.TimeZone
+	opts.Rootful = src.HostUser.Rootful
+
+	mc, err := newMachineConfig(opts.InitOptions, dirs, src.SSH.IdentityPath, mp.VMType())
+	if err != nil {
+		return err
+	}
+	callbackFuncs.Add(func() error {
+		return removeMachineConfig(mc)
+	})
+	mc.Resources = src.Resources
+	mc.Mounts = src.Mounts
+
+	macadamConfig, err := machineconfig.New(mc)
+	if err != nil {
+		return err
+	}
+	macadamConfig.Provisioner = srcConfig.Provisioner
+	macadamConfig.Image = srcConfig.Image
+	macadamConfig.CachedImage = srcConfig.CachedImage
+	macadamConfig.ImageFormat = srcConfig.ImageFormat
+	macadamConfig.IgnitionPath = srcConfig.IgnitionPath
+	macadamConfig.TimeZone = srcConfig.TimeZone
+	// internal snapshots are copied along with the disk
+	macadamConfig.Snapshots = srcConfig.Snapshots
+	if len(srcConfig.DataDisks) > 0 {
+		logrus.Warnf("data disks of machine %q are not cloned", src.Name)
+	}
+	if srcConfig.SavedState != nil {
+		logrus.Warnf("the saved state of machine %q is not cloned", src.Name)
+	}
+
+	mc.ImagePath, err = dirs.DataDir.AppendToNewVMFile(fmt.Sprintf("%s-%s%s", name, runtime.GOARCH, filepath.Ext(src.ImagePath.GetPath())), nil)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("copying disk %s to %s", src.ImagePath.GetPath(), mc.ImagePath.GetPath())
+	if err := crcos.CopyFileSparse(src.ImagePath.GetPath(), mc.ImagePath.GetPath()); err != nil {
+		return fmt.Errorf("copying disk of machine %q: %w", src.Name, err)
+	}
+	callbackFuncs.Add(mc.ImagePath.Delete)
+
+	ignitionFile, err := mc.IgnitionFile()
+	if err != nil {
+		return err
+	}
+	ignBuilder := ignition.NewIgnitionBuilder(ignition.DynamicIgnition{
+		Name:      opts.Username,
+		Key:       sshKey,
+		TimeZone:  opts.TimeZone,
+		UID:       mc.HostUser.UID,
+		VMName:    name,
+		VMType:    mp.VMType(),
+		WritePath: ignitionFile.GetPath(),
+		Rootful:   opts.Rootful,
+	})
+	switch {
+	case opts.Provisioner == machineconfig.CloudInitProvisioner:
+		if err := prepareCloudInit(mc, macadamConfig, sshKey, opts); err != nil {
+			return err
+		}
+		callbackFuncs.Add(macadamConfig.CloudInitISO.Delete)
+	case srcConfig.IgnitionPath != "":
+		// user provided ignition files are used as-is
+		if err := copyIgnitionFile(src, ignitionFile); err != nil {
+			return err
+		}
+		callbackFuncs.Add(ignitionFile.Delete)
+	default:
+		if err := generateIgnition(mp, mc, &ignBuilder); err != nil {
+			return err
+		}
+	}
+
+	if !opts.SkipPodmanConnection {
+		if err := connection.AddSSHConnectionsToPodmanSocket(mc.HostUser.UID, mc.SSH.Port, mc.SSH.IdentityPath, mc.Name, mc.SSH.RemoteUsername, opts.InitOptions); err != nil {
+			return err
+		}
+		macadamConfig.PodmanConnections = []string{mc.Name, mc.Name + "-root"}
+		callbackFuncs.Add(func() error {
+			return connection.RemoveConnections(macadamConfig.PodmanConnections...)
+		})
+	}
+
+	createOpts := machineDefine.CreateVMOpts{
+		Name:               name,
+		Dirs:               dirs,
+		UserModeNetworking: mp.UserModeNetworkEnabled(src),
+	}
+	if err := mp.CreateVM(createOpts, mc, &ignBuilder); err != nil {
+		return err
+	}
+
+	if opts.Provisioner == machineconfig.IgnitionProvisioner && srcConfig.IgnitionPath == "" {
+		if err := ignBuilder.Build(); err != nil {
+			return err
+		}
+		callbackFuncs.Add(ignitionFile.Delete)
+	}
+
+	macadamConfig.UpdateConnection(mc)
+	if err := macadamConfig.Write(); err != nil {
+		return err
+	}
+	callbackFuncs.Add(macadamConfig.Remove)
+
+	return mc.Write()
+}
+
+// copyIgnitionFile copies the ignition file of src to dst
+func copyIgnitionFile(src *vmconfigs.MachineConfig, dst *machineDefine.VMFile) error {
+	srcFile, err := src.IgnitionFile()
+	if err != nil {
+		return err
+	}
+	b, err := srcFile.Read()
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("machine %q has no ignition file to clone", src.Name)
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst.GetPath(), b, 0644)
+}
@@ -0,0 +1,186 @@
+package shim
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/containers/common/pkg/strongunits"
+	"github.com/containers/podman/v5/pkg/errorhandling"
+	machineDefine "github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/containers/storage/pkg/fileutils"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/crc-org/macadam/pkg/ports"
+	"github.com/sirupsen/logrus"
+)
+
+// newMachineConfig creates the initial machine configuration file from cli
+// options. This is podman's vmconfigs.NewMachineConfig, the SSH port is
+// allocated from macadam's port allocations instead of podman's. The file is
+// written right away so that the configuration can be loaded with the private
+// fields (directories, config path and lock) set.
+func newMachineConfig(opts machineDefine.InitOptions, dirs *machineDefine.MachineDirs, sshIdentityPath string, vmtype machineDefine.VMType) (*vmconfigs.MachineConfig, error) {
+	cf, err := dirs.ConfigDir.AppendToNewVMFile(opts.Name+".json", nil)
+	if err != nil {
+		return nil, err
+	}
+	// Given that we are locked now and check again that the config file does not exists,
+	// if it does it means the VM was already created and we should error.
+	if err := fileutils.Exists(cf.GetPath()); err == nil {
+		return nil, fmt.Errorf("%s: %w", opts.Name, machineDefine.ErrVMAlreadyExists)
+	}
+
+	if vmtype != machineDefine.QemuVirt && len(opts.USBs) > 0 {
+		return nil, fmt.Errorf("USB host passthrough not supported for %s machines", vmtype)
+	}
+
+	usbs, err := machineDefine.ParseUSBs(opts.USBs)
+	if err != nil {
+		return nil, err
+	}
+
+	uid := os.Getuid()
+	if uid == -1 { // windows compensation
+		uid = 1000
+	}
+
+	mc := &vmconfigs.MachineConfig{
+		Name:    opts.Name,
+		Version: vmconfigs.MachineConfigVersion,
+		Resources: vmconfigs.ResourceConfig{
+			CPUs:     opts.CPUS,
+			DiskSize: strongunits.GiB(opts.DiskSize),
+			Memory:   strongunits.MiB(opts.Memory),
+			USBs:     usbs,
+		},
+		Created:  time.Now(),
+		HostUser: vmconfigs.HostUser{UID: uid, Rootful: opts.Rootful},
+	}
+
+	sshPort, err := ports.AllocateMachinePort()
+	if err != nil {
+		return nil, err
+	}
+	mc.SSH = vmconfigs.SSHConfig{
+		IdentityPath:   sshIdentityPath,
+		Port:           sshPort,
+		RemoteUsername: opts.Username,
+	}
+
+	b, err := json.Marshal(mc)
+	if err == nil {
+		err = ioutils.AtomicWriteFile(cf.GetPath(), b, machineDefine.DefaultFilePerm)
+	}
+	if err != nil {
+		if err := ports.ReleaseMachinePort(sshPort); err != nil {
+			logrus.Warnf("could not release port allocation as part of failure rollback (%d): %s", sshPort, err.Error())
+		}
+		return nil, err
+	}
+
+	return vmconfigs.LoadMachineByName(opts.Name, dirs)
+}
+
+// removeMachineConfig deletes the machine configuration file and releases
+// the SSH port of the machine
+func removeMachineConfig(mc *vmconfigs.MachineConfig) error {
+	var errs []error
+	configDir, err := mc.ConfigDir()
+	if err != nil {
+		return err
+	}
+	cf, err := configDir.AppendToNewVMFile(mc.Name+".json", nil)
+	if err != nil {
+		return err
+	}
+	if err := cf.Delete(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := ports.ReleaseMachinePort(mc.SSH.Port); err != nil {
+		errs = append(errs, err)
+	}
+	return errorhandling.JoinErrors(errs)
+}
+
+// machineFiles returns the files of the machine which are deleted on removal
+// along with the function doing the removal. This is podman's
+// MachineConfig.Remove, the SSH port is released from macadam's port
+// allocations and the podman system connections are left to the caller.
+func machineFiles(mc *vmconfigs.MachineConfig, saveIgnition, saveImage bool) ([]string, func() error, error) {
+	ignitionFile, err := mc.IgnitionFile()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	readySocket, err := mc.ReadySocket()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gvProxySocket, err := mc.GVProxySocket()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	apiSocket, err := mc.APISocket()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logPath, err := mc.LogFile()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	configDir, err := mc.ConfigDir()
+	if err != nil {
+		return nil, nil, err
+	}
+	configPath, err := configDir.AppendToNewVMFile(mc.Name+".json", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rmFiles := []string{
+		configPath.GetPath(),
+		readySocket.GetPath(),
+		gvProxySocket.GetPath(),
+		apiSocket.GetPath(),
+		logPath.GetPath(),
+	}
+	if !saveImage {
+		rmFiles = append(rmFiles, mc.ImagePath.GetPath())
+	}
+	if !saveIgnition {
+		rmFiles = append(rmFiles, ignitionFile.GetPath())
+	}
+
+	mcRemove := func() error {
+		var errs []error
+		if !saveIgnition {
+			if err := ignitionFile.Delete(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if !saveImage {
+			if err := mc.ImagePath.Delete(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		for _, f := range []*machineDefine.VMFile{readySocket, gvProxySocket, apiSocket, logPath} {
+			if err := f.Delete(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		if err := removeMachineConfig(mc); err != nil {
+			errs = append(errs, err)
+		}
+
+		return errorhandling.JoinErrors(errs)
+	}
+
+	return rmFiles, mcRemove, nil
+}
@@ -0,0 +1,209 @@
+package shim
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/containers/common/pkg/strongunits"
+	machineDefine "github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/containers/storage/pkg/fileutils"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/sirupsen/logrus"
+)
+
+// dataDiskProvider is implemented by the providers which can attach data
+// disks to machines
+type dataDiskProvider interface {
+	CreateDataDisk(path string, size strongunits.GiB) error
+	DataDiskInfo(path string) (string, int64, error)
+}
+
+// dataDiskNameRegex matches the valid data disk names, dataDiskSerialRegex
+// the valid serial numbers which virtio limits to 20 bytes
+var (
+	dataDiskNameRegex   = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+	dataDiskSerialRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,20}$`)
+)
+
+// ErrDataDiskNotFound is returned for data disks the machine does not have
+var ErrDataDiskNotFound = errors.New("no such data disk")
+
+// DataDiskOptions describes the data disk to attach to a machine, either an
+// empty disk of Size or the existing image file Image
+type DataDiskOptions struct {
+	Name string
+	// Serial defaults to the name of the disk
+	Serial string
+	Size   strongunits.GiB
+	Image  string
+}
+
+func getDataDiskProvider(mp vmconfigs.VMProvider) (dataDiskProvider, error) {
+	p, ok := mp.(dataDiskProvider)
+	if !ok {
+		return nil, fmt.Errorf("data disks are not supported by the %s provider", mp.VMType())
+	}
+	return p, nil
+}
+
+// dataDiskState checks that the machine is stopped, disks are only attached
+// and detached on the QEMU command line
+func dataDiskState(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider) error {
+	state, err := mp.State(mc, false)
+	if err != nil {
+		return err
+	}
+	if state != machineDefine.Stopped {
+		return fmt.Errorf("machine %q must be stopped to attach or detach disks", mc.Name)
+	}
+	return nil
+}
+
+// AddDataDisk attaches a data disk to the stopped machine and records it in
+// the machine configuration. Empty disks are created in the machine data
+// directory and deleted along with the machine, image files are attached in
+// place and never deleted.
+func AddDataDisk(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, opts DataDiskOptions) (_ *machineconfig.DataDisk, err error) {
+	p, err := getDataDiskProvider(mp)
+	if err != nil {
+		return nil, err
+	}
+	if !dataDiskNameRegex.MatchString(opts.Name) {
+		return nil, fmt.Errorf("invalid data disk name %q: names must match %s", opts.Name, dataDiskNameRegex)
+	}
+	if opts.Serial == "" {
+		opts.Serial = opts.Name
+	}
+	if !dataDiskSerialRegex.MatchString(opts.Serial) {
+		return nil, fmt.Errorf("invalid data disk serial %q: serials must match %s", opts.Serial, dataDiskSerialRegex)
+	}
+	if (opts.Size == 0) == (opts.Image == "") {
+		return nil, errors.New("data disks need either a size or an image")
+	}
+
+	mc.Lock()
+	defer mc.Unlock()
+	if err := mc.Refresh(); err != nil {
+		return nil, fmt.Errorf("reload config: %w", err)
+	}
+	if err := dataDiskState(mc, mp); err != nil {
+		return nil, err
+	}
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return nil, err
+	}
+
+	disk := machineconfig.DataDisk{
+		Name:   opts.Name,
+		Serial: opts.Serial,
+	}
+	if opts.Image != "" {
+		disk.Path, err = filepath.Abs(opts.Image)
+		if err != nil {
+			return nil, err
+		}
+		if disk.Path == mc.ImagePath.GetPath() {
+			return nil, fmt.Errorf("%s is the boot disk of machine %q", disk.Path, mc.Name)
+		}
+	} else {
+		dataDir, err := mc.DataDir()
+		if err != nil {
+			return nil, err
+		}
+		disk.Path = filepath.Join(dataDir.GetPath(), fmt.Sprintf("%s-%s.qcow2", mc.Name, opts.Name))
+		disk.Owned = true
+	}
+	for _, d := range macadamConfig.DataDisks {
+		switch {
+		case d.Name == disk.Name:
+			return nil, fmt.Errorf("machine %q already has a data disk named %q", mc.Name, disk.Name)
+		case d.Serial == disk.Serial:
+			return nil, fmt.Errorf("data disk %q of machine %q already has serial %q", d.Name, mc.Name, disk.Serial)
+		case d.Path == disk.Path:
+			return nil, fmt.Errorf("%s is already attached to machine %q as %q", disk.Path, mc.Name, d.Name)
+		}
+	}
+
+	if disk.Owned {
+		if err := fileutils.Exists(disk.Path); err == nil {
+			return nil, fmt.Errorf("data disk %s already exists", disk.Path)
+		}
+		if err := p.CreateDataDisk(disk.Path, opts.Size); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				if err := os.Remove(disk.Path); err != nil {
+					logrus.Error(err)
+				}
+			}
+		}()
+	}
+	disk.Format, disk.Size, err = p.DataDiskInfo(disk.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	macadamConfig.DataDisks = append(macadamConfig.DataDisks, disk)
+	if err := macadamConfig.Write(); err != nil {
+		return nil, err
+	}
+	// the state of a suspended machine cannot be loaded with other disks
+	if err := discardSavedState(macadamConfig); err != nil {
+		return nil, err
+	}
+	return &disk, nil
+}
+
+// RemoveDataDisk detaches a data disk from the stopped machine, the disks
+// created by macadam are deleted
+func RemoveDataDisk(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, name string) error {
+	mc.Lock()
+	defer mc.Unlock()
+	if err := mc.Refresh(); err != nil {
+		return fmt.Errorf("reload config: %w", err)
+	}
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return err
+	}
+	disk := macadamConfig.DataDisk(name)
+	if disk == nil {
+		return fmt.Errorf("%s: %w", name, ErrDataDiskNotFound)
+	}
+	if err := dataDiskState(mc, mp); err != nil {
+		return err
+	}
+
+	path, owned := disk.Path, disk.Owned
+	macadamConfig.RemoveDataDisk(name)
+	if err := macadamConfig.Write(); err != nil {
+		return err
+	}
+	if err := discardSavedState(macadamConfig); err != nil {
+		return err
+	}
+	if owned {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("deleting data disk %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ownedDataDisks returns the paths of the data disks macadam created for the
+// machine
+func ownedDataDisks(macadamConfig *machineconfig.MachineConfig) []string {
+	var paths []string
+	for _, d := range macadamConfig.DataDisks {
+		if d.Owned {
+			paths = append(paths, d.Path)
+		}
+	}
+	return paths
+}
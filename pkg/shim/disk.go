@@ -0,0 +1,44 @@
+package shim
+
+import (
+	"fmt"
+
+	machineDefine "github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/imagecache"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+)
+
+// getDisk lays down the disk image of a new machine. Images go through the
+// macadam image cache so that machines created from the same image share a
+// single download, decompression and conversion to the disk format of the
+// provider. QEMU disks are qcow2 overlays of the cached image, other
+// providers get a copy of it. WSL distributions are imported from tarballs
+// and are still handled by the provider.
+func getDisk(mp vmconfigs.VMProvider, userInputPath string, opts *imagecache.PullOptions, dirs *machineDefine.MachineDirs, mc *vmconfigs.MachineConfig, macadamConfig *machineconfig.MachineConfig) error {
+	var (
+		entry *imagecache.Entry
+		err   error
+	)
+	cache := imagecache.New(dirs, mp.VMType())
+	switch mp.VMType() {
+	case machineDefine.WSLVirt:
+		if opts.Verify.IsSet() {
+			return fmt.Errorf("image verification is not supported for %s machines", mp.VMType())
+		}
+		if opts.OCI != (imagecache.OCIOptions{}) {
+			return fmt.Errorf("OCI image options are not supported for %s machines", mp.VMType())
+		}
+		return mp.GetDisk(userInputPath, dirs, mc)
+	case machineDefine.QemuVirt:
+		entry, err = cache.GetOverlay(userInputPath, opts, mc.ImagePath)
+	default:
+		entry, err = cache.GetDisk(userInputPath, opts, mc.ImagePath)
+	}
+	if err != nil {
+		return err
+	}
+	macadamConfig.CachedImage = entry.Key
+	macadamConfig.ImageFormat = string(entry.Format)
+	return nil
+}
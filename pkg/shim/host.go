@@ -0,0 +1,957 @@
+package shim
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	ldefine "github.com/containers/podman/v5/libpod/define"
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/containers/podman/v5/pkg/machine/connection"
+	machineDefine "github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/ignition"
+	"github.com/containers/podman/v5/pkg/machine/proxyenv"
+	"github.com/containers/podman/v5/pkg/machine/shim"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/cloudinit"
+	"github.com/crc-org/macadam/pkg/env"
+	"github.com/crc-org/macadam/pkg/imagecache"
+	"github.com/crc-org/macadam/pkg/lock"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/sirupsen/logrus"
+)
+
+// InitOptions are the options used to create a new machine
+type InitOptions struct {
+	machineDefine.InitOptions
+	// Provisioner configures the guest on its first boot, ignition is used
+	// when unset
+	Provisioner machineconfig.Provisioner
+	// SkipPodmanConnection disables the registration of the machine in the
+	// podman system connections
+	SkipPodmanConnection bool
+	// ImagePull alters how the image of the machine is fetched
+	ImagePull imagecache.PullOptions
+	// SocketForwards are the guest sockets forwarded to the host besides
+	// the podman API socket
+	SocketForwards []machineconfig.SocketForward
+}
+
+// List is done at the host level to allow for a *possible* future where
+// more than one provider is used
+func List(vmstubbers []vmconfigs.VMProvider, _ machine.ListOptions) ([]*machine.ListResponse, error) {
+	var (
+		lrs []*machine.ListResponse
+	)
+
+	for _, s := range vmstubbers {
+		dirs, err := env.GetMachineDirs(s.VMType())
+		if err != nil {
+			return nil, err
+		}
+		mcs, err := vmconfigs.LoadMachinesInDir(dirs)
+		if err != nil {
+			return nil, err
+		}
+		for name, mc := range mcs {
+			state, err := s.State(mc, false)
+			if err != nil {
+				return nil, err
+			}
+			lr := machine.ListResponse{
+				Name:               name,
+				CreatedAt:          mc.Created,
+				LastUp:             mc.LastUp,
+				Running:            state == machineDefine.Running,
+				Starting:           mc.Starting,
+				VMType:             s.VMType().String(),
+				CPUs:               mc.Resources.CPUs,
+				Memory:             mc.Resources.Memory,
+				DiskSize:           mc.Resources.DiskSize,
+				Port:               mc.SSH.Port,
+				RemoteUsername:     mc.SSH.RemoteUsername,
+				IdentityPath:       mc.SSH.IdentityPath,
+				UserModeNetworking: s.UserModeNetworkEnabled(mc),
+			}
+			lrs = append(lrs, &lr)
+		}
+	}
+
+	return lrs, nil
+}
+
+// Init creates a new machine. This is podman's shim.Init with support for
+// the macadam specific settings.
+func Init(opts InitOptions, mp vmconfigs.VMProvider) error {
+	var (
+		err            error
+		imageExtension string
+		imagePath      *machineDefine.VMFile
+	)
+
+	if opts.Provisioner == "" {
+		opts.Provisioner = machineconfig.IgnitionProvisioner
+	}
+	if opts.Provisioner == machineconfig.CloudInitProvisioner {
+		if mp.VMType() != machineDefine.QemuVirt {
+			return fmt.Errorf("cloud-init provisioning is not supported for %s machines", mp.VMType())
+		}
+		if len(opts.IgnitionPath) > 0 {
+			return fmt.Errorf("an ignition file cannot be used with %s provisioning", opts.Provisioner)
+		}
+	}
+
+	callbackFuncs := machine.CleanUp()
+	defer callbackFuncs.CleanIfErr(&err)
+	go callbackFuncs.CleanOnSignal()
+
+	dirs, err := env.GetMachineDirs(mp.VMType())
+	if err != nil {
+		return err
+	}
+
+	sshIdentityPath, err := env.GetSSHIdentityPath(machineDefine.DefaultIdentityName)
+	if err != nil {
+		return err
+	}
+	sshKey, err := machine.GetSSHKeys(sshIdentityPath)
+	if err != nil {
+		return err
+	}
+
+	machineLock, err := lock.GetMachineLock(opts.Name, dirs.ConfigDir.GetPath())
+	if err != nil {
+		return err
+	}
+	machineLock.Lock()
+	defer machineLock.Unlock()
+
+	mc, err := newMachineConfig(opts.InitOptions, dirs, sshIdentityPath, mp.VMType())
+	if err != nil {
+		return err
+	}
+	callbackFuncs.Add(func() error {
+		return removeMachineConfig(mc)
+	})
+
+	macadamConfig, err := machineconfig.New(mc)
+	if err != nil {
+		return err
+	}
+	macadamConfig.Provisioner = opts.Provisioner
+	macadamConfig.Image = opts.Image
+	macadamConfig.IgnitionPath = opts.IgnitionPath
+	macadamConfig.TimeZone = opts.TimeZone
+	macadamConfig.SocketForwards = opts.SocketForwards
+
+	createOpts := machineDefine.CreateVMOpts{
+		Name: opts.Name,
+		Dirs: dirs,
+	}
+
+	if umn := opts.UserModeNetworking; umn != nil {
+		createOpts.UserModeNetworking = *umn
+	}
+
+	// New images are named vmname-ARCH. Windows/HyperV will not accept a
+	// disk that is not suffixed as ".vhdx".
+	switch mp.VMType() {
+	case machineDefine.QemuVirt:
+		imageExtension = ".qcow2"
+	case machineDefine.AppleHvVirt:
+		imageExtension = ".raw"
+	case machineDefine.HyperVVirt:
+		imageExtension = ".vhdx"
+	default:
+		// do nothing
+	}
+
+	imagePath, err = dirs.DataDir.AppendToNewVMFile(fmt.Sprintf("%s-%s%s", opts.Name, runtime.GOARCH, imageExtension), nil)
+	if err != nil {
+		return err
+	}
+	mc.ImagePath = imagePath
+
+	// Eventual valid input:
+	// "" <- means take the default
+	// "http|https://path"
+	// "/path
+	// "docker://quay.io/something/someManifest
+	// "oci-dir:/path" or "oci-archive:/path.tar"
+	if err := getDisk(mp, opts.Image, &opts.ImagePull, dirs, mc, macadamConfig); err != nil {
+		return err
+	}
+
+	callbackFuncs.Add(mc.ImagePath.Delete)
+
+	logrus.Debugf("--> imagePath is %q", imagePath.GetPath())
+
+	ignitionFile, err := mc.IgnitionFile()
+	if err != nil {
+		return err
+	}
+
+	uid := os.Getuid()
+	if uid == -1 { // windows compensation
+		uid = 1000
+	}
+
+	userName := opts.Username
+	if mp.VMType() == machineDefine.WSLVirt {
+		if opts.Username == "core" {
+			userName = "user"
+			mc.SSH.RemoteUsername = "user"
+		}
+	}
+
+	ignBuilder := ignition.NewIgnitionBuilder(ignition.DynamicIgnition{
+		Name:      userName,
+		Key:       sshKey,
+		TimeZone:  opts.TimeZone,
+		UID:       uid,
+		VMName:    opts.Name,
+		VMType:    mp.VMType(),
+		WritePath: ignitionFile.GetPath(),
+		Rootful:   opts.Rootful,
+	})
+
+	switch opts.Provisioner {
+	case machineconfig.CloudInitProvisioner:
+		err = prepareCloudInit(mc, macadamConfig, sshKey, opts)
+		if err != nil {
+			return err
+		}
+		callbackFuncs.Add(macadamConfig.CloudInitISO.Delete)
+	default:
+		// If the user provides an ignition file, we need to
+		// copy it into the conf dir
+		if len(opts.IgnitionPath) > 0 {
+			if err := ignBuilder.BuildWithIgnitionFile(opts.IgnitionPath); err != nil {
+				return err
+			}
+			callbackFuncs.Add(ignitionFile.Delete)
+			break
+		}
+
+		err = generateIgnition(mp, mc, &ignBuilder)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Mounts
+	if mp.VMType() != machineDefine.WSLVirt {
+		mc.Mounts = shim.CmdLineVolumesToMounts(opts.Volumes, mp.MountType())
+	}
+
+	// The podman system connections are only useful when the guest runs
+	// podman, they can be skipped altogether
+	if !opts.SkipPodmanConnection && len(opts.IgnitionPath) == 0 {
+		if err := connection.AddSSHConnectionsToPodmanSocket(mc.HostUser.UID, mc.SSH.Port, mc.SSH.IdentityPath, mc.Name, mc.SSH.RemoteUsername, opts.InitOptions); err != nil {
+			return err
+		}
+		macadamConfig.PodmanConnections = []string{mc.Name, mc.Name + "-root"}
+
+		cleanup := func() error {
+			return connection.RemoveConnections(macadamConfig.PodmanConnections...)
+		}
+		callbackFuncs.Add(cleanup)
+	}
+
+	err = mp.CreateVM(createOpts, mc, &ignBuilder)
+	if err != nil {
+		return err
+	}
+
+	// the user provided ignition file was copied as-is
+	if opts.Provisioner == machineconfig.IgnitionProvisioner && len(opts.IgnitionPath) == 0 {
+		err = ignBuilder.Build()
+		if err != nil {
+			return err
+		}
+	}
+
+	macadamConfig.UpdateConnection(mc)
+	err = macadamConfig.Write()
+	if err != nil {
+		return err
+	}
+	callbackFuncs.Add(macadamConfig.Remove)
+
+	return mc.Write()
+}
+
+// generateIgnition generates the ignition config of the machine along with
+// the unit reporting to the host that it booted
+func generateIgnition(mp vmconfigs.VMProvider, mc *vmconfigs.MachineConfig, ignBuilder *ignition.IgnitionBuilder) error {
+	if err := ignBuilder.GenerateIgnitionConfig(); err != nil {
+		return err
+	}
+
+	readyIgnOpts, err := mp.PrepareIgnition(mc, ignBuilder)
+	if err != nil {
+		return err
+	}
+
+	readyUnitFile, err := ignition.CreateReadyUnitFile(mp.VMType(), readyIgnOpts)
+	if err != nil {
+		return err
+	}
+
+	readyUnit := ignition.Unit{
+		Enabled:  ignition.BoolToPtr(true),
+		Name:     "ready.service",
+		Contents: ignition.StrToPtr(readyUnitFile),
+	}
+	ignBuilder.WithUnit(readyUnit)
+	return nil
+}
+
+// prepareCloudInit generates the NoCloud seed ISO used to provision the
+// machine on first boot
+func prepareCloudInit(mc *vmconfigs.MachineConfig, macadamConfig *machineconfig.MachineConfig, sshKey string, opts InitOptions) error {
+	configDir, err := mc.ConfigDir()
+	if err != nil {
+		return err
+	}
+	isoFile, err := configDir.AppendToNewVMFile(mc.Name+"-cidata.iso", nil)
+	if err != nil {
+		return err
+	}
+
+	ci := cloudinit.CloudInit{
+		Name:     opts.Username,
+		Key:      sshKey,
+		TimeZone: opts.TimeZone,
+		VMName:   opts.Name,
+		VMType:   machineDefine.QemuVirt,
+	}
+	if err := ci.GenerateISO(isoFile.GetPath()); err != nil {
+		return err
+	}
+	macadamConfig.CloudInitISO = isoFile
+	return nil
+}
+
+// maxMachineNameSize caps the length of machine names, the paths of the
+// sockets of machines are derived from their name and are limited in size
+const maxMachineNameSize = 30
+
+// ValidateMachineName checks name can be used for a new machine. Names end
+// up in file paths, they must not hold path separators.
+func ValidateMachineName(name string) error {
+	if len(name) > maxMachineNameSize {
+		return fmt.Errorf("machine name %q must be %d characters or less", name, maxMachineNameSize)
+	}
+	if !ldefine.NameRegex.MatchString(name) {
+		return fmt.Errorf("invalid machine name %q: %w", name, ldefine.RegexError)
+	}
+	// The vmtype names need to be reserved and cannot be used for machine names
+	if _, err := machineDefine.ParseVMType(name, machineDefine.UnknownVirt); err == nil {
+		return fmt.Errorf("cannot use %q for a machine name", name)
+	}
+	return nil
+}
+
+// VMExists looks across given providers for a machine's existence.  returns the actual config and found bool
+func VMExists(name string, vmstubbers []vmconfigs.VMProvider) (*vmconfigs.MachineConfig, bool, error) {
+	// Look on disk first
+	mcs, err := getMCsOverProviders(vmstubbers)
+	if err != nil {
+		return nil, false, err
+	}
+	if mc, found := mcs[name]; found {
+		return mc, true, nil
+	}
+	// Check with the provider hypervisor
+	for _, vmstubber := range vmstubbers {
+		exists, err := vmstubber.Exists(name)
+		if err != nil {
+			return nil, false, err
+		}
+		if exists {
+			return nil, true, fmt.Errorf("vm %q already exists on hypervisor", name)
+		}
+	}
+	return nil, false, nil
+}
+
+// checkExclusiveActiveVM checks if any of the machines are already running
+func checkExclusiveActiveVM(provider vmconfigs.VMProvider, mc *vmconfigs.MachineConfig) error {
+	// Check if any other machines are running; if so, we error
+	localMachines, err := getMCsOverProviders([]vmconfigs.VMProvider{provider})
+	if err != nil {
+		return err
+	}
+	for name, localMachine := range localMachines {
+		state, err := provider.State(localMachine, false)
+		if err != nil {
+			return err
+		}
+		if state == machineconfig.Paused && name == mc.Name {
+			return fmt.Errorf("machine %s is paused, use resume to continue it", mc.Name)
+		}
+		if state == machineDefine.Running || state == machineDefine.Starting || state == machineconfig.Paused {
+			return fmt.Errorf("unable to start %q: machine %s: %w", mc.Name, name, machineDefine.ErrVMAlreadyRunning)
+		}
+	}
+	return nil
+}
+
+// getMCsOverProviders loads machineconfigs from a config dir derived from the "provider".  it returns only what is known on
+// disk so things like status may be incomplete or inaccurate
+func getMCsOverProviders(vmstubbers []vmconfigs.VMProvider) (map[string]*vmconfigs.MachineConfig, error) {
+	mcs := make(map[string]*vmconfigs.MachineConfig)
+	for _, stubber := range vmstubbers {
+		dirs, err := env.GetMachineDirs(stubber.VMType())
+		if err != nil {
+			return nil, err
+		}
+		stubberMCs, err := vmconfigs.LoadMachinesInDir(dirs)
+		if err != nil {
+			return nil, err
+		}
+		for mcName, mc := range stubberMCs {
+			if _, ok := mcs[mcName]; !ok {
+				mcs[mcName] = mc
+			}
+		}
+	}
+	return mcs, nil
+}
+
+// Stop stops the machine as well as supporting binaries/processes. It
+// returns how the machine was stopped, which is empty when it was not
+// running or when the provider stopped it on its own terms.
+func Stop(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, dirs *machineDefine.MachineDirs, opts StopOptions) (StopMethod, error) {
+	// state is checked here instead of earlier because stopping a stopped vm is not considered
+	// an error.  so putting in one place instead of sprinkling all over.
+	mc.Lock()
+	defer mc.Unlock()
+	if err := mc.Refresh(); err != nil {
+		return "", fmt.Errorf("reload config: %w", err)
+	}
+
+	return stopMachine(mc, mp, dirs, opts)
+}
+
+// stopLocked stops the machine and expects the caller to hold the machine's lock.
+func stopLocked(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, dirs *machineDefine.MachineDirs, hardStop bool) error {
+	_, err := stopMachine(mc, mp, dirs, StopOptions{Force: hardStop})
+	return err
+}
+
+// stopMachine is stopLocked with support for stop timeouts
+func stopMachine(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, dirs *machineDefine.MachineDirs, opts StopOptions) (StopMethod, error) {
+	state, err := mp.State(mc, false)
+	if err != nil {
+		return "", err
+	}
+	// stopping a stopped machine is NOT an error
+	if state == machineDefine.Stopped {
+		return "", nil
+	}
+	if state == machineconfig.Paused {
+		// the guest has to run to handle the shutdown request
+		p, err := getPauser(mp)
+		if err != nil {
+			return "", err
+		}
+		if err := p.ResumeVM(mc); err != nil {
+			return "", err
+		}
+		state = machineDefine.Running
+	}
+	if state != machineDefine.Running {
+		return "", machineDefine.ErrWrongState
+	}
+
+	// Provider stops the machine, the method is only known when macadam
+	// drives the shutdown
+	var method StopMethod
+	s, graceful := mp.(gracefulStopper)
+	switch {
+	case opts.Force && graceful:
+		// podman's QEMU provider ignores hard stops
+		if err := s.KillVM(mc); err != nil {
+			return "", err
+		}
+		method = StopMethodKill
+	case opts.Timeout > 0 && !opts.Force:
+		s, err := getGracefulStopper(mp)
+		if err != nil {
+			return "", err
+		}
+		if method, err = stopGracefully(mc, s, opts.Timeout); err != nil {
+			return "", err
+		}
+	default:
+		if err := mp.StopVM(mc, opts.Force); err != nil {
+			return "", err
+		}
+	}
+	return method, cleanupStoppedVM(mc, mp, dirs)
+}
+
+// cleanupStoppedVM removes the runtime files of the machine once the
+// provider stopped it and stops gvproxy
+func cleanupStoppedVM(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, dirs *machineDefine.MachineDirs) error {
+	// Remove Ready Socket
+	readySocket, err := mc.ReadySocket()
+	if err != nil {
+		return err
+	}
+	if err := readySocket.Delete(); err != nil {
+		return err
+	}
+
+	// Stop GvProxy and remove PID file
+	if !mp.UseProviderNetworkSetup() {
+		gvproxyPidFile, err := dirs.RuntimeDir.AppendToNewVMFile("gvproxy.pid", nil)
+		if err != nil {
+			return err
+		}
+		if err := machine.CleanupGVProxy(*gvproxyPidFile); err != nil {
+			return fmt.Errorf("unable to clean up gvproxy: %w", err)
+		}
+	}
+
+	// Update last time up
+	mc.LastUp = time.Now()
+	return mc.Write()
+}
+
+// Start starts the machine along with gvproxy and waits for it to be
+// reachable over SSH. A StartError reporting the phase which failed is
+// returned when the machine does not become ready.
+func Start(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, dirs *machineDefine.MachineDirs, opts StartOptions) (err error) {
+	defaultBackoff := 500 * time.Millisecond
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultStartTimeout
+	}
+
+	mc.Lock()
+	defer mc.Unlock()
+	if err := mc.Refresh(); err != nil {
+		return fmt.Errorf("reload config: %w", err)
+	}
+
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return err
+	}
+
+	// Don't check if provider supports parallel running machines
+	if mp.RequireExclusiveActive() {
+		startLock, err := lock.GetMachineStartLock()
+		if err != nil {
+			return err
+		}
+		startLock.Lock()
+		defer startLock.Unlock()
+
+		if err := checkExclusiveActiveVM(mp, mc); err != nil {
+			return err
+		}
+	} else {
+		// still should make sure we do not start the same machine twice
+		state, err := mp.State(mc, false)
+		if err != nil {
+			return err
+		}
+
+		if state == machineDefine.Running || state == machineDefine.Starting {
+			return fmt.Errorf("machine %s: %w", mc.Name, machineDefine.ErrVMAlreadyRunning)
+		}
+		if state == machineconfig.Paused {
+			return fmt.Errorf("machine %s is paused, use resume to continue it", mc.Name)
+		}
+	}
+
+	if opts.Restore && opts.DiscardState {
+		return errors.New("the saved state of a machine cannot be both restored and discarded")
+	}
+	if opts.Restore {
+		if macadamConfig.SavedState == nil {
+			return fmt.Errorf("machine %q has no saved state", mc.Name)
+		}
+		s, err := getSuspender(mp)
+		if err != nil {
+			return err
+		}
+		s.SetRestoreState(macadamConfig.SavedState.Path)
+	} else if macadamConfig.SavedState != nil {
+		if !opts.DiscardState {
+			return fmt.Errorf("machine %q is suspended, start it with --restore to continue it or with --discard-state to boot it and delete its saved state", mc.Name)
+		}
+		// booting changes the disks the saved state depends on
+		logrus.Infof("discarding the saved state of machine %q", mc.Name)
+		if err := discardSavedState(macadamConfig); err != nil {
+			return err
+		}
+	}
+
+	// Set starting to true
+	mc.Starting = true
+	if err := mc.Write(); err != nil {
+		logrus.Error(err)
+	}
+	// Set starting to false on exit
+	defer func() {
+		mc.Starting = false
+		if err := mc.Write(); err != nil {
+			logrus.Error(err)
+		}
+	}()
+
+	gvproxyPidFile, err := dirs.RuntimeDir.AppendToNewVMFile("gvproxy.pid", nil)
+	if err != nil {
+		return err
+	}
+
+	// start gvproxy and set up the API socket forwarding
+	forwardSocketPath, forwardingState, err := startNetworking(mc, mp)
+	if err != nil {
+		return err
+	}
+
+	callBackFuncs := machine.CleanUp()
+	defer callBackFuncs.CleanIfErr(&err)
+	go callBackFuncs.CleanOnSignal()
+
+	// Clean up gvproxy if start fails
+	cleanGV := func() error {
+		return machine.CleanupGVProxy(*gvproxyPidFile)
+	}
+	callBackFuncs.Add(cleanGV)
+
+	if err := applyPortForwards(mc, macadamConfig); err != nil {
+		return err
+	}
+
+	// The start timeout covers everything from the launch of the
+	// hypervisor process to the machine being reachable
+	deadline := time.Now().Add(timeout)
+	if s, ok := mp.(readyTimeoutSetter); ok {
+		s.SetReadyTimeout(timeout)
+	}
+
+	// releaseFunc is if the provider starts a vm using a go command
+	// and we still need control of it while it is booting until the ready
+	// socket is tripped
+	releaseCmd, WaitForReady, err := mp.StartVM(mc)
+	if err != nil {
+		return startPhaseError(mc.Name, StartPhaseLaunch, deadline, err)
+	}
+
+	// Do not leave a half started machine behind
+	callBackFuncs.Add(func() error {
+		return mp.StopVM(mc, true)
+	})
+
+	if WaitForReady == nil {
+		return errors.New("no valid wait function returned")
+	}
+
+	if err := waitWithDeadline(deadline, WaitForReady); err != nil {
+		return startPhaseError(mc.Name, StartPhaseReadySocket, deadline, err)
+	}
+
+	// the guest carries on from its saved state, which is outdated from now
+	if opts.Restore {
+		if err := discardSavedState(macadamConfig); err != nil {
+			return err
+		}
+	}
+
+	if releaseCmd != nil && releaseCmd() != nil { // some providers can return nil here (hyperv)
+		if err := releaseCmd(); err != nil {
+			// I think it is ok for a "light" error?
+			logrus.Error(err)
+		}
+	}
+
+	if !opts.NoInfo && !mc.HostUser.Rootful {
+		machine.PrintRootlessWarning(mc.Name)
+	}
+
+	err = mp.PostStartNetworking(mc, opts.NoInfo)
+	if err != nil {
+		return err
+	}
+
+	stateF := func() (machineDefine.Status, error) {
+		return mp.State(mc, true)
+	}
+
+	connected, sshError, err := conductVMReadinessCheck(mc, deadline, defaultBackoff, stateF)
+	if err != nil {
+		return err
+	}
+
+	if !connected {
+		msg := "machine did not transition into running state"
+		if sshError != nil {
+			msg = fmt.Sprintf("%s: ssh error: %v", msg, sshError)
+		}
+		return startPhaseError(mc.Name, StartPhaseSSH, deadline, errors.New(msg))
+	}
+
+	if opts.Restore {
+		if err := syncGuestClock(mc); err != nil {
+			logrus.Warnf("unable to sync the clock of machine %q: %v", mc.Name, err)
+		}
+	}
+
+	if err := proxyenv.ApplyProxies(mc); err != nil {
+		return err
+	}
+
+	// mount the volumes to the VM, the mounts of restored guests are
+	// restored along with them
+	if !opts.Restore {
+		if err := mp.MountVolumesToVM(mc, opts.Quiet); err != nil {
+			return err
+		}
+	}
+
+	// update the podman/docker socket service if the host user has been modified at all (UID or Rootful)
+	if mc.HostUser.Modified {
+		if machine.UpdatePodmanDockerSockService(mc) == nil {
+			// Reset modification state if there are no errors, otherwise ignore errors
+			// which are already logged
+			mc.HostUser.Modified = false
+			if err := mc.Write(); err != nil {
+				logrus.Error(err)
+			}
+		}
+	}
+
+	// Provider is responsible for waiting
+	if mp.UseProviderNetworkSetup() {
+		return nil
+	}
+
+	// Only the ignition based images are known to run podman, there is no
+	// API to wait for in the other guests
+	if macadamConfig.Provisioner != machineconfig.IgnitionProvisioner {
+		return nil
+	}
+
+	if err := waitAPISocket(forwardSocketPath, deadline, defaultBackoff); err != nil {
+		return startPhaseError(mc.Name, StartPhaseAPISocket, deadline, err)
+	}
+
+	noInfo := opts.NoInfo
+
+	machine.WaitAPIAndPrintInfo(
+		forwardingState,
+		mc.Name,
+		"",
+		forwardSocketPath,
+		noInfo,
+		mc.HostUser.Rootful,
+	)
+
+	return nil
+}
+
+// Set changes the settings of an existing machine. This is podman's
+// shim.Set, the rootful setting is only propagated to the podman system
+// connections when the machine is registered there.
+func Set(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, opts machineDefine.SetOptions) error {
+	mc.Lock()
+	defer mc.Unlock()
+
+	if err := mc.Refresh(); err != nil {
+		return fmt.Errorf("reload config: %w", err)
+	}
+
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return err
+	}
+
+	if opts.CPUs != nil {
+		mc.Resources.CPUs = *opts.CPUs
+	}
+
+	if opts.Memory != nil {
+		mc.Resources.Memory = *opts.Memory
+	}
+
+	if opts.DiskSize != nil {
+		if *opts.DiskSize <= mc.Resources.DiskSize {
+			return fmt.Errorf("new disk size must be larger than %d GB", mc.Resources.DiskSize)
+		}
+		mc.Resources.DiskSize = *opts.DiskSize
+	}
+
+	if opts.Rootful != nil && len(macadamConfig.PodmanConnections) == 0 {
+		state, err := mp.State(mc, false)
+		if err != nil {
+			return err
+		}
+		if state != machineDefine.Stopped {
+			return errors.New("unable to change settings unless vm is stopped")
+		}
+		if mc.HostUser.Rootful != *opts.Rootful {
+			mc.HostUser.Rootful = *opts.Rootful
+			mc.HostUser.Modified = true
+		}
+		opts.Rootful = nil
+	}
+
+	if err := mp.SetProviderAttrs(mc, opts); err != nil {
+		return err
+	}
+
+	// the state of a suspended machine cannot be loaded with other
+	// resources or a resized disk
+	if opts.CPUs != nil || opts.Memory != nil || opts.DiskSize != nil {
+		if err := discardSavedState(macadamConfig); err != nil {
+			return err
+		}
+	}
+
+	// Update the configuration file last if everything earlier worked
+	return mc.Write()
+}
+
+// Remove deletes a machine and its files. This is podman's shim.Remove
+// which also takes care of the macadam specific files.
+func Remove(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, dirs *machineDefine.MachineDirs, opts machine.RemoveOptions) error {
+	mc.Lock()
+	defer mc.Unlock()
+	if err := mc.Refresh(); err != nil {
+		return fmt.Errorf("reload config: %w", err)
+	}
+
+	state, err := mp.State(mc, false)
+	if err != nil {
+		return err
+	}
+
+	running := state == machineDefine.Running || state == machineconfig.Paused
+	if running {
+		if !opts.Force {
+			return &machineDefine.ErrVMRunningCannotDestroyed{Name: mc.Name}
+		}
+	}
+
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return err
+	}
+
+	rmFiles, genericRm, err := machineFiles(mc, opts.SaveIgnition, opts.SaveImage)
+	if err != nil {
+		return err
+	}
+
+	providerFiles, providerRm, err := mp.Remove(mc)
+	if err != nil {
+		return err
+	}
+
+	// Add provider and macadam specific files to the list
+	rmFiles = append(rmFiles, providerFiles...)
+	rmFiles = append(rmFiles, macadamConfig.Path())
+	if macadamConfig.CloudInitISO != nil {
+		rmFiles = append(rmFiles, macadamConfig.CloudInitISO.GetPath())
+	}
+	dataDisks := ownedDataDisks(macadamConfig)
+	rmFiles = append(rmFiles, dataDisks...)
+	if macadamConfig.SavedState != nil {
+		rmFiles = append(rmFiles, macadamConfig.SavedState.Path)
+	}
+	identityFile, err := importedIdentityFile(mc)
+	if err != nil {
+		return err
+	}
+	importedIdentity := mc.SSH.IdentityPath == identityFile.GetPath()
+	if importedIdentity {
+		rmFiles = append(rmFiles, identityFile.GetPath(), identityFile.GetPath()+".pub")
+	}
+
+	// Important!
+	// Nothing can be removed at this point.  The user can still opt out below
+	//
+
+	if !opts.Force {
+		// Warn user
+		confirmationMessage(rmFiles)
+		reader := bufio.NewReader(os.Stdin)
+		fmt.Print("Are you sure you want to continue? [y/N] ")
+		answer, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if strings.ToLower(answer)[0] != 'y' {
+			return nil
+		}
+	}
+
+	if running {
+		if err := stopLocked(mc, mp, dirs, true); err != nil {
+			return err
+		}
+	}
+
+	//
+	// All actual removal of files and vms should occur after this
+	//
+
+	if err := providerRm(); err != nil {
+		logrus.Errorf("failed to remove virtual machine from provider for %q: %v", mc.Name, err)
+	}
+
+	if macadamConfig.CloudInitISO != nil {
+		if err := macadamConfig.CloudInitISO.Delete(); err != nil {
+			logrus.Errorf("failed to remove cloud-init seed ISO for %q: %v", mc.Name, err)
+		}
+	}
+	for _, path := range dataDisks {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.Errorf("failed to remove data disk of %q: %v", mc.Name, err)
+		}
+	}
+	if macadamConfig.SavedState != nil {
+		if err := os.Remove(macadamConfig.SavedState.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.Errorf("failed to remove saved state of %q: %v", mc.Name, err)
+		}
+	}
+	if importedIdentity {
+		for _, path := range []string{identityFile.GetPath(), identityFile.GetPath() + ".pub"} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				logrus.Errorf("failed to remove SSH key of %q: %v", mc.Name, err)
+			}
+		}
+	}
+	if len(macadamConfig.PodmanConnections) > 0 {
+		if err := connection.RemoveConnections(macadamConfig.PodmanConnections...); err != nil {
+			logrus.Errorf("failed to remove podman system connections for %q: %v", mc.Name, err)
+		}
+	}
+	if err := macadamConfig.Remove(); err != nil {
+		logrus.Errorf("failed to remove macadam configuration for %q: %v", mc.Name, err)
+	}
+
+	if err := genericRm(); err != nil {
+		return fmt.Errorf("failed to remove machines files: %v", err)
+	}
+	return nil
+}
+
+func confirmationMessage(files []string) {
+	fmt.Printf("The following files will be deleted:\n\n\n")
+	for _, msg := range files {
+		fmt.Println(msg)
+	}
+}
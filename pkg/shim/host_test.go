@@ -0,0 +1,32 @@
+package shim
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateMachineName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "macadam"},
+		{name: "dev-vm_1.2"},
+		{name: strings.Repeat("a", maxMachineNameSize)},
+		{name: strings.Repeat("a", maxMachineNameSize+1), wantErr: true},
+		{name: "", wantErr: true},
+		{name: "../../x", wantErr: true},
+		{name: "a/b", wantErr: true},
+		{name: "my vm", wantErr: true},
+		{name: ".hidden", wantErr: true},
+		{name: "qemu", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateMachineName(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
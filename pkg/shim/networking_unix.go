@@ -0,0 +1,36 @@
+//go:build dragonfly || freebsd || linux || netbsd || openbsd || darwin
+
+package shim
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+)
+
+// setupMachineSockets returns the machine API socket. Unlike podman, macadam
+// never claims the global docker socket, its machines are only reachable
+// through their own socket.
+func setupMachineSockets(mc *vmconfigs.MachineConfig, _ *define.MachineDirs) ([]string, string, machine.APIForwardingState, error) {
+	hostSocket, err := mc.APISocket()
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return []string{hostSocket.GetPath()}, hostSocket.GetPath(), machine.ClaimUnsupported, nil
+}
+
+func dialAPISocket(ctx context.Context, sock string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", sock)
+}
+
+// isConnRefused reports whether err is a refused connection, which is what
+// dialing a socket nothing listens on returns
+func isConnRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
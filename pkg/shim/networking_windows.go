@@ -0,0 +1,37 @@
+package shim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/Microsoft/go-winio"
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/env"
+	"golang.org/x/sys/windows"
+)
+
+// setupMachineSockets returns the machine API named pipe. Unlike podman,
+// macadam never claims the global docker pipe, its machines are only
+// reachable through their own pipe.
+func setupMachineSockets(mc *vmconfigs.MachineConfig, _ *define.MachineDirs) ([]string, string, machine.APIForwardingState, error) {
+	machinePipe := env.WithMacadamPrefix(mc.Name)
+	if !machine.PipeNameAvailable(machinePipe, machine.MachineNameWait) {
+		return nil, "", 0, fmt.Errorf("could not start api proxy since expected pipe is not available: %s", machinePipe)
+	}
+	sockets := []string{machine.NamedPipePrefix + machinePipe}
+	return sockets, sockets[0], machine.MachineLocal, nil
+}
+
+func dialAPISocket(ctx context.Context, sock string) (net.Conn, error) {
+	return winio.DialPipeContext(ctx, sock)
+}
+
+// isConnRefused reports whether err is a refused connection, which is what
+// dialing a socket nothing listens on returns
+func isConnRefused(err error) bool {
+	return errors.Is(err, windows.WSAECONNREFUSED)
+}
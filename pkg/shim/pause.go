@@ -0,0 +1,88 @@
+package shim
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/containers/podman/v5/pkg/machine"
+	machineDefine "github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/sirupsen/logrus"
+)
+
+// pauser is implemented by the providers which can pause machines
+type pauser interface {
+	PauseVM(mc *vmconfigs.MachineConfig) error
+	ResumeVM(mc *vmconfigs.MachineConfig) error
+}
+
+func getPauser(mp vmconfigs.VMProvider) (pauser, error) {
+	p, ok := mp.(pauser)
+	if !ok {
+		return nil, fmt.Errorf("pausing machines is not supported by the %s provider", mp.VMType())
+	}
+	return p, nil
+}
+
+// Pause freezes the guest of the running machine, its memory is kept and
+// the machine carries on where it left off once resumed
+func Pause(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider) error {
+	p, err := getPauser(mp)
+	if err != nil {
+		return err
+	}
+	mc.Lock()
+	defer mc.Unlock()
+	if err := mc.Refresh(); err != nil {
+		return fmt.Errorf("reload config: %w", err)
+	}
+	state, err := mp.State(mc, false)
+	if err != nil {
+		return err
+	}
+	switch state {
+	case machineconfig.Paused:
+		return fmt.Errorf("machine %q is already paused", mc.Name)
+	case machineDefine.Running:
+	default:
+		return fmt.Errorf("machine %q is not running", mc.Name)
+	}
+	return p.PauseVM(mc)
+}
+
+// Resume continues the guest of the paused machine and resyncs its clock,
+// which lags behind by the time the machine was paused
+func Resume(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider) error {
+	p, err := getPauser(mp)
+	if err != nil {
+		return err
+	}
+	mc.Lock()
+	defer mc.Unlock()
+	if err := mc.Refresh(); err != nil {
+		return fmt.Errorf("reload config: %w", err)
+	}
+	state, err := mp.State(mc, false)
+	if err != nil {
+		return err
+	}
+	if state != machineconfig.Paused {
+		return fmt.Errorf("machine %q is not paused", mc.Name)
+	}
+	if err := p.ResumeVM(mc); err != nil {
+		return err
+	}
+	if err := syncGuestClock(mc); err != nil {
+		logrus.Warnf("unable to sync the clock of machine %q: %v", mc.Name, err)
+	}
+	return nil
+}
+
+// syncGuestClock sets the clock of the guest to the time of the host
+func syncGuestClock(mc *vmconfigs.MachineConfig) error {
+	now := time.Now().UTC()
+	setDate := fmt.Sprintf("@%d.%09d", now.Unix(), now.Nanosecond())
+	logrus.Debugf("setting the clock of machine %q to %s", mc.Name, setDate)
+	return machine.CommonSSHSilent(mc.SSH.RemoteUsername, mc.SSH.IdentityPath, mc.Name, mc.SSH.Port, []string{"sudo", "date", "-u", "--set", setDate})
+}
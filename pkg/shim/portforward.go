@@ -0,0 +1,270 @@
+package shim
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	gvproxy "github.com/containers/gvisor-tap-vsock/pkg/types"
+	machineDefine "github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/sockets"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/crc-org/macadam/pkg/ports"
+	"github.com/sirupsen/logrus"
+)
+
+// guestIP is the address gvproxy leases to the guest
+const guestIP = "192.168.127.2"
+
+var (
+	servicesWaitBackoff        = 100 * time.Millisecond
+	servicesMaxBackoffAttempts = 6
+)
+
+// ErrPortForwardNotFound is returned for forwards the machine does not have
+var ErrPortForwardNotFound = errors.New("no such port forward")
+
+// gvproxyServicesSocket returns the socket gvproxy serves its services API
+// on, which is used to manage the port forwards of running machines
+func gvproxyServicesSocket(mc *vmconfigs.MachineConfig) (*machineDefine.VMFile, error) {
+	runtimeDir, err := mc.RuntimeDir()
+	if err != nil {
+		return nil, err
+	}
+	return runtimeDir.AppendToNewVMFile(mc.Name+"-gvproxy-services.sock", nil)
+}
+
+// gvproxyClient returns a client of the services API gvproxy serves on sock
+func gvproxyClient(sock *machineDefine.VMFile) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", sock.GetPath())
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+}
+
+// gvproxyPost sends the request to the services API of gvproxy
+func gvproxyPost(sock *machineDefine.VMFile, path string, request any) error {
+	b, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := gvproxyClient(sock).Post("http://gvproxy"+path, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("gvproxy %s: %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// gvproxyGet decodes the response of the services API of gvproxy to path
+// into response
+func gvproxyGet(sock *machineDefine.VMFile, path string, response any) error {
+	resp, err := gvproxyClient(sock).Get("http://gvproxy" + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("gvproxy %s: %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+func exposePort(sock *machineDefine.VMFile, fwd machineconfig.PortForward) error {
+	logrus.Debugf("forwarding host port %s", fwd)
+	req := gvproxy.ExposeRequest{
+		Local:    net.JoinHostPort("127.0.0.1", strconv.Itoa(fwd.HostPort)),
+		Remote:   net.JoinHostPort(guestIP, strconv.Itoa(fwd.GuestPort)),
+		Protocol: gvproxy.TransportProtocol(fwd.Protocol),
+	}
+	if err := gvproxyPost(sock, "/services/forwarder/expose", req); err != nil {
+		return fmt.Errorf("forwarding port %s: %w", fwd, err)
+	}
+	return nil
+}
+
+func unexposePort(sock *machineDefine.VMFile, fwd machineconfig.PortForward) error {
+	logrus.Debugf("removing forward of host port %s", fwd)
+	req := gvproxy.UnexposeRequest{
+		Local:    net.JoinHostPort("127.0.0.1", strconv.Itoa(fwd.HostPort)),
+		Protocol: gvproxy.TransportProtocol(fwd.Protocol),
+	}
+	if err := gvproxyPost(sock, "/services/forwarder/unexpose", req); err != nil {
+		return fmt.Errorf("removing forward of port %s: %w", fwd, err)
+	}
+	return nil
+}
+
+// isPortExposed returns whether gvproxy forwards the host port of fwd
+func isPortExposed(sock *machineDefine.VMFile, fwd machineconfig.PortForward) (bool, error) {
+	var exposed []gvproxy.ExposeRequest
+	if err := gvproxyGet(sock, "/services/forwarder/all", &exposed); err != nil {
+		return false, err
+	}
+	local := net.JoinHostPort("127.0.0.1", strconv.Itoa(fwd.HostPort))
+	for _, e := range exposed {
+		if e.Local == local && e.Protocol == gvproxy.TransportProtocol(fwd.Protocol) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// stopPortForward stops the forward of a running machine. Forwards of host
+// ports which were in use when the machine started are not active, they
+// have nothing to stop.
+func stopPortForward(sock *machineDefine.VMFile, fwd machineconfig.PortForward) error {
+	err := unexposePort(sock, fwd)
+	if err == nil {
+		return nil
+	}
+	if exposed, lookupErr := isPortExposed(sock, fwd); lookupErr != nil || exposed {
+		return err
+	}
+	logrus.Warnf("port forward %s was not active: %v", fwd, err)
+	return nil
+}
+
+// isHostPortAvailable checks that nothing listens on the host port of fwd
+func isHostPortAvailable(fwd machineconfig.PortForward) bool {
+	if fwd.Protocol == "udp" {
+		return ports.IsLocalUDPPortAvailable(fwd.HostPort)
+	}
+	return ports.IsLocalPortAvailable(fwd.HostPort)
+}
+
+// portForwardState returns whether the forwards of the machine are active,
+// they cannot be changed while the machine is starting or stopping
+func portForwardState(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider) (bool, error) {
+	if mp.UseProviderNetworkSetup() {
+		return false, fmt.Errorf("port forwards are not supported by the %s provider", mp.VMType())
+	}
+	state, err := mp.State(mc, false)
+	if err != nil {
+		return false, err
+	}
+	switch state {
+	case machineDefine.Running, machineconfig.Paused:
+		return true, nil
+	case machineDefine.Stopped:
+		return false, nil
+	}
+	return false, machineDefine.ErrWrongState
+}
+
+// AddPortForward forwards a host port to the guest and records the forward
+// in the machine configuration so that it is applied on every start. The
+// forward is applied right away to running machines.
+func AddPortForward(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, fwd machineconfig.PortForward) error {
+	mc.Lock()
+	defer mc.Unlock()
+	if err := mc.Refresh(); err != nil {
+		return fmt.Errorf("reload config: %w", err)
+	}
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return err
+	}
+	if macadamConfig.PortForward(fwd.HostPort, fwd.Protocol) != nil {
+		return fmt.Errorf("host port %d/%s is already forwarded to machine %q", fwd.HostPort, fwd.Protocol, mc.Name)
+	}
+	if fwd.HostPort == mc.SSH.Port && fwd.Protocol == "tcp" {
+		return fmt.Errorf("host port %d is the SSH port of machine %q", fwd.HostPort, mc.Name)
+	}
+	running, err := portForwardState(mc, mp)
+	if err != nil {
+		return err
+	}
+	if !isHostPortAvailable(fwd) {
+		return fmt.Errorf("host port %d/%s is already in use", fwd.HostPort, fwd.Protocol)
+	}
+
+	if running {
+		sock, err := gvproxyServicesSocket(mc)
+		if err != nil {
+			return err
+		}
+		if err := exposePort(sock, fwd); err != nil {
+			return err
+		}
+	}
+	macadamConfig.PortForwards = append(macadamConfig.PortForwards, fwd)
+	return macadamConfig.Write()
+}
+
+// RemovePortForward removes the forward of the host port with the given
+// protocol, the forward is stopped right away on running machines
+func RemovePortForward(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, hostPort int, protocol string) error {
+	mc.Lock()
+	defer mc.Unlock()
+	if err := mc.Refresh(); err != nil {
+		return fmt.Errorf("reload config: %w", err)
+	}
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return err
+	}
+	fwd := macadamConfig.PortForward(hostPort, protocol)
+	if fwd == nil {
+		return fmt.Errorf("%d/%s: %w", hostPort, protocol, ErrPortForwardNotFound)
+	}
+	running, err := portForwardState(mc, mp)
+	if err != nil {
+		return err
+	}
+
+	if running {
+		sock, err := gvproxyServicesSocket(mc)
+		if err != nil {
+			return err
+		}
+		if err := stopPortForward(sock, *fwd); err != nil {
+			return err
+		}
+	}
+	macadamConfig.RemovePortForward(hostPort, protocol)
+	return macadamConfig.Write()
+}
+
+// applyPortForwards sets up the port forwards of the machine once gvproxy
+// started, the forwards of host ports which are in use are skipped
+func applyPortForwards(mc *vmconfigs.MachineConfig, macadamConfig *machineconfig.MachineConfig) error {
+	if len(macadamConfig.PortForwards) == 0 {
+		return nil
+	}
+	sock, err := gvproxyServicesSocket(mc)
+	if err != nil {
+		return err
+	}
+	if err := sockets.WaitForSocketWithBackoffs(servicesMaxBackoffAttempts, servicesWaitBackoff, sock.GetPath(), "gvproxy services"); err != nil {
+		return err
+	}
+	for _, fwd := range macadamConfig.PortForwards {
+		if !isHostPortAvailable(fwd) {
+			logrus.Warnf("host port %d/%s is already in use, not forwarding it to machine %q", fwd.HostPort, fwd.Protocol, mc.Name)
+			continue
+		}
+		if err := exposePort(sock, fwd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
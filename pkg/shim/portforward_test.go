@@ -0,0 +1,67 @@
+//go:build !windows
+
+package shim
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	gvproxy "github.com/containers/gvisor-tap-vsock/pkg/types"
+	machineDefine "github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+)
+
+func TestStopPortForward(t *testing.T) {
+	tests := []struct {
+		name     string
+		exposed  []gvproxy.ExposeRequest
+		unexpose int
+		listAll  int
+		wantErr  bool
+	}{
+		{name: "active", exposed: []gvproxy.ExposeRequest{{Local: "127.0.0.1:8080", Protocol: "tcp"}}, unexpose: http.StatusOK, listAll: http.StatusOK},
+		{name: "inactive", unexpose: http.StatusInternalServerError, listAll: http.StatusOK},
+		{name: "other protocol active", exposed: []gvproxy.ExposeRequest{{Local: "127.0.0.1:8080", Protocol: "udp"}}, unexpose: http.StatusInternalServerError, listAll: http.StatusOK},
+		{name: "active and failing", exposed: []gvproxy.ExposeRequest{{Local: "127.0.0.1:8080", Protocol: "tcp"}}, unexpose: http.StatusInternalServerError, listAll: http.StatusOK, wantErr: true},
+		{name: "unknown state", unexpose: http.StatusInternalServerError, listAll: http.StatusInternalServerError, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "gvproxy.sock")
+			l, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mux := http.NewServeMux()
+			mux.HandleFunc("/services/forwarder/unexpose", func(w http.ResponseWriter, _ *http.Request) {
+				if tt.unexpose != http.StatusOK {
+					http.Error(w, "proxy not found", tt.unexpose)
+				}
+			})
+			mux.HandleFunc("/services/forwarder/all", func(w http.ResponseWriter, _ *http.Request) {
+				if tt.listAll != http.StatusOK {
+					http.Error(w, "internal error", tt.listAll)
+					return
+				}
+				_ = json.NewEncoder(w).Encode(append([]gvproxy.ExposeRequest{}, tt.exposed...))
+			})
+			server := httptest.NewUnstartedServer(mux)
+			server.Listener = l
+			server.Start()
+			defer server.Close()
+
+			sock, err := machineDefine.NewMachineFile(path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = stopPortForward(sock, machineconfig.PortForward{HostPort: 8080, GuestPort: 80, Protocol: "tcp"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
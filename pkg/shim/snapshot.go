@@ -0,0 +1,185 @@
+package shim
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/containers/common/pkg/strongunits"
+	machineDefine "github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/sirupsen/logrus"
+)
+
+// snapshotter is implemented by the providers which support internal
+// snapshots of the machine disk. Running machines are snapshotted along with
+// their memory and device state.
+type snapshotter interface {
+	CreateSnapshot(mc *vmconfigs.MachineConfig, name string, running bool) (*machineconfig.Snapshot, error)
+	RestoreSnapshot(mc *vmconfigs.MachineConfig, snapshot *machineconfig.Snapshot, running bool) error
+	DeleteSnapshot(mc *vmconfigs.MachineConfig, name string, running bool) error
+}
+
+// snapshotNameRegex matches the valid snapshot names, names made of digits
+// only are refused as QEMU would take them for snapshot IDs
+var (
+	snapshotNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+	snapshotIDRegex   = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// ErrSnapshotNotFound is returned for snapshots the machine does not have
+var ErrSnapshotNotFound = errors.New("no such snapshot")
+
+func validateSnapshotName(name string) error {
+	if !snapshotNameRegex.MatchString(name) || snapshotIDRegex.MatchString(name) {
+		return fmt.Errorf("invalid snapshot name %q: names must match %s and not be a number", name, snapshotNameRegex)
+	}
+	return nil
+}
+
+func getSnapshotter(mp vmconfigs.VMProvider) (snapshotter, error) {
+	s, ok := mp.(snapshotter)
+	if !ok {
+		return nil, fmt.Errorf("snapshots are not supported by the %s provider", mp.VMType())
+	}
+	return s, nil
+}
+
+// snapshotState returns whether the machine is running, snapshots cannot be
+// managed while it is starting or stopping
+func snapshotState(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider) (bool, error) {
+	state, err := mp.State(mc, false)
+	if err != nil {
+		return false, err
+	}
+	switch state {
+	case machineDefine.Running, machineconfig.Paused:
+		return true, nil
+	case machineDefine.Stopped:
+		return false, nil
+	}
+	return false, machineDefine.ErrWrongState
+}
+
+// CreateSnapshot takes a snapshot of the machine, stopped or running, and
+// records it in the machine configuration
+func CreateSnapshot(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, name string) (*machineconfig.Snapshot, error) {
+	s, err := getSnapshotter(mp)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSnapshotName(name); err != nil {
+		return nil, err
+	}
+
+	mc.Lock()
+	defer mc.Unlock()
+	if err := mc.Refresh(); err != nil {
+		return nil, fmt.Errorf("reload config: %w", err)
+	}
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return nil, err
+	}
+	if macadamConfig.Snapshot(name) != nil {
+		return nil, fmt.Errorf("machine %q already has a snapshot named %q", mc.Name, name)
+	}
+	running, err := snapshotState(mc, mp)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := s.CreateSnapshot(mc, name, running)
+	if err != nil {
+		return nil, err
+	}
+	macadamConfig.Snapshots = append(macadamConfig.Snapshots, *snapshot)
+	if err := macadamConfig.Write(); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// RestoreSnapshot reverts the machine to a snapshot. Running machines are
+// only restored when force is set: snapshots taken while the machine was
+// running are restored live, the machine is stopped first otherwise.
+func RestoreSnapshot(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, dirs *machineDefine.MachineDirs, name string, force bool) error {
+	s, err := getSnapshotter(mp)
+	if err != nil {
+		return err
+	}
+
+	mc.Lock()
+	defer mc.Unlock()
+	if err := mc.Refresh(); err != nil {
+		return fmt.Errorf("reload config: %w", err)
+	}
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return err
+	}
+	snapshot := macadamConfig.Snapshot(name)
+	if snapshot == nil {
+		return fmt.Errorf("%s: %w", name, ErrSnapshotNotFound)
+	}
+	running, err := snapshotState(mc, mp)
+	if err != nil {
+		return err
+	}
+	if running && !force {
+		return fmt.Errorf("machine %q is running, stop it first or use --force", mc.Name)
+	}
+	if running && snapshot.VMStateSize == 0 {
+		logrus.Infof("snapshot %q has no saved VM state, stopping machine %q", name, mc.Name)
+		if err := stopLocked(mc, mp, dirs, true); err != nil {
+			return err
+		}
+		running = false
+	}
+
+	if err := s.RestoreSnapshot(mc, snapshot, running); err != nil {
+		return err
+	}
+	// the state of a suspended machine does not match the restored disk
+	if err := discardSavedState(macadamConfig); err != nil {
+		return err
+	}
+	// the disk is back to its size when the snapshot was taken
+	if snapshot.DiskSize > 0 {
+		mc.Resources.DiskSize = strongunits.ToGiB(strongunits.B(snapshot.DiskSize))
+		return mc.Write()
+	}
+	return nil
+}
+
+// DeleteSnapshot deletes a snapshot of the machine
+func DeleteSnapshot(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, name string) error {
+	s, err := getSnapshotter(mp)
+	if err != nil {
+		return err
+	}
+
+	mc.Lock()
+	defer mc.Unlock()
+	if err := mc.Refresh(); err != nil {
+		return fmt.Errorf("reload config: %w", err)
+	}
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return err
+	}
+	if macadamConfig.Snapshot(name) == nil {
+		return fmt.Errorf("%s: %w", name, ErrSnapshotNotFound)
+	}
+	running, err := snapshotState(mc, mp)
+	if err != nil {
+		return err
+	}
+
+	if err := s.DeleteSnapshot(mc, name, running); err != nil {
+		return err
+	}
+	macadamConfig.RemoveSnapshot(name)
+	return macadamConfig.Write()
+}
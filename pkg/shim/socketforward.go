@@ -0,0 +1,169 @@
+package shim
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	gvproxy "github.com/containers/gvisor-tap-vsock/pkg/types"
+	machineDefine "github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/crc-org/macadam/pkg/ports"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrSocketForwardNotFound is returned for socket forwards the machine does
+// not have
+var ErrSocketForwardNotFound = errors.New("no such socket forward")
+
+// socketForwardState returns whether the machine is running, socket forwards
+// are set up by gvproxy on start so changes only apply on the next start
+func socketForwardState(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider) (bool, error) {
+	if mp.UseProviderNetworkSetup() {
+		return false, fmt.Errorf("socket forwards are not supported by the %s provider", mp.VMType())
+	}
+	state, err := mp.State(mc, false)
+	if err != nil {
+		return false, err
+	}
+	return state != machineDefine.Stopped, nil
+}
+
+// checkSocketForwardHost checks that the host end of fwd can be listened on.
+// Existing files are only replaced when they are stale sockets, which
+// nothing listens on anymore.
+func checkSocketForwardHost(fwd machineconfig.SocketForward) error {
+	if addr := fwd.TCPAddress(); addr != "" {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return err
+		}
+		if !ports.IsLocalPortAvailable(p) {
+			return fmt.Errorf("host port %d is already in use", p)
+		}
+		return nil
+	}
+	fi, err := os.Lstat(fwd.Host)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", fwd.Host)
+	}
+	conn, err := net.DialTimeout("unix", fwd.Host, time.Second)
+	if err == nil {
+		if err := conn.Close(); err != nil {
+			logrus.Error(err)
+		}
+		return fmt.Errorf("socket %s is already in use", fwd.Host)
+	}
+	if !isConnRefused(err) {
+		return fmt.Errorf("checking whether socket %s is in use: %w", fwd.Host, err)
+	}
+	return nil
+}
+
+// AddSocketForward records a guest socket forward in the machine
+// configuration. It returns whether the machine is running, in which case
+// the forward is only set up on the next start.
+func AddSocketForward(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, fwd machineconfig.SocketForward) (bool, error) {
+	mc.Lock()
+	defer mc.Unlock()
+	if err := mc.Refresh(); err != nil {
+		return false, fmt.Errorf("reload config: %w", err)
+	}
+	running, err := socketForwardState(mc, mp)
+	if err != nil {
+		return false, err
+	}
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return false, err
+	}
+	if existing := macadamConfig.SocketForward(fwd.Host); existing != nil {
+		return false, fmt.Errorf("%s is already forwarded from %s of machine %q", fwd.Host, existing.Guest, mc.Name)
+	}
+	apiSocket, err := mc.APISocket()
+	if err != nil {
+		return false, err
+	}
+	if fwd.Host == apiSocket.GetPath() {
+		return false, fmt.Errorf("%s is the API socket of machine %q", fwd.Host, mc.Name)
+	}
+	if !running {
+		if err := checkSocketForwardHost(fwd); err != nil {
+			return false, err
+		}
+	}
+
+	macadamConfig.SocketForwards = append(macadamConfig.SocketForwards, fwd)
+	return running, macadamConfig.Write()
+}
+
+// RemoveSocketForward removes the forward to the given host socket or
+// address. It returns whether the machine is running, in which case the
+// forward is only removed on the next start.
+func RemoveSocketForward(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, host string) (bool, error) {
+	mc.Lock()
+	defer mc.Unlock()
+	if err := mc.Refresh(); err != nil {
+		return false, fmt.Errorf("reload config: %w", err)
+	}
+	running, err := socketForwardState(mc, mp)
+	if err != nil {
+		return false, err
+	}
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return false, err
+	}
+	if macadamConfig.SocketForward(host) == nil {
+		return false, fmt.Errorf("%s: %w", host, ErrSocketForwardNotFound)
+	}
+
+	macadamConfig.RemoveSocketForward(host)
+	return running, macadamConfig.Write()
+}
+
+// addSocketForwards adds the socket forwards of the machine to the gvproxy
+// command line, forwards whose host end is in use are skipped
+func addSocketForwards(cmd *gvproxy.GvproxyCommand, mc *vmconfigs.MachineConfig) error {
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return err
+	}
+	for _, fwd := range macadamConfig.SocketForwards {
+		if err := checkSocketForwardHost(fwd); err != nil {
+			logrus.Warnf("not forwarding %s of machine %q: %v", fwd.Guest, mc.Name, err)
+			continue
+		}
+		if fwd.TCPAddress() == "" {
+			// the stale socket of a previous run, checkSocketForwardHost
+			// made sure nothing listens on it
+			if err := os.Remove(fwd.Host); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		user := fwd.User
+		if user == "" {
+			user = mc.SSH.RemoteUsername
+		}
+		logrus.Debugf("forwarding guest socket %s to %s as %s", fwd.Guest, fwd.Host, user)
+		cmd.AddForwardSock(fwd.Host)
+		cmd.AddForwardDest(fwd.Guest)
+		cmd.AddForwardUser(user)
+		cmd.AddForwardIdentity(mc.SSH.IdentityPath)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+//go:build !windows
+
+package shim
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/crc-org/macadam/pkg/machineconfig"
+)
+
+func TestCheckSocketForwardHost(t *testing.T) {
+	dir := t.TempDir()
+
+	listening := filepath.Join(dir, "listening.sock")
+	l, err := net.Listen("unix", listening)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// a socket left behind by a process which exited
+	stale := filepath.Join(dir, "stale.sock")
+	sl, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := sl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		host    string
+		wantErr bool
+	}{
+		{name: "missing", host: filepath.Join(dir, "missing.sock")},
+		{name: "stale socket", host: stale},
+		{name: "socket in use", host: listening, wantErr: true},
+		{name: "regular file", host: file, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSocketForwardHost(machineconfig.SocketForward{Guest: "/run/test.sock", Host: tt.host})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package shim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultStartTimeout is the time given to a machine to be ready when no
+// timeout is set in the start options
+const DefaultStartTimeout = 5 * time.Minute
+
+const (
+	// maxReadinessBackoff caps the wait between two readiness checks
+	maxReadinessBackoff = 5 * time.Second
+	apiPingTimeout      = 2 * time.Second
+)
+
+// StartOptions are the options used to start a machine
+type StartOptions struct {
+	machine.StartOptions
+	// Timeout bounds the time spent waiting for the machine to be ready,
+	// DefaultStartTimeout is used when unset
+	Timeout time.Duration
+	// Restore continues the suspended machine from its saved state instead
+	// of booting it
+	Restore bool
+	// DiscardState boots the suspended machine, deleting its saved state
+	DiscardState bool
+}
+
+// StartPhase is a step of the start of a machine
+type StartPhase string
+
+const (
+	// StartPhaseLaunch is the launch of the hypervisor process
+	StartPhaseLaunch StartPhase = "vm-launch"
+	// StartPhaseReadySocket is the wait for the guest to report it booted
+	// on the ready socket
+	StartPhaseReadySocket StartPhase = "ready-socket"
+	// StartPhaseSSH is the wait for the guest SSH server to accept
+	// connections
+	StartPhaseSSH StartPhase = "ssh-handshake"
+	// StartPhaseAPISocket is the wait for the podman API of the guest to
+	// answer on the forwarded API socket
+	StartPhaseAPISocket StartPhase = "api-socket"
+)
+
+// ErrStartTimeout is wrapped by a StartError when the phase did not
+// complete before the start timeout
+var ErrStartTimeout = errors.New("timed out")
+
+// StartError is returned when a machine fails to start, it reports the
+// phase of the start which failed
+type StartError struct {
+	Name  string
+	Phase StartPhase
+	Err   error
+}
+
+func (e *StartError) Error() string {
+	return fmt.Sprintf("machine %q failed to start during the %s phase: %v", e.Name, e.Phase, e.Err)
+}
+
+func (e *StartError) Unwrap() error {
+	return e.Err
+}
+
+// TimedOut returns true if the phase did not complete in time
+func (e *StartError) TimedOut() bool {
+	return errors.Is(e.Err, ErrStartTimeout)
+}
+
+// readyTimeoutSetter is implemented by the providers which can bound the
+// wait on the ready socket of the machine
+type readyTimeoutSetter interface {
+	SetReadyTimeout(timeout time.Duration)
+}
+
+// startPhaseError wraps err in a StartError, err is reported as a timeout
+// when the deadline has passed
+func startPhaseError(name string, phase StartPhase, deadline time.Time, err error) error {
+	if time.Now().After(deadline) && !errors.Is(err, ErrStartTimeout) {
+		err = fmt.Errorf("%w: %v", ErrStartTimeout, err)
+	}
+	return &StartError{Name: name, Phase: phase, Err: err}
+}
+
+// waitWithDeadline runs f and gives up when it does not return before
+// deadline
+func waitWithDeadline(deadline time.Time, f func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- f()
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case err := <-errCh:
+		return err
+	case <-timer.C:
+		return ErrStartTimeout
+	}
+}
+
+// waitAPISocket pings the podman API behind sock until it answers or the
+// deadline passes
+func waitAPISocket(sock string, deadline time.Time, backoff time.Duration) error {
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialAPISocket(ctx, sock)
+			},
+		},
+		Timeout: apiPingTimeout,
+	}
+
+	for {
+		resp, err := client.Get("http://host/_ping")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+			err = fmt.Errorf("unexpected API ping status: %s", resp.Status)
+		}
+		logrus.Debugf("API socket readiness check failed: %v", err)
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("%w: %v", ErrStartTimeout, err)
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxReadinessBackoff)
+	}
+}
@@ -0,0 +1,91 @@
+package shim
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/containers/podman/v5/pkg/machine"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/sirupsen/logrus"
+)
+
+// StopOptions are the options used to stop a machine
+type StopOptions struct {
+	// Force stops the machine without waiting for a graceful shutdown
+	Force bool
+	// Timeout bounds the wait for the guest to shut down, first after an
+	// ACPI powerdown request then after a poweroff over SSH, before the
+	// machine is killed. The guest is waited for indefinitely when unset.
+	Timeout time.Duration
+}
+
+// StopMethod is the way a machine was stopped
+type StopMethod string
+
+const (
+	// StopMethodACPI is a shutdown of the guest on an ACPI powerdown
+	// request
+	StopMethodACPI StopMethod = "ACPI powerdown"
+	// StopMethodSSH is a shutdown of the guest on systemctl poweroff run
+	// over SSH
+	StopMethodSSH StopMethod = "poweroff over SSH"
+	// StopMethodKill is the kill of the hypervisor process, the guest did
+	// not shut down
+	StopMethodKill StopMethod = "SIGKILL"
+)
+
+// gracefulStopper is implemented by the providers which can stop machines
+// step by step
+type gracefulStopper interface {
+	PowerdownVM(mc *vmconfigs.MachineConfig) error
+	WaitVMStopped(mc *vmconfigs.MachineConfig, timeout time.Duration) (bool, error)
+	KillVM(mc *vmconfigs.MachineConfig) error
+}
+
+func getGracefulStopper(mp vmconfigs.VMProvider) (gracefulStopper, error) {
+	s, ok := mp.(gracefulStopper)
+	if !ok {
+		return nil, fmt.Errorf("stop timeouts are not supported by the %s provider", mp.VMType())
+	}
+	return s, nil
+}
+
+// stopGracefully gives the guest timeout to shut down and kills the machine
+// when it is still running. Half of the timeout is given to an ACPI powerdown
+// request, the rest to a poweroff over SSH.
+func stopGracefully(mc *vmconfigs.MachineConfig, s gracefulStopper, timeout time.Duration) (StopMethod, error) {
+	deadline := time.Now().Add(timeout)
+	if err := s.PowerdownVM(mc); err != nil {
+		logrus.Warnf("unable to request ACPI powerdown of machine %q: %v", mc.Name, err)
+	} else {
+		stopped, err := s.WaitVMStopped(mc, timeout/2)
+		if err != nil {
+			return "", err
+		}
+		if stopped {
+			return StopMethodACPI, nil
+		}
+	}
+
+	logrus.Infof("machine %q did not shut down after ACPI powerdown, running poweroff over SSH", mc.Name)
+	err := waitWithDeadline(deadline, func() error {
+		return machine.CommonSSHSilent(mc.SSH.RemoteUsername, mc.SSH.IdentityPath, mc.Name, mc.SSH.Port, []string{"sudo", "systemctl", "poweroff"})
+	})
+	if err != nil {
+		// the shutdown may close the connection before the command returns
+		logrus.Debugf("poweroff of machine %q over SSH: %v", mc.Name, err)
+	}
+	stopped, err := s.WaitVMStopped(mc, time.Until(deadline))
+	if err != nil {
+		return "", err
+	}
+	if stopped {
+		return StopMethodSSH, nil
+	}
+
+	logrus.Warnf("machine %q did not shut down in time, killing it", mc.Name)
+	if err := s.KillVM(mc); err != nil {
+		return "", err
+	}
+	return StopMethodKill, nil
+}
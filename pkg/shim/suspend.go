@@ -0,0 +1,99 @@
+package shim
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	machineDefine "github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/sirupsen/logrus"
+)
+
+// suspender is implemented by the providers which can save the state of
+// machines to a file and start them from it
+type suspender interface {
+	SuspendVM(mc *vmconfigs.MachineConfig, path string) error
+	SetRestoreState(path string)
+}
+
+func getSuspender(mp vmconfigs.VMProvider) (suspender, error) {
+	s, ok := mp.(suspender)
+	if !ok {
+		return nil, fmt.Errorf("suspending machines is not supported by the %s provider", mp.VMType())
+	}
+	return s, nil
+}
+
+// savedStateFile returns the file the state of the suspended machine is
+// saved to
+func savedStateFile(mc *vmconfigs.MachineConfig) (*machineDefine.VMFile, error) {
+	dataDir, err := mc.DataDir()
+	if err != nil {
+		return nil, err
+	}
+	return dataDir.AppendToNewVMFile(mc.Name+"-state", nil)
+}
+
+// Suspend saves the memory and device state of the running or paused
+// machine to a file in its data directory and stops it. The machine is
+// continued from the saved state by a start with the Restore option.
+func Suspend(mc *vmconfigs.MachineConfig, mp vmconfigs.VMProvider, dirs *machineDefine.MachineDirs) error {
+	s, err := getSuspender(mp)
+	if err != nil {
+		return err
+	}
+	mc.Lock()
+	defer mc.Unlock()
+	if err := mc.Refresh(); err != nil {
+		return fmt.Errorf("reload config: %w", err)
+	}
+	state, err := mp.State(mc, false)
+	if err != nil {
+		return err
+	}
+	if state != machineDefine.Running && state != machineconfig.Paused {
+		return fmt.Errorf("machine %q is not running", mc.Name)
+	}
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		return err
+	}
+
+	stateFile, err := savedStateFile(mc)
+	if err != nil {
+		return err
+	}
+	if err := stateFile.Delete(); err != nil {
+		return err
+	}
+	if err := s.SuspendVM(mc, stateFile.GetPath()); err != nil {
+		if err := stateFile.Delete(); err != nil {
+			logrus.Errorf("removing partial saved state: %v", err)
+		}
+		return fmt.Errorf("suspending machine %q: %w", mc.Name, err)
+	}
+	macadamConfig.SavedState = &machineconfig.SavedState{
+		Path:    stateFile.GetPath(),
+		Created: time.Now(),
+	}
+	if err := macadamConfig.Write(); err != nil {
+		return err
+	}
+	return cleanupStoppedVM(mc, mp, dirs)
+}
+
+// discardSavedState deletes the saved state of the machine, which no longer
+// matches its disks
+func discardSavedState(macadamConfig *machineconfig.MachineConfig) error {
+	if macadamConfig.SavedState == nil {
+		return nil
+	}
+	if err := os.Remove(macadamConfig.SavedState.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	macadamConfig.SavedState = nil
+	return macadamConfig.Write()
+}
@@ -0,0 +1,205 @@
+package spec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/containers/common/pkg/config"
+	"github.com/containers/common/pkg/strongunits"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/imagecache"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/crc-org/macadam/pkg/shim"
+	"gopkg.in/yaml.v3"
+)
+
+// MachineSpec is the declarative description of a machine. Unset fields
+// take the containers.conf defaults when the machine is created and are left
+// untouched when an existing machine is reconciled.
+type MachineSpec struct {
+	Name                 string   `yaml:"name"`
+	CPUs                 *uint64  `yaml:"cpus"`
+	Memory               *uint64  `yaml:"memory"`
+	DiskSize             *uint64  `yaml:"diskSize"`
+	Image                *string  `yaml:"image"`
+	Volumes              []string `yaml:"volumes"`
+	Username             *string  `yaml:"username"`
+	Rootful              *bool    `yaml:"rootful"`
+	USBs                 []string `yaml:"usbs"`
+	UserModeNetworking   *bool    `yaml:"userModeNetworking"`
+	IgnitionPath         *string  `yaml:"ignitionPath"`
+	TimeZone             *string  `yaml:"timezone"`
+	Provisioner          *string  `yaml:"provisioner"`
+	SkipPodmanConnection *bool    `yaml:"skipPodmanConnection"`
+}
+
+// Load reads a YAML or JSON machine spec file, "-" reads it from stdin
+func Load(path string) (*MachineSpec, error) {
+	var (
+		b   []byte
+		err error
+	)
+	if path == "-" {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// YAML being a superset of JSON, both are handled by the YAML decoder
+	s := new(MachineSpec)
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(s); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unable to parse machine spec %q: %w", path, err)
+	}
+	if s.Provisioner != nil {
+		if _, err := machineconfig.ParseProvisioner(*s.Provisioner); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// InitOptions returns the options creating the machine described by the
+// spec, unset fields take their default from cfg
+func (s *MachineSpec) InitOptions(cfg *config.Config) shim.InitOptions {
+	opts := shim.InitOptions{}
+	opts.Name = s.Name
+	opts.CPUS = valueOr(s.CPUs, cfg.Machine.CPUs)
+	opts.Memory = valueOr(s.Memory, cfg.Machine.Memory)
+	opts.DiskSize = valueOr(s.DiskSize, cfg.Machine.DiskSize)
+	opts.Image = valueOr(s.Image, cfg.Machine.Image)
+	opts.Username = valueOr(s.Username, cfg.Machine.User)
+	opts.Rootful = valueOr(s.Rootful, false)
+	opts.IgnitionPath = valueOr(s.IgnitionPath, "")
+	opts.UserModeNetworking = s.UserModeNetworking
+	opts.USBs = s.USBs
+	opts.Volumes = s.Volumes
+	if opts.Volumes == nil {
+		opts.Volumes = cfg.Machine.Volumes.Get()
+	}
+	defaultTz := cfg.TZ()
+	if len(defaultTz) < 1 {
+		defaultTz = "local"
+	}
+	opts.TimeZone = valueOr(s.TimeZone, defaultTz)
+	opts.Provisioner = machineconfig.Provisioner(valueOr(s.Provisioner, string(machineconfig.IgnitionProvisioner)))
+	opts.SkipPodmanConnection = valueOr(s.SkipPodmanConnection, false)
+	opts.ImagePull.Retries = imagecache.DefaultRetries
+	return opts
+}
+
+// FieldChange is a difference between the spec and an existing machine
+type FieldChange struct {
+	Field   string
+	Current string
+	Desired string
+}
+
+func (c FieldChange) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Field, c.Current, c.Desired)
+}
+
+// Diff compares the spec with an existing machine. It returns the options
+// reconciling the fields which can be changed in place along with those
+// changes, and the changes which require the machine to be recreated.
+func (s *MachineSpec) Diff(mc *vmconfigs.MachineConfig, macadamConfig *machineconfig.MachineConfig, mp vmconfigs.VMProvider) (define.SetOptions, []FieldChange, []FieldChange) {
+	var (
+		setOpts  define.SetOptions
+		changes  []FieldChange
+		recreate []FieldChange
+	)
+
+	if s.CPUs != nil && *s.CPUs != mc.Resources.CPUs {
+		setOpts.CPUs = s.CPUs
+		changes = append(changes, newChange("cpus", mc.Resources.CPUs, *s.CPUs))
+	}
+	if s.Memory != nil && strongunits.MiB(*s.Memory) != mc.Resources.Memory {
+		memory := strongunits.MiB(*s.Memory)
+		setOpts.Memory = &memory
+		changes = append(changes, newChange("memory", mc.Resources.Memory, memory))
+	}
+	if s.DiskSize != nil && strongunits.GiB(*s.DiskSize) != mc.Resources.DiskSize {
+		diskSize := strongunits.GiB(*s.DiskSize)
+		change := newChange("diskSize", mc.Resources.DiskSize, diskSize)
+		// disks can only grow
+		if diskSize > mc.Resources.DiskSize {
+			setOpts.DiskSize = &diskSize
+			changes = append(changes, change)
+		} else {
+			recreate = append(recreate, change)
+		}
+	}
+	if s.Rootful != nil && *s.Rootful != mc.HostUser.Rootful {
+		setOpts.Rootful = s.Rootful
+		changes = append(changes, newChange("rootful", mc.HostUser.Rootful, *s.Rootful))
+	}
+	if s.UserModeNetworking != nil && *s.UserModeNetworking != mp.UserModeNetworkEnabled(mc) {
+		setOpts.UserModeNetworking = s.UserModeNetworking
+		changes = append(changes, newChange("userModeNetworking", mp.UserModeNetworkEnabled(mc), *s.UserModeNetworking))
+	}
+	if s.USBs != nil {
+		usbs, err := define.ParseUSBs(s.USBs)
+		if err != nil || !slices.Equal(usbs, mc.Resources.USBs) {
+			setOpts.USBs = &s.USBs
+			changes = append(changes, newChange("usbs", mc.Resources.USBs, s.USBs))
+		}
+	}
+
+	if s.Image != nil && *s.Image != macadamConfig.Image {
+		recreate = append(recreate, newChange("image", macadamConfig.Image, *s.Image))
+	}
+	if s.Username != nil && *s.Username != mc.SSH.RemoteUsername {
+		recreate = append(recreate, newChange("username", mc.SSH.RemoteUsername, *s.Username))
+	}
+	if s.IgnitionPath != nil && *s.IgnitionPath != macadamConfig.IgnitionPath {
+		recreate = append(recreate, newChange("ignitionPath", macadamConfig.IgnitionPath, *s.IgnitionPath))
+	}
+	if s.TimeZone != nil && *s.TimeZone != macadamConfig.TimeZone {
+		recreate = append(recreate, newChange("timezone", macadamConfig.TimeZone, *s.TimeZone))
+	}
+	if s.Provisioner != nil && machineconfig.Provisioner(*s.Provisioner) != macadamConfig.Provisioner {
+		recreate = append(recreate, newChange("provisioner", macadamConfig.Provisioner, *s.Provisioner))
+	}
+	if s.SkipPodmanConnection != nil && *s.SkipPodmanConnection != (len(macadamConfig.PodmanConnections) == 0) {
+		recreate = append(recreate, newChange("skipPodmanConnection", len(macadamConfig.PodmanConnections) == 0, *s.SkipPodmanConnection))
+	}
+	if s.Volumes != nil {
+		current := make([]string, 0, len(mc.Mounts))
+		for _, mount := range mc.Mounts {
+			current = append(current, mount.OriginalInput)
+		}
+		desired := make([]string, 0, len(s.Volumes))
+		for _, vol := range s.Volumes {
+			desired = append(desired, os.ExpandEnv(vol))
+		}
+		if !slices.Equal(current, desired) {
+			recreate = append(recreate, newChange("volumes", current, desired))
+		}
+	}
+
+	return setOpts, changes, recreate
+}
+
+func newChange(field string, current, desired any) FieldChange {
+	return FieldChange{
+		Field:   field,
+		Current: fmt.Sprint(current),
+		Desired: fmt.Sprint(desired),
+	}
+}
+
+func valueOr[T any](v *T, def T) T {
+	if v == nil {
+		return def
+	}
+	return *v
+}
@@ -0,0 +1,98 @@
+package spec
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/common/pkg/config"
+	"github.com/containers/podman/v5/pkg/machine/define"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/env"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+	"github.com/crc-org/macadam/pkg/qemu"
+	"github.com/crc-org/macadam/pkg/shim"
+)
+
+// fakeQEMUImg is a qemu-img which writes the qcow2 magic to the images it
+// creates, which is all machine creation needs from it
+const fakeQEMUImg = `#!/bin/sh
+case "$1" in
+create|convert) for a; do case "$a" in [0-9]*G) ;; *) last=$a;; esac; done; printf 'QFI\373' > "$last";;
+info) echo '{"format": "qcow2", "virtual-size": 107374182400}';;
+esac
+`
+
+// setupMachineEnv isolates the machine state of the test and puts a fake
+// qemu-img in the PATH
+func setupMachineEnv(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is needed to create machines")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(env.HomeEnvVar, filepath.Join(home, "macadam"))
+	bin := filepath.Join(home, "bin")
+	if err := os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bin, "qemu-img"), []byte(fakeQEMUImg), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return home
+}
+
+func TestInitWithIgnitionPath(t *testing.T) {
+	home := setupMachineEnv(t)
+	image := writeFile(t, filepath.Join(home, "disk.raw"), string(make([]byte, 1<<20)))
+	ignition := `{"ignition":{"version":"3.4.0"}}`
+	ignitionPath := writeFile(t, filepath.Join(home, "user.ign"), ignition)
+	specPath := writeFile(t, filepath.Join(home, "spec.yaml"), `name: ign
+image: `+image+`
+ignitionPath: `+ignitionPath+`
+timezone: UTC
+skipPodmanConnection: true
+`)
+
+	s, err := Load(specPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shim.Init(s.InitOptions(cfg), new(qemu.QEMUStubber)); err != nil {
+		t.Fatal(err)
+	}
+
+	dirs, err := env.GetMachineDirs(define.QemuVirt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc, err := vmconfigs.LoadMachineByName("ign", dirs)
+	if err != nil {
+		t.Fatalf("machine was not created: %v", err)
+	}
+	ignitionFile, err := mc.IgnitionFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(ignitionFile.GetPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != ignition {
+		t.Errorf("ignition file is %q, want the user provided %q", b, ignition)
+	}
+	macadamConfig, err := machineconfig.Load(mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if macadamConfig.IgnitionPath != ignitionPath {
+		t.Errorf("IgnitionPath is %q, want %q", macadamConfig.IgnitionPath, ignitionPath)
+	}
+}
@@ -0,0 +1,189 @@
+package spec
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/containers/common/pkg/strongunits"
+	"github.com/containers/podman/v5/pkg/machine/vmconfigs"
+	"github.com/crc-org/macadam/pkg/machineconfig"
+)
+
+func writeFile(t *testing.T, path, content string) string {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    *MachineSpec
+		wantErr bool
+	}{
+		{
+			name: "yaml",
+			content: `name: dev
+cpus: 4
+memory: 4096
+volumes: [/src:/src]
+userModeNetworking: false
+provisioner: cloud-init
+`,
+			want: &MachineSpec{
+				Name:               "dev",
+				CPUs:               ptr(uint64(4)),
+				Memory:             ptr(uint64(4096)),
+				Volumes:            []string{"/src:/src"},
+				UserModeNetworking: ptr(false),
+				Provisioner:        ptr("cloud-init"),
+			},
+		},
+		{
+			name:    "json",
+			content: `{"name": "dev", "diskSize": 50, "image": "https://example.com/disk.qcow2"}`,
+			want: &MachineSpec{
+				Name:     "dev",
+				DiskSize: ptr(uint64(50)),
+				Image:    ptr("https://example.com/disk.qcow2"),
+			},
+		},
+		{name: "empty", content: "", want: &MachineSpec{}},
+		{name: "unknown field", content: "name: dev\ncpu: 4\n", wantErr: true},
+		{name: "invalid type", content: "cpus: four\n", wantErr: true},
+		{name: "unknown provisioner", content: "provisioner: kickstart\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, filepath.Join(t.TempDir(), "spec.yaml"), tt.content)
+			got, err := Load(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeProvider is the provider of the machines Diff compares specs with
+type fakeProvider struct {
+	vmconfigs.VMProvider
+	userModeNetworking bool
+}
+
+func (p *fakeProvider) UserModeNetworkEnabled(*vmconfigs.MachineConfig) bool {
+	return p.userModeNetworking
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name         string
+		spec         MachineSpec
+		wantChanges  []string
+		wantRecreate []string
+	}{
+		{name: "empty spec"},
+		{
+			name: "same settings",
+			spec: MachineSpec{
+				CPUs:                 ptr(uint64(2)),
+				Memory:               ptr(uint64(2048)),
+				DiskSize:             ptr(uint64(100)),
+				Image:                ptr("disk.qcow2"),
+				Rootful:              ptr(false),
+				UserModeNetworking:   ptr(false),
+				TimeZone:             ptr("UTC"),
+				Provisioner:          ptr("ignition"),
+				SkipPodmanConnection: ptr(true),
+				Volumes:              []string{"/src:/src"},
+			},
+		},
+		{
+			name:        "resources",
+			spec:        MachineSpec{CPUs: ptr(uint64(4)), Memory: ptr(uint64(4096)), DiskSize: ptr(uint64(200))},
+			wantChanges: []string{"cpus", "memory", "diskSize"},
+		},
+		{
+			name:         "disk shrink",
+			spec:         MachineSpec{DiskSize: ptr(uint64(50))},
+			wantRecreate: []string{"diskSize"},
+		},
+		{
+			name:        "networking",
+			spec:        MachineSpec{Rootful: ptr(true), UserModeNetworking: ptr(true)},
+			wantChanges: []string{"rootful", "userModeNetworking"},
+		},
+		{
+			name: "creation settings",
+			spec: MachineSpec{
+				Image:                ptr("other.qcow2"),
+				Username:             ptr("admin"),
+				IgnitionPath:         ptr("/tmp/user.ign"),
+				TimeZone:             ptr("Europe/Paris"),
+				Provisioner:          ptr("cloud-init"),
+				SkipPodmanConnection: ptr(false),
+			},
+			wantRecreate: []string{"image", "username", "ignitionPath", "timezone", "provisioner", "skipPodmanConnection"},
+		},
+		{
+			name:         "volumes",
+			spec:         MachineSpec{Volumes: []string{}},
+			wantRecreate: []string{"volumes"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mc := &vmconfigs.MachineConfig{
+				Mounts: []*vmconfigs.Mount{{OriginalInput: "/src:/src"}},
+			}
+			mc.Resources.CPUs = 2
+			mc.Resources.Memory = strongunits.MiB(2048)
+			mc.Resources.DiskSize = strongunits.GiB(100)
+			mc.SSH.RemoteUsername = "core"
+			macadamConfig := &machineconfig.MachineConfig{
+				Provisioner: machineconfig.IgnitionProvisioner,
+				Image:       "disk.qcow2",
+				TimeZone:    "UTC",
+			}
+
+			setOpts, changes, recreate := tt.spec.Diff(mc, macadamConfig, &fakeProvider{})
+			if got := fields(changes); !reflect.DeepEqual(got, tt.wantChanges) {
+				t.Errorf("got changes %v, want %v", got, tt.wantChanges)
+			}
+			if got := fields(recreate); !reflect.DeepEqual(got, tt.wantRecreate) {
+				t.Errorf("got changes requiring to recreate the machine %v, want %v", got, tt.wantRecreate)
+			}
+			if (setOpts.CPUs != nil) != (tt.spec.CPUs != nil && *tt.spec.CPUs != 2) {
+				t.Errorf("CPUs set to %v", setOpts.CPUs)
+			}
+			if setOpts.DiskSize != nil && *setOpts.DiskSize < mc.Resources.DiskSize {
+				t.Errorf("disk shrunk to %d", *setOpts.DiskSize)
+			}
+		})
+	}
+}
+
+func fields(changes []FieldChange) []string {
+	var fields []string
+	for _, c := range changes {
+		fields = append(fields, c.Field)
+	}
+	return fields
+}